@@ -14,13 +14,19 @@ var (
 )
 
 func main() {
+	// --refresh goes before the command to hash every file again rather than
+	// trusting the local index
+	flag.BoolVar(&jam.RefreshIndex, "refresh", false, "rehash every file instead of using the local index")
 	flag.Parse()
+	os.Args = append(os.Args[:1], flag.Args()...)
 
 	switch {
 	case len(os.Args) == 1:
 		jam.Help(version, built)
 	case os.Args[1] == "login":
 		jam.Login()
+	case os.Args[1] == "register":
+		jam.Register()
 	case os.Args[1] == "init":
 		jam.InitConfig()
 	case os.Args[1] == "open":
@@ -29,16 +35,34 @@ func main() {
 		jam.Pull()
 	case os.Args[1] == "status":
 		jam.Status()
+	case os.Args[1] == "check-ignore":
+		jam.CheckIgnore()
+	case os.Args[1] == "diff":
+		jam.Diff()
 	case os.Args[1] == "push":
 		jam.Push()
+	case os.Args[1] == "sync" || os.Args[1] == "watch":
+		jam.Sync()
+	case os.Args[1] == "update":
+		jam.Update()
 	case os.Args[1] == "merge":
 		jam.Merge()
+	case os.Args[1] == "resolve":
+		jam.Resolve()
+	case os.Args[1] == "log":
+		jam.Log()
 	case os.Args[1] == "checkout":
 		jam.Checkout()
 	case os.Args[1] == "workspaces":
 		jam.ListWorkspaces()
 	case os.Args[1] == "projects":
 		jam.ListProjects()
+	case os.Args[1] == "members":
+		jam.Members()
+	case os.Args[1] == "visibility":
+		jam.Visibility()
+	case os.Args[1] == "token":
+		jam.Token()
 	case os.Args[1] == "logout":
 		jam.Logout()
 	case os.Args[1] == "delete":
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/zdgeier/jamhub/internal/jamenv"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverconfig"
 )
 
 var (
@@ -17,14 +19,32 @@ var (
 )
 
 func main() {
+	gc := flag.Bool("gc", false, "remove op data that no commit or workspace refers to and exit, fails while the server is running")
+	configFlags := serverconfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	config, err := configFlags.Load()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if *gc {
+		stats, err := jamhubgrpc.CollectGarbage(config)
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Printf("Reclaimed %d bytes from %d projects and %d deleted workspaces", stats.Bytes, stats.Projects, stats.Workspaces)
+		return
+	}
+
 	log.Println("version: " + version)
 	log.Println("built: " + built)
-	log.Println("env: " + jamenv.Env().String())
-	closer, err := jamhubgrpc.New()
+	log.Println("env: " + config.Env)
+	closer, err := jamhubgrpc.New(config)
 	if err != nil {
 		log.Panic(err)
 	}
-	log.Println("JamHub server is running...")
+	log.Printf("JamHub server is running on %s...", strings.Join(config.Listen, ", "))
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
@@ -57,21 +57,21 @@ async function setup() {
   let fileResp;
   if (window.location.pathname.includes("committedfile")) {
     const currentPath = splitPath.slice(4).join("/");
-    const currentCommitResp = await fetch(`/api/projects/${projectName}`);
+    const currentCommitResp = await fetch(`/api/projects/${projectName}?owner=${encodeURIComponent(decodeURIComponent(splitPath[1]))}`);
     const currentCommitJson = await currentCommitResp.json();
     const currentCommitId = currentCommitJson.commit_id ?? 0;
     fileResp = await fetch(
-      `/api/projects/${projectName}/committedfile/${currentCommitId}/${currentPath}`,
+      `/api/projects/${projectName}/committedfile/${currentCommitId}/${currentPath}?owner=${encodeURIComponent(decodeURIComponent(splitPath[1]))}`,
     );
   } else {
     const workspaceName = splitPath[4];
-    const workspaceInfoResp = await fetch(`/api/projects/${projectName}/workspaces/${workspaceName}`);
+    const workspaceInfoResp = await fetch(`/api/projects/${projectName}/workspaces/${workspaceName}?owner=${encodeURIComponent(decodeURIComponent(splitPath[1]))}`);
     const workspaceInfoJson = await workspaceInfoResp.json();
     const currentChangeId = workspaceInfoJson.change_id ?? 0;
     const workspaceId = workspaceInfoJson.workspace_id ?? 0;
     const currentPath = splitPath.slice(5).join("/");
     fileResp = await fetch(
-      `/api/projects/${projectName}/workspacefile/${workspaceId}/${currentChangeId}/${currentPath}`,
+      `/api/projects/${projectName}/workspacefile/${workspaceId}/${currentChangeId}/${currentPath}?owner=${encodeURIComponent(decodeURIComponent(splitPath[1]))}`,
     );
   }
   const doc = await fileResp.text();
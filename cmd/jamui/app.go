@@ -87,7 +87,7 @@ func (a *App) Checkout(workspaceName string) string {
 				log.Panic(err)
 			}
 
-			err = jam.ApplyFileListDiffCommit(a.client, state.ProjectId, commitResp.CommitId, diffRemoteToLocalResp)
+			err = jam.ApplyFileListDiffCommit(a.client, state.ProjectId, commitResp.CommitId, &pb.FileMetadata{}, diffRemoteToLocalResp)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -133,8 +133,13 @@ func (a *App) Checkout(workspaceName string) string {
 			log.Panic(err)
 		}
 
+		baseFileMetadata, err := jam.ReadStateFileList(a.client, state)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		if jam.DiffHasChanges(remoteToLocalDiff) {
-			err = jam.ApplyFileListDiffWorkspace(a.client, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.ChangeId, remoteToLocalDiff)
+			err = jam.ApplyFileListDiffWorkspace(a.client, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.ChangeId, baseFileMetadata, remoteToLocalDiff)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -23,34 +23,35 @@ func (c *Chunker) CreateSignature(sw ChunkHashWriter) error {
 			return err
 		}
 
-		sw(&pb.ChunkHash{
+		err = sw(&pb.ChunkHash{
 			Offset: chunk.Offset,
 			Length: chunk.Length,
 			Hash:   chunk.Hash,
 		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (c *Chunker) ApplyDelta(alignedTarget io.Writer, target io.ReadSeeker, ops chan *pb.Operation) error {
 	var err error
-	var n int
-	var block []byte
+	var buffer []byte
 
 	writeBlock := func(op *pb.Operation) error {
 		_, err := target.Seek(int64(op.ChunkHash.Offset), 0)
 		if err != nil {
 			return err
 		}
-		buffer := make([]byte, int(op.ChunkHash.Length)) // TODO: reuse this buffer
-		n, err = target.Read(buffer)
-		if err != nil {
-			if err != io.ErrUnexpectedEOF {
-				return err
-			}
+		if uint64(cap(buffer)) < op.ChunkHash.Length {
+			buffer = make([]byte, op.ChunkHash.Length)
+		}
+		n, err := io.ReadFull(target, buffer[:op.ChunkHash.Length])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
 		}
-		block = buffer[:n]
-		_, err = alignedTarget.Write(block)
+		_, err = alignedTarget.Write(buffer[:n])
 		if err != nil {
 			return err
 		}
@@ -77,9 +78,19 @@ func (c *Chunker) ApplyDelta(alignedTarget io.Writer, target io.ReadSeeker, ops
 	return nil
 }
 
-// Writes delta ops that are diffs from chunkhashes
+// CreateDelta writes the operations that rebuild the chunker's data from the
+// chunks described by chunkHashes. Chunks are matched by content rather than
+// position so data that has moved, such as everything after an insertion, is
+// written as OpBlock operations pointing at its old offset.
 func (c *Chunker) CreateDelta(chunkHashes []*pb.ChunkHash, ops OperationWriter) error {
-	for i := 0; ; i++ {
+	existing := make(map[uint64]*pb.ChunkHash, len(chunkHashes))
+	for _, chunkHash := range chunkHashes {
+		if _, found := existing[chunkHash.Hash]; !found {
+			existing[chunkHash.Hash] = chunkHash
+		}
+	}
+
+	for {
 		chunk, err := c.Next()
 		if err == io.EOF {
 			break
@@ -88,26 +99,19 @@ func (c *Chunker) CreateDelta(chunkHashes []*pb.ChunkHash, ops OperationWriter)
 			return err
 		}
 
-		// Has valid chunk hash to compare against
-		if i < len(chunkHashes) {
-			chunkHash := chunkHashes[i]
-			if chunkHash.Hash == chunk.Hash && chunkHash.Length == chunk.Length && chunkHash.Offset == chunk.Offset {
-				ops(&pb.Operation{
-					Type:      pb.Operation_OpBlock,
-					ChunkHash: chunkHash,
-				})
-			} else {
-				ops(&pb.Operation{
-					Type:  pb.Operation_OpData,
-					Chunk: chunk,
-				})
-			}
+		if chunkHash, found := existing[chunk.Hash]; found && chunkHash.Length == chunk.Length {
+			err = ops(&pb.Operation{
+				Type:      pb.Operation_OpBlock,
+				ChunkHash: chunkHash,
+			})
 		} else {
-			ops(&pb.Operation{
+			err = ops(&pb.Operation{
 				Type:  pb.Operation_OpData,
 				Chunk: chunk,
 			})
-
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
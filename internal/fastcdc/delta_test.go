@@ -182,6 +182,100 @@ func Test_GenData(t *testing.T) {
 	}
 }
 
+// roundTrip creates a delta of source against target, applies it to target and
+// returns the result along with the number of bytes sent as OpData.
+func roundTrip(t *testing.T, source, target []byte) ([]byte, int) {
+	opts := Options{
+		AverageSize: 1024 * 64,
+		Seed:        84372,
+	}
+	targetChunker, err := NewChunker(bytes.NewReader(target), opts)
+	assertNoError(t, err)
+	sig := make([]*pb.ChunkHash, 0)
+	err = targetChunker.CreateSignature(func(ch *pb.ChunkHash) error {
+		sig = append(sig, ch)
+		return nil
+	})
+	assertNoError(t, err)
+
+	sourceChunker, err := NewChunker(bytes.NewReader(source), opts)
+	assertNoError(t, err)
+	ops := make(chan *pb.Operation, 1024)
+	dataBytes := 0
+	err = sourceChunker.CreateDelta(sig, func(op *pb.Operation) error {
+		if op.Type == pb.Operation_OpData {
+			b := make([]byte, len(op.Chunk.Data))
+			copy(b, op.Chunk.Data)
+			op.Chunk.Data = b
+			dataBytes += len(b)
+		}
+		ops <- op
+		return nil
+	})
+	assertNoError(t, err)
+	close(ops)
+
+	result := new(bytes.Buffer)
+	err = targetChunker.ApplyDelta(result, bytes.NewReader(target), ops)
+	assertNoError(t, err)
+	return result.Bytes(), dataBytes
+}
+
+func TestDeltaMovedData(t *testing.T) {
+	a := randBytes(512*1024, 1)
+	b := randBytes(512*1024, 2)
+	c := randBytes(512*1024, 3)
+	target := bytes.Join([][]byte{a, b, c}, nil)
+
+	tests := []struct {
+		description string
+		source      []byte
+		maxData     int
+	}{
+		{"insertion near the start", bytes.Join([][]byte{a[:100], []byte("x"), a[100:], b, c}, nil), 512 * 1024},
+		{"insertion in the middle", bytes.Join([][]byte{a, b[:1000], randBytes(5000, 4), b[1000:], c}, nil), 512 * 1024},
+		{"deletion near the start", bytes.Join([][]byte{a[:100], a[200:], b, c}, nil), 512 * 1024},
+		{"reordered sections", bytes.Join([][]byte{c, a, b}, nil), 3 * 512 * 1024 / 2},
+		{"repeated section", bytes.Join([][]byte{a, b, b, c}, nil), 512 * 1024},
+		{"unchanged", target, 0},
+	}
+
+	for _, test := range tests {
+		result, dataBytes := roundTrip(t, test.source, target)
+		if !bytes.Equal(result, test.source) {
+			t.Errorf("%s: result is different from the source", test.description)
+		}
+		if dataBytes > test.maxData {
+			t.Errorf("%s: expected at most %d bytes of data but sent %d", test.description, test.maxData, dataBytes)
+		}
+	}
+}
+
+func TestChunkersAgree(t *testing.T) {
+	data := randBytes(1024*1024, 5)
+	chunks := func() []uint64 {
+		chunker, err := NewChunker(bytes.NewReader(data), defaultOpts)
+		assertNoError(t, err)
+		lengths := make([]uint64, 0)
+		err = chunker.CreateSignature(func(ch *pb.ChunkHash) error {
+			lengths = append(lengths, ch.Length)
+			return nil
+		})
+		assertNoError(t, err)
+		return lengths
+	}
+
+	first, second := chunks(), chunks()
+	if len(first) != len(second) {
+		t.Fatalf("chunkers found %d and %d chunks in the same data", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("chunk %d: lengths %d and %d differ", i, first[i], second[i])
+		}
+	}
+}
+
 func assertNoError(t *testing.T, err error) {
 	if err != nil {
 		t.Errorf("expected no error but received: %v", err)
@@ -35,6 +35,7 @@ type Chunker struct {
 
 	maskS uint64
 	maskL uint64
+	table [256]uint64
 
 	rd io.Reader
 
@@ -100,10 +101,6 @@ func NewChunker(rd io.Reader, opts Options) (*Chunker, error) {
 		return nil, err
 	}
 
-	for i := 0; i < len(table); i++ {
-		table[i] = table[i] ^ opts.Seed
-	}
-
 	normalization := opts.Normalization
 	if opts.DisableNormalization {
 		normalization = 0
@@ -122,6 +119,11 @@ func NewChunker(rd io.Reader, opts Options) (*Chunker, error) {
 		buf:      make([]byte, opts.BufSize),
 		cursor:   opts.BufSize,
 	}
+	// Seed a copy of the table so every chunker with the same options finds
+	// the same boundaries
+	for i := 0; i < len(table); i++ {
+		chunker.table[i] = table[i] ^ opts.Seed
+	}
 
 	return chunker, nil
 }
@@ -191,14 +193,14 @@ func (c *Chunker) nextChunk(data []byte) (uint64, uint64) {
 	n := min(len(data), c.maxSize)
 
 	for ; i < uint64(min(n, c.normSize)); i++ {
-		fp = (fp << 1) + table[data[i]]
+		fp = (fp << 1) + c.table[data[i]]
 		if (fp & c.maskS) == 0 {
 			return i + 1, fp
 		}
 	}
 
 	for ; i < uint64(n); i++ {
-		fp = (fp << 1) + table[data[i]]
+		fp = (fp << 1) + c.table[data[i]]
 		if (fp & c.maskL) == 0 {
 			return i + 1, fp
 		}
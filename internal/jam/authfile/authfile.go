@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io/fs"
 	"log"
 	"os"
 	"path"
@@ -13,80 +12,175 @@ import (
 	"github.com/zdgeier/jamhub/internal/jamhub/clientauth"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// connect opens a client to the server, replaced in tests.
+var connect = jamhubgrpc.Connect
+
 type AuthFile struct {
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// RefreshToken gets a new Token once it expires, if the login came with
+	// one
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
+// Authorize returns the credentials to use for requests. An access token in
+// JAMHUB_TOKEN takes precedence over the login stored in the home directory so
+// that jam can run in CI without a browser.
 func Authorize() (AuthFile, error) {
+	return authorize(false)
+}
+
+// Login is Authorize that logs in with the device authorization grant when
+// there is no login yet, printing a code to enter on another device instead
+// of opening a browser.
+func Login(device bool) (AuthFile, error) {
+	return authorize(device)
+}
+
+func authorize(device bool) (AuthFile, error) {
+	if token := os.Getenv("JAMHUB_TOKEN"); token != "" {
+		return check(clientauth.Tokens{AccessToken: token})
+	}
+
 	rawFile, err := os.ReadFile(authPath())
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if errors.Is(err, os.ErrNotExist) {
+		return login(device)
+	}
+	if err != nil {
 		return AuthFile{}, err
 	}
 
-	if errors.Is(err, os.ErrNotExist) {
-		token, err := clientauth.AuthorizeUser()
-		if err != nil {
-			log.Panic(err)
-		}
+	authFile := AuthFile{}
+	err = json.Unmarshal(rawFile, &authFile)
+	if err != nil {
+		return authFile, err
+	}
 
-		apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
-			AccessToken: string(token),
-		})
-		if err != nil {
-			log.Panic(err)
-		}
-		defer closer()
+	_, err = check(clientauth.Tokens{AccessToken: authFile.Token})
+	if status.Code(err) != codes.Unauthenticated {
+		return authFile, err
+	}
 
-		resp, err := apiClient.Ping(context.Background(), &pb.PingRequest{})
-		if err != nil {
-			log.Panic(err)
+	// The token expired or was revoked, so get a new one with the refresh
+	// token or by logging in again
+	if authFile.RefreshToken != "" {
+		tokens, err := clientauth.Refresh(authFile.RefreshToken)
+		if err == nil {
+			return save(tokens)
 		}
+		log.Println("Could not refresh the login:", err)
+	}
+	err = os.Remove(authPath())
+	if err != nil {
+		return authFile, err
+	}
+	return login(device)
+}
 
-		authFile := AuthFile{
-			Token:    token,
-			Username: resp.GetUsername(),
-		}
+// check returns the credentials for tokens after making sure the server
+// accepts them.
+func check(tokens clientauth.Tokens) (AuthFile, error) {
+	apiClient, closer, err := connect(&oauth2.Token{
+		AccessToken: tokens.AccessToken,
+	})
+	if err != nil {
+		return AuthFile{}, err
+	}
+	defer closer()
 
-		data, err := json.Marshal(authFile)
-		if err != nil {
-			log.Panic(err)
-		}
+	resp, err := apiClient.Ping(context.Background(), &pb.PingRequest{})
+	if err != nil {
+		return AuthFile{}, err
+	}
 
-		err = os.WriteFile(authPath(), data, fs.ModePerm)
-		if err != nil {
-			log.Panic(err)
-		}
-		return authFile, nil
+	return AuthFile{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Username:     resp.GetUsername(),
+	}, nil
+}
+
+// save stores the credentials for tokens in the auth file.
+func save(tokens clientauth.Tokens) (AuthFile, error) {
+	authFile, err := check(tokens)
+	if err != nil {
+		return authFile, err
 	}
 
-	authFile := AuthFile{}
-	err = json.Unmarshal(rawFile, &authFile)
+	data, err := json.Marshal(authFile)
 	if err != nil {
 		return authFile, err
 	}
+	// The file holds a refresh token so only the user can read it
+	return authFile, os.WriteFile(authPath(), data, 0600)
+}
 
-	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
-		AccessToken: string(authFile.Token),
-	})
+// login logs in with the identity provider that the server uses and saves the
+// credentials.
+func login(device bool) (AuthFile, error) {
+	apiClient, closer, err := connect(nil)
 	if err != nil {
-		log.Panic(err)
+		return AuthFile{}, err
 	}
 	defer closer()
 
-	_, err = apiClient.Ping(context.Background(), &pb.PingRequest{})
+	resp, err := apiClient.GetAuthProvider(context.Background(), &pb.GetAuthProviderRequest{})
 	if err != nil {
-		// If outdated token
-		err := os.Remove(authPath())
+		return AuthFile{}, err
+	}
+	if resp.GetProvider() != pb.GetAuthProviderResponse_Builtin {
+		var tokens clientauth.Tokens
+		if device {
+			tokens, err = clientauth.AuthorizeDevice()
+		} else {
+			tokens, err = clientauth.AuthorizeUser()
+		}
 		if err != nil {
-			return authFile, err
+			return AuthFile{}, err
 		}
-		Authorize()
+		return save(tokens)
 	}
 
-	return authFile, nil
+	username, password, err := clientauth.PromptCredentials(false)
+	if err != nil {
+		return AuthFile{}, err
+	}
+	loginResp, err := apiClient.Login(context.Background(), &pb.LoginRequest{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return AuthFile{}, err
+	}
+	return save(clientauth.Tokens{AccessToken: loginResp.GetToken()})
+}
+
+// Register creates a user with the server's built-in identity provider and
+// logs in as them.
+func Register() (AuthFile, error) {
+	username, password, err := clientauth.PromptCredentials(true)
+	if err != nil {
+		return AuthFile{}, err
+	}
+
+	apiClient, closer, err := connect(nil)
+	if err != nil {
+		return AuthFile{}, err
+	}
+	defer closer()
+
+	resp, err := apiClient.Register(context.Background(), &pb.RegisterRequest{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return AuthFile{}, err
+	}
+	return save(clientauth.Tokens{AccessToken: resp.GetToken()})
 }
 
 func Logout() error {
@@ -0,0 +1,107 @@
+package authfile
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testClient accepts the tokens of users, naming each user after their
+// token.
+type testClient struct {
+	pb.JamHubClient
+	token string
+	users map[string]string
+}
+
+func (c testClient) Ping(ctx context.Context, in *pb.PingRequest, opts ...grpc.CallOption) (*pb.PingResponse, error) {
+	username, found := c.users[c.token]
+	if !found {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
+	}
+	return &pb.PingResponse{Username: username}, nil
+}
+
+func TestAuthorize(t *testing.T) {
+	users := map[string]string{
+		"env token":                  "ci",
+		"file token":                 "alice",
+		"local authentication token": "alice",
+	}
+	tests := []struct {
+		name     string
+		envToken string
+		authFile AuthFile
+		expected AuthFile
+		saved    AuthFile
+	}{
+		{
+			name:     "token from the environment",
+			envToken: "env token",
+			authFile: AuthFile{Username: "alice", Token: "file token"},
+			expected: AuthFile{Username: "ci", Token: "env token"},
+			saved:    AuthFile{Username: "alice", Token: "file token"},
+		},
+		{
+			name:     "token from the auth file",
+			authFile: AuthFile{Username: "alice", Token: "file token"},
+			expected: AuthFile{Username: "alice", Token: "file token"},
+			saved:    AuthFile{Username: "alice", Token: "file token"},
+		},
+		{
+			name:     "expired token refreshed",
+			authFile: AuthFile{Username: "alice", Token: "expired token", RefreshToken: "refresh"},
+			expected: AuthFile{Username: "alice", Token: "local authentication token"},
+			saved:    AuthFile{Username: "alice", Token: "local authentication token"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Refreshing locally always returns the local tokens
+			t.Setenv("JAM_ENV", "local")
+			t.Setenv("HOME", t.TempDir())
+			t.Setenv("JAMHUB_TOKEN", test.envToken)
+			connect = func(token *oauth2.Token) (pb.JamHubClient, func(), error) {
+				return testClient{token: token.AccessToken, users: users}, func() {}, nil
+			}
+			t.Cleanup(func() { connect = jamhubgrpc.Connect })
+
+			data, err := json.Marshal(test.authFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(authPath(), data, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authFile, err := Authorize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authFile != test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, authFile)
+			}
+			data, err = os.ReadFile(authPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved AuthFile
+			err = json.Unmarshal(data, &saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved != test.saved {
+				t.Fatalf("expected %+v to be saved, got %+v", test.saved, saved)
+			}
+		})
+	}
+}
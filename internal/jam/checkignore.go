@@ -0,0 +1,41 @@
+package jam
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckIgnore prints whether each path given is ignored and which rule in
+// which ignore file decided it.
+func CheckIgnore() {
+	if len(os.Args) < 3 {
+		fmt.Println("jam check-ignore <path>...")
+		return
+	}
+
+	ignorer := loadIgnorer()
+	for _, arg := range os.Args[2:] {
+		path := filepath.ToSlash(filepath.Clean(arg))
+		isDir := strings.HasSuffix(arg, "/")
+		if info, err := os.Stat(arg); err == nil {
+			isDir = info.IsDir()
+		}
+
+		if alwaysIgnoredPath(path) {
+			fmt.Printf("%s: ignored, jam never syncs .git or .jamhub files\n", path)
+			continue
+		}
+
+		pattern, ignored := ignorer.MatchingPattern(path, isDir)
+		switch {
+		case pattern == nil:
+			fmt.Printf("%s: not ignored, no rule matches\n", path)
+		case ignored:
+			fmt.Printf("%s: ignored by %s:%d:%s\n", path, pattern.Source, pattern.Line, pattern.Text)
+		default:
+			fmt.Printf("%s: not ignored, re-included by %s:%d:%s\n", path, pattern.Source, pattern.Line, pattern.Text)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package jam
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zdgeier/jamhub/gen/pb"
@@ -15,10 +18,17 @@ import (
 )
 
 func Checkout() {
-	if len(os.Args) != 3 {
+	checkoutCmd := flag.NewFlagSet("checkout", flag.ExitOnError)
+	newWorkspace := checkoutCmd.String("b", "", "create a new workspace, starting from the given commit if there is one")
+	checkoutCmd.Parse(os.Args[2:])
+	target := checkoutCmd.Arg(0)
+	if checkoutCmd.NArg() > 1 || (checkoutCmd.NArg() == 0 && *newWorkspace == "") || (*newWorkspace != "" && target != "" && !strings.HasPrefix(target, "@")) {
 		fmt.Println("jam checkout <workspace name>")
+		fmt.Println("jam checkout @<commit id>")
+		fmt.Println("jam checkout -b <workspace name> [@<commit id>]")
 		return
 	}
+
 	authFile, err := authfile.Authorize()
 	if err != nil {
 		panic(err)
@@ -44,8 +54,31 @@ func Checkout() {
 		os.Exit(0)
 	}
 
+	if strings.HasPrefix(target, "@") {
+		commitId, err := strconv.ParseUint(target[1:], 10, 64)
+		if err != nil {
+			fmt.Println("jam checkout @<commit id>")
+			os.Exit(1)
+		}
+		checkoutCommit(apiClient, state, commitId, *newWorkspace)
+		return
+	}
+	if *newWorkspace != "" {
+		target = *newWorkspace
+	}
+
 	if state.CommitInfo == nil || state.WorkspaceInfo != nil {
-		if os.Args[2] == "main" || os.Args[2] == "mainline" {
+		if *newWorkspace == "" && target != "main" && target != "mainline" {
+			nameResp, err := apiClient.GetWorkspaceName(ctx, &pb.GetWorkspaceNameRequest{ProjectId: state.ProjectId, WorkspaceId: state.WorkspaceInfo.WorkspaceId})
+			if err != nil {
+				log.Panic(err)
+			}
+			if nameResp.GetWorkspaceName() == target {
+				fmt.Println("Already on", target)
+				return
+			}
+		}
+		if target == "main" || target == "mainline" {
 			fileMetadata := ReadLocalFileList()
 			localToRemoteDiff, err := DiffLocalToRemoteWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId, fileMetadata)
 			if err != nil {
@@ -63,13 +96,18 @@ func Checkout() {
 				log.Panic(err)
 			}
 
-			diffRemoteToLocalResp, err := DiffRemoteToLocalCommit(apiClient, state.ProjectId, commitResp.CommitId, &pb.FileMetadata{})
+			diffRemoteToLocalResp, err := DiffRemoteToLocalCommit(apiClient, state.ProjectId, commitResp.CommitId, fileMetadata)
+			if err != nil {
+				log.Panic(err)
+			}
+			baseFileMetadata, err := ReadStateFileList(apiClient, state)
 			if err != nil {
 				log.Panic(err)
 			}
 
-			err = ApplyFileListDiffCommit(apiClient, state.ProjectId, commitResp.CommitId, diffRemoteToLocalResp)
+			err = ApplyFileListDiffCommit(apiClient, state.ProjectId, commitResp.CommitId, baseFileMetadata, diffRemoteToLocalResp)
 			if err != nil {
+				exitIfUnpushed(err)
 				log.Panic(err)
 			}
 
@@ -89,7 +127,7 @@ func Checkout() {
 		}
 	}
 
-	if os.Args[2] == "main" || os.Args[2] == "mainline" {
+	if target == "main" || target == "mainline" {
 		fmt.Println("`main` and `mainline` are workspace names reserved for commits. Please choose another workspace name.")
 		os.Exit(1)
 	}
@@ -99,10 +137,10 @@ func Checkout() {
 		panic(err)
 	}
 
-	if workspaceId, ok := resp.GetWorkspaces()[os.Args[2]]; ok {
-		if workspaceId == state.WorkspaceInfo.WorkspaceId {
-			fmt.Println("Already on", os.Args[2])
-			return
+	if workspaceId, ok := resp.GetWorkspaces()[target]; ok {
+		if *newWorkspace != "" {
+			fmt.Println("Workspace", target, "already exists.")
+			os.Exit(1)
 		}
 
 		changeResp, err := apiClient.GetWorkspaceCurrentChange(context.TODO(), &pb.GetWorkspaceCurrentChangeRequest{ProjectId: state.ProjectId, WorkspaceId: workspaceId})
@@ -112,14 +150,22 @@ func Checkout() {
 
 		// if workspace already exists, do a pull
 		fileMetadata := ReadLocalFileList()
-		remoteToLocalDiff, err := DiffRemoteToLocalWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.ChangeId, fileMetadata)
+		remoteToLocalDiff, err := DiffRemoteToLocalWorkspace(apiClient, state.ProjectId, workspaceId, changeResp.ChangeId, fileMetadata)
+		if err != nil {
+			log.Panic(err)
+		}
+		baseFileMetadata, err := ReadStateFileList(apiClient, state)
 		if err != nil {
 			log.Panic(err)
 		}
+		if conflicts := keepLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff); len(conflicts) > 0 {
+			exitIfUnpushed(&UnpushedChangesError{Paths: conflicts})
+		}
 
 		if DiffHasChanges(remoteToLocalDiff) {
-			err = ApplyFileListDiffWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.ChangeId, remoteToLocalDiff)
+			err = ApplyFileListDiffWorkspace(apiClient, state.ProjectId, workspaceId, changeResp.ChangeId, baseFileMetadata, remoteToLocalDiff)
 			if err != nil {
+				exitIfUnpushed(err)
 				log.Panic(err)
 			}
 			for key, val := range remoteToLocalDiff.GetDiffs() {
@@ -134,7 +180,7 @@ func Checkout() {
 		err = statefile.StateFile{
 			ProjectId: state.ProjectId,
 			WorkspaceInfo: &statefile.WorkspaceInfo{
-				WorkspaceId: state.WorkspaceInfo.WorkspaceId,
+				WorkspaceId: workspaceId,
 				ChangeId:    changeResp.ChangeId,
 			},
 		}.Save()
@@ -143,7 +189,7 @@ func Checkout() {
 		}
 	} else {
 		// otherwise, just create a new workspace
-		resp, err := apiClient.CreateWorkspace(ctx, &pb.CreateWorkspaceRequest{ProjectId: state.ProjectId, WorkspaceName: os.Args[2]})
+		resp, err := apiClient.CreateWorkspace(ctx, &pb.CreateWorkspaceRequest{ProjectId: state.ProjectId, WorkspaceName: target})
 		if err != nil {
 			log.Panic(err)
 		}
@@ -157,6 +203,107 @@ func Checkout() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("Switched to new workspace", os.Args[2]+".")
+		fmt.Println("Switched to new workspace", target+".")
+	}
+}
+
+// checkoutCommit replaces the local files with the files as of commitId. If a
+// workspace name is given a new workspace is started from the commit, otherwise
+// the commit is checked out read-only.
+func checkoutCommit(apiClient pb.JamHubClient, state statefile.StateFile, commitId uint64, workspaceName string) {
+	if workspaceName == "main" || workspaceName == "mainline" {
+		fmt.Println("`main` and `mainline` are workspace names reserved for commits. Please choose another workspace name.")
+		os.Exit(1)
+	}
+
+	if state.WorkspaceInfo != nil {
+		fileMetadata := ReadLocalFileList()
+		remoteFileMetadata, err := readWorkspaceFileList(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId)
+		if err != nil {
+			log.Panic(err)
+		}
+		if fileListContentChanged(fileMetadata, remoteFileMetadata) {
+			fmt.Println("Some changes locally have not been pushed. Run `jam push` to push your local changes.")
+			os.Exit(1)
+		}
+	}
+
+	commitResp, err := apiClient.GetProjectCurrentCommit(context.Background(), &pb.GetProjectCurrentCommitRequest{
+		ProjectId: state.ProjectId,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if commitId > commitResp.GetCommitId() {
+		fmt.Printf("Commit %d does not exist, the latest commit is %d.\n", commitId, commitResp.GetCommitId())
+		os.Exit(1)
+	}
+
+	var workspaceId uint64
+	if workspaceName != "" {
+		workspacesResp, err := apiClient.ListWorkspaces(context.Background(), &pb.ListWorkspacesRequest{ProjectId: state.ProjectId})
+		if err != nil {
+			log.Panic(err)
+		}
+		if _, ok := workspacesResp.GetWorkspaces()[workspaceName]; ok {
+			fmt.Println("Workspace", workspaceName, "already exists.")
+			os.Exit(1)
+		}
+
+		resp, err := apiClient.CreateWorkspace(context.Background(), &pb.CreateWorkspaceRequest{
+			ProjectId:       state.ProjectId,
+			WorkspaceName:   workspaceName,
+			UseBaseCommitId: true,
+			BaseCommitId:    commitId,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		workspaceId = resp.GetWorkspaceId()
+	}
+
+	fileMetadata := ReadLocalFileList()
+	remoteToLocalDiff, err := DiffRemoteToLocalCommit(apiClient, state.ProjectId, commitId, fileMetadata)
+	if err != nil {
+		log.Panic(err)
+	}
+	baseFileMetadata, err := ReadStateFileList(apiClient, state)
+	if err != nil {
+		log.Panic(err)
+	}
+	if conflicts := keepLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff); len(conflicts) > 0 {
+		exitIfUnpushed(&UnpushedChangesError{Paths: conflicts})
+	}
+	if DiffHasChanges(remoteToLocalDiff) {
+		err = ApplyFileListDiffCommit(apiClient, state.ProjectId, commitId, baseFileMetadata, remoteToLocalDiff)
+		if err != nil {
+			exitIfUnpushed(err)
+			log.Panic(err)
+		}
+	}
+
+	if workspaceName != "" {
+		err = statefile.StateFile{
+			ProjectId: state.ProjectId,
+			WorkspaceInfo: &statefile.WorkspaceInfo{
+				WorkspaceId: workspaceId,
+			},
+		}.Save()
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Switched to new workspace %s starting from commit %d.\n", workspaceName, commitId)
+		return
+	}
+
+	err = statefile.StateFile{
+		ProjectId: state.ProjectId,
+		CommitInfo: &statefile.CommitInfo{
+			CommitId: commitId,
+		},
+	}.Save()
+	if err != nil {
+		log.Panic(err)
 	}
+	fmt.Printf("Checked out commit %d. Changes cannot be pushed here, run `jam checkout -b <workspace name> @%d` to start a workspace from it.\n", commitId, commitId)
 }
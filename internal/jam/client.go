@@ -3,18 +3,22 @@ package jam
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/zdgeier/jamhub/gen/pb"
 	"github.com/zdgeier/jamhub/internal/fastcdc"
+	"github.com/zdgeier/jamhub/internal/jam/indexfile"
 	"github.com/zdgeier/jamhub/internal/jam/jamignore"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
 	"github.com/zdgeier/jamhub/internal/jamhub/file"
 	"github.com/zeebo/xxh3"
 	"google.golang.org/protobuf/proto"
@@ -31,8 +35,9 @@ func DiffHasChanges(diff *pb.FileMetadataDiff) bool {
 }
 
 type PathFile struct {
-	path string
-	file *pb.File
+	path  string
+	file  *pb.File
+	entry *indexfile.Entry
 }
 
 type PathInfo struct {
@@ -40,110 +45,324 @@ type PathInfo struct {
 	isDir bool
 }
 
-func worker(pathInfos <-chan PathInfo, results chan<- PathFile) {
+// RefreshIndex makes ReadLocalFileList hash every file again instead of
+// trusting the hashes cached in the local index.
+var RefreshIndex bool
+
+func worker(index indexfile.IndexFile, pathInfos <-chan PathInfo, results chan<- PathFile) {
 	for pathInfo := range pathInfos {
-		osFile, err := os.Open(pathInfo.path)
+		stat, err := os.Lstat(pathInfo.path)
 		if err != nil {
 			fmt.Println("Could not open ", pathInfo.path, ":", err)
 			results <- PathFile{}
 			continue
 		}
 
-		stat, err := osFile.Stat()
-		if err != nil {
-			panic(err)
-		}
-
 		var file *pb.File
-		if pathInfo.isDir {
+		var entry *indexfile.Entry
+		if stat.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(pathInfo.path)
+			if err != nil {
+				fmt.Println("Could not read link ", pathInfo.path, ":", err)
+				results <- PathFile{}
+				continue
+			}
+			b := xxh3.Hash128([]byte(target)).Bytes()
+
+			file = &pb.File{
+				ModTime:       timestamppb.New(stat.ModTime()),
+				Hash:          b[:],
+				Mode:          uint32(stat.Mode().Perm()),
+				SymlinkTarget: target,
+			}
+		} else if pathInfo.isDir {
 			file = &pb.File{
 				ModTime: timestamppb.New(stat.ModTime()),
 				Dir:     true,
+				Mode:    uint32(stat.Mode().Perm()),
 			}
 		} else {
-			data, err := os.ReadFile(pathInfo.path)
-			if err != nil {
-				fmt.Println("Could not read ", pathInfo.path, "(jamhub does not support symlinks)")
-				results <- PathFile{}
-				continue
+			hash, found := index.Lookup(pathInfo.path, stat)
+			if !found {
+				hash, err = hashFile(pathInfo.path)
+				if err != nil {
+					fmt.Println("Could not read ", pathInfo.path, ":", err)
+					results <- PathFile{}
+					continue
+				}
 			}
-			b := xxh3.Hash128(data).Bytes()
+			newEntry := indexfile.NewEntry(stat, hash)
+			entry = &newEntry
 
 			file = &pb.File{
 				ModTime: timestamppb.New(stat.ModTime()),
 				Dir:     false,
-				Hash:    b[:],
+				Hash:    hash,
+				Mode:    uint32(stat.Mode().Perm()),
 			}
 		}
-		osFile.Close()
-		results <- PathFile{pathInfo.path, file}
+		results <- PathFile{pathInfo.path, file, entry}
 	}
 }
 
-func ReadLocalFileList() *pb.FileMetadata {
-	var ignorer = &jamignore.JamHubIgnorer{}
-	err := ignorer.ImportPatterns(".gitignore")
+// hashFile hashes a file without reading all of it into memory.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	hasher := xxh3.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return nil, err
+	}
+	b := hasher.Sum128().Bytes()
+	return b[:], nil
+}
+
+// hasContents reports whether a diff needs file contents to be transferred.
+// Directories and symlinks are fully described by their metadata.
+func hasContents(diff *pb.FileMetadataDiff_FileDiff) bool {
+	return diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() && diff.GetFile().GetSymlinkTarget() == ""
+}
+
+// checkLocalPath makes sure a path from the server stays inside the project
+// when it is written. It has to be relative without any "..", and none of the
+// directories above it may be symlinks since writes would follow them out of
+// the project. Directories that do not exist yet are created by the caller.
+func checkLocalPath(path string) error {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "/") || filepath.VolumeName(path) != "" {
+		return fmt.Errorf("refusing to write %q outside of the project", path)
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("refusing to write %q outside of the project", path)
+		}
+	}
+	if alwaysIgnoredPath(path) {
+		return fmt.Errorf("refusing to write %q, which is never synced", path)
+	}
+
+	dir := filepath.Dir(filepath.FromSlash(path))
+	for dir != "." {
+		stat, err := os.Lstat(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil && stat.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write %q through the symlink %q", path, filepath.ToSlash(dir))
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// checkSymlinkTarget rejects symlinks from the server that are absolute or
+// point outside of the project.
+func checkSymlinkTarget(path string, target string) error {
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") || filepath.VolumeName(target) != "" {
+		return fmt.Errorf("refusing to create %q pointing to the absolute path %q", path, target)
+	}
+	resolved := filepath.Join(filepath.Dir(filepath.FromSlash(path)), filepath.FromSlash(target))
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to create %q pointing to %q outside of the project", path, target)
+	}
+	return nil
+}
+
+// checkDiffPaths checks every path and symlink of a diff from the server
+// before any of it is applied.
+func checkDiffPaths(fileMetadataDiff *pb.FileMetadataDiff) error {
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() == pb.FileMetadataDiff_NoOp {
+			continue
+		}
+		err := checkLocalPath(path)
+		if err != nil {
+			return err
+		}
+		if diff.GetType() != pb.FileMetadataDiff_Delete && diff.GetFile().GetSymlinkTarget() != "" {
+			err = checkSymlinkTarget(path, diff.GetFile().GetSymlinkTarget())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createLocalFile creates or truncates a file at a path from the server. A
+// symlink at the path itself is replaced rather than followed.
+func createLocalFile(path string) (*os.File, error) {
+	err := checkLocalPath(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Lstat(path)
+	if err == nil && stat.Mode()&fs.ModeSymlink != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// writeLocalFile is os.WriteFile for paths from the server.
+func writeLocalFile(path string, data []byte) error {
+	f, err := createLocalFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// applySymlinks recreates every created or updated symlink in the diff.
+func applySymlinks(fileMetadataDiff *pb.FileMetadataDiff) error {
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() == pb.FileMetadataDiff_NoOp || diff.GetType() == pb.FileMetadataDiff_Delete || diff.GetFile().GetSymlinkTarget() == "" {
+			continue
+		}
+		err := checkLocalPath(path)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = os.Symlink(diff.GetFile().GetSymlinkTarget(), path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyModes sets the permission bits of every created or updated file and
+// directory in the diff.
+func applyModes(fileMetadataDiff *pb.FileMetadataDiff) error {
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() == pb.FileMetadataDiff_NoOp || diff.GetType() == pb.FileMetadataDiff_Delete || diff.GetFile().GetSymlinkTarget() != "" || diff.GetFile().GetMode() == 0 {
+			continue
+		}
+		err := checkLocalPath(path)
+		if err != nil {
+			return err
+		}
+		// Chmod follows symlinks, which are left alone
+		stat, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && stat.Mode()&fs.ModeSymlink != 0) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(path, fs.FileMode(diff.GetFile().GetMode()).Perm())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 	}
-	err = ignorer.ImportPatterns(".jamignore")
+	return nil
+}
+
+func loadIgnorer() *jamignore.JamHubIgnorer {
+	ignorer := jamignore.NewIgnorer()
+	err := ignorer.ImportTree(".")
 	if err != nil {
 		panic(err)
 	}
-	var numEntries int64
-	i := 0
-	if err := filepath.WalkDir(".", func(path string, d fs.DirEntry, _ error) error {
+	return ignorer
+}
+
+// alwaysIgnoredPath reports whether a path is one that is never synced no
+// matter what the ignore files say.
+func alwaysIgnoredPath(path string) bool {
+	return path == ".git" || strings.HasPrefix(path, ".git/") || strings.HasPrefix(path, ".jamhub")
+}
+
+// ignoredPath reports whether a slash separated path relative to the project
+// root should never be synced.
+func ignoredPath(ignorer *jamignore.JamHubIgnorer, path string, isDir bool) bool {
+	return alwaysIgnoredPath(path) || ignorer.Match(path, isDir)
+}
+
+// ReadLocalFileList hashes every file that is not ignored. Hashes of files
+// that have not changed since the last call are reused from the local index
+// unless RefreshIndex is set.
+func ReadLocalFileList() *pb.FileMetadata {
+	// Ignore files are imported as the walk reaches their directories, which
+	// is before anything they apply to is visited
+	ignorer := jamignore.NewIgnorer()
+	pathInfos := make([]PathInfo, 0)
+	if err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
 		path = filepath.ToSlash(path)
-		if ignorer.Match(path) || path == "." || strings.HasPrefix(path, ".git/") || strings.HasPrefix(path, ".jamhub") {
+		if err != nil {
+			return nil
+		}
+		if path != "." && ignoredPath(ignorer, path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			err = ignorer.ImportDir(".", path)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if path == "." {
 			return nil
 		}
-		numEntries += 1
-		i += 1
+		pathInfos = append(pathInfos, PathInfo{path, d.IsDir()})
 		return nil
 	}); err != nil {
 		fmt.Println("WARN: could not walk directory tree", err)
 	}
-	paths := make(chan PathInfo, numEntries)
-	results := make(chan PathFile, numEntries)
+	numEntries := len(pathInfos)
 
-	i = 0
-	for w := 1; w < 2048 && w <= int(numEntries)/10+1; w++ {
-		go worker(paths, results)
+	index := indexfile.IndexFile{Files: make(map[string]indexfile.Entry)}
+	if !RefreshIndex {
+		index = indexfile.Read(indexfile.FileName)
 	}
 
-	go func() {
-		if err := filepath.WalkDir(".", func(path string, d fs.DirEntry, _ error) error {
-			path = filepath.ToSlash(path)
-			if ignorer.Match(path) || path == "." || strings.HasPrefix(path, ".git/") || strings.HasPrefix(path, ".jamhub") {
-				return nil
-			}
-			paths <- PathInfo{path, d.IsDir()}
-			i += 1
-			return nil
-		}); err != nil {
-			fmt.Println("WARN: could not walk directory tree", err)
-		}
-		close(paths)
-	}()
+	paths := make(chan PathInfo, numEntries)
+	results := make(chan PathFile, numEntries)
+	for w := 1; w < 2048 && w <= numEntries/10+1; w++ {
+		go worker(index, paths, results)
+	}
+	for _, pathInfo := range pathInfos {
+		paths <- pathInfo
+	}
+	close(paths)
 
 	files := make(map[string]*pb.File, numEntries)
-	// if os.Args[1] != "sync" {
-	// 	bar := progressbar.Default(numEntries)
-	// 	for i := int64(0); i < numEntries; i++ {
-	// 		pathFile := <-results
-	// 		if pathFile.path != "" {
-	// 			files[pathFile.path] = pathFile.file
-	// 		}
-	// 		bar.Add(1)
-	// 	}
-	// } else {
-	for i := int64(0); i < numEntries; i++ {
+	newIndex := indexfile.IndexFile{Files: make(map[string]indexfile.Entry, numEntries)}
+	for i := 0; i < numEntries; i++ {
 		pathFile := <-results
 		if pathFile.path != "" {
 			files[pathFile.path] = pathFile.file
 		}
+		if pathFile.entry != nil {
+			newIndex.Files[pathFile.path] = *pathFile.entry
+		}
+	}
+
+	err := newIndex.Write(indexfile.FileName)
+	if err != nil {
+		fmt.Println("WARN: could not write local index", err)
 	}
-	// }
 
 	return &pb.FileMetadata{
 		Files: files,
@@ -333,12 +552,64 @@ func pathToHash(path string) []byte {
 	return h[:]
 }
 
+func readCommittedFileList(apiClient pb.JamHubClient, projectId uint64, commitId uint64) (*pb.FileMetadata, error) {
+	metadataResult := new(bytes.Buffer)
+	err := file.DownloadCommittedFile(apiClient, projectId, commitId, ".jamhubfilelist", bytes.NewReader([]byte{}), metadataResult)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMetadata := &pb.FileMetadata{}
+	err = proto.Unmarshal(metadataResult.Bytes(), fileMetadata)
+	return fileMetadata, err
+}
+
+func readWorkspaceFileList(apiClient pb.JamHubClient, projectId uint64, workspaceId uint64, changeId uint64) (*pb.FileMetadata, error) {
+	metadataResult := new(bytes.Buffer)
+	err := file.DownloadWorkspaceFile(apiClient, projectId, workspaceId, changeId, ".jamhubfilelist", bytes.NewReader([]byte{}), metadataResult)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMetadata := &pb.FileMetadata{}
+	err = proto.Unmarshal(metadataResult.Bytes(), fileMetadata)
+	return fileMetadata, err
+}
+
+// sameFile compares file entries ignoring modification times.
+func sameFile(a *pb.File, b *pb.File) bool {
+	return a.GetDir() == b.GetDir() && bytes.Equal(a.GetHash(), b.GetHash()) && a.GetMode() == b.GetMode() && a.GetSymlinkTarget() == b.GetSymlinkTarget()
+}
+
+// fileListContentChanged compares file lists ignoring modification times.
+func fileListContentChanged(a *pb.FileMetadata, b *pb.FileMetadata) bool {
+	if len(a.GetFiles()) != len(b.GetFiles()) {
+		return true
+	}
+	for path, aFile := range a.GetFiles() {
+		bFile, found := b.GetFiles()[path]
+		if !found || !sameFile(aFile, bFile) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadStateFileList reads the file list of the commit or workspace change the
+// local files were last synced with.
+func ReadStateFileList(apiClient pb.JamHubClient, state statefile.StateFile) (*pb.FileMetadata, error) {
+	if state.WorkspaceInfo != nil {
+		return readWorkspaceFileList(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId)
+	}
+	return readCommittedFileList(apiClient, state.ProjectId, state.CommitInfo.CommitId)
+}
+
 func pushFileListDiffWorkspace(apiClient pb.JamHubClient, projectId uint64, workspaceId uint64, changeId uint64, fileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff) error {
 	ctx := context.Background()
 
 	var numFiles int64
 	for _, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
+		if hasContents(diff) {
 			numFiles += 1
 		}
 	}
@@ -349,7 +620,7 @@ func pushFileListDiffWorkspace(apiClient pb.JamHubClient, projectId uint64, work
 	go uploadWorkspaceFiles(ctx, apiClient, projectId, workspaceId, changeId, paths, results, numFiles)
 
 	for path, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
+		if hasContents(diff) {
 			paths <- path
 		}
 	}
@@ -390,6 +661,19 @@ func downloadWorkspaceFiles(ctx context.Context, apiClient pb.JamHubClient, proj
 	for i := 0; i < numUpload; i++ {
 		go func() {
 			for path := range paths {
+				err := checkLocalPath(path)
+				if err != nil {
+					results <- err
+					continue
+				}
+				// A symlink being replaced by a file is not followed
+				if stat, err := os.Lstat(path); err == nil && stat.Mode()&fs.ModeSymlink != 0 {
+					err = os.Remove(path)
+					if err != nil {
+						results <- err
+						continue
+					}
+				}
 				currFile, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0755)
 				if err != nil {
 					fmt.Println(err)
@@ -445,12 +729,12 @@ func downloadWorkspaceFiles(ctx context.Context, apiClient pb.JamHubClient, proj
 					}
 					close(ops)
 				}()
-				tempFilePath := path + ".jamtemp"
-				tempFile, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE, 0755)
+				tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".jamtemp*")
 				if err != nil {
 					results <- err
 					continue
 				}
+				tempFilePath := tempFile.Name()
 
 				currFile.Seek(0, 0)
 				err = targetChunker.ApplyDelta(tempFile, currFile, ops)
@@ -497,6 +781,19 @@ func downloadCommittedFiles(ctx context.Context, apiClient pb.JamHubClient, proj
 	for i := 0; i < numUpload; i++ {
 		go func() {
 			for path := range paths {
+				err := checkLocalPath(path)
+				if err != nil {
+					results <- err
+					continue
+				}
+				// A symlink being replaced by a file is not followed
+				if stat, err := os.Lstat(path); err == nil && stat.Mode()&fs.ModeSymlink != 0 {
+					err = os.Remove(path)
+					if err != nil {
+						results <- err
+						continue
+					}
+				}
 				currFile, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0755)
 				if err != nil {
 					fmt.Println(err)
@@ -551,12 +848,12 @@ func downloadCommittedFiles(ctx context.Context, apiClient pb.JamHubClient, proj
 					}
 					close(ops)
 				}()
-				tempFilePath := path + ".jamtemp"
-				tempFile, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE, 0755)
+				tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".jamtemp*")
 				if err != nil {
 					results <- err
 					continue
 				}
+				tempFilePath := tempFile.Name()
 
 				currFile.Seek(0, 0)
 				err = targetChunker.ApplyDelta(tempFile, currFile, ops)
@@ -597,108 +894,270 @@ func downloadCommittedFiles(ctx context.Context, apiClient pb.JamHubClient, proj
 	<-done
 }
 
-func ApplyFileListDiffCommit(apiClient pb.JamHubClient, projectId, commitId uint64, fileMetadataDiff *pb.FileMetadataDiff) error {
+// UnpushedChangesError is returned instead of applying a diff that would
+// overwrite or delete local files that have changed since they were last synced.
+type UnpushedChangesError struct {
+	Paths []string
+}
+
+func (e *UnpushedChangesError) Error() string {
+	return "Some files changed remotely have local changes that have not been pushed:\n  " + strings.Join(e.Paths, "\n  ")
+}
+
+// exitIfUnpushed exits with the list of files that would lose local changes
+// instead of panicking.
+func exitIfUnpushed(err error) {
+	var unpushed *UnpushedChangesError
+	if errors.As(err, &unpushed) {
+		fmt.Println(unpushed.Error())
+		os.Exit(1)
+	}
+}
+
+// syncedDeletes returns the files deleted by the diff that are safe to remove
+// locally. baseFileMetadata is the file list the local files were last synced
+// with, files missing from it were created locally and are left alone.
+func syncedDeletes(baseFileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff) (map[string]*pb.File, error) {
+	deletes := make(map[string]*pb.File)
+	unpushed := make([]string, 0)
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() != pb.FileMetadataDiff_Delete {
+			continue
+		}
+		baseFile, found := baseFileMetadata.GetFiles()[path]
+		if !found {
+			continue
+		}
+		if !sameFile(baseFile, diff.GetFile()) {
+			unpushed = append(unpushed, path)
+			continue
+		}
+		deletes[path] = diff.GetFile()
+	}
+
+	if len(unpushed) > 0 {
+		sort.Strings(unpushed)
+		return nil, &UnpushedChangesError{Paths: unpushed}
+	}
+	return deletes, nil
+}
+
+// applyRenames moves deleted files to the paths of created files with the same
+// contents so they do not need to be downloaded again. The created paths that
+// were handled are returned and the moved files are removed from deletes.
+func applyRenames(fileMetadataDiff *pb.FileMetadataDiff, deletes map[string]*pb.File) (map[string]bool, error) {
+	hashToPath := make(map[string]string)
+	for path, file := range deletes {
+		if !file.GetDir() && file.GetSymlinkTarget() == "" {
+			hashToPath[string(file.GetHash())] = path
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() != pb.FileMetadataDiff_Create || !hasContents(diff) {
+			continue
+		}
+		oldPath, found := hashToPath[string(diff.GetFile().GetHash())]
+		if !found {
+			continue
+		}
+
+		err := checkLocalPath(path)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Rename(oldPath, path)
+		if err != nil {
+			return nil, err
+		}
+		delete(hashToPath, string(diff.GetFile().GetHash()))
+		delete(deletes, oldPath)
+		renamed[path] = true
+	}
+	return renamed, nil
+}
+
+// removeDeletes removes deleted files and then any deleted directories that
+// are left empty, deepest first.
+func removeDeletes(deletes map[string]*pb.File) error {
+	dirs := make([]string, 0)
+	for path, file := range deletes {
+		err := checkLocalPath(path)
+		if err != nil {
+			return err
+		}
+		if file.GetDir() {
+			dirs = append(dirs, path)
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			// Keep directories holding files created locally
+			continue
+		}
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ApplyFileListDiffCommit(apiClient pb.JamHubClient, projectId, commitId uint64, baseFileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff) error {
 	ctx := context.Background()
+	err := checkDiffPaths(fileMetadataDiff)
+	if err != nil {
+		return err
+	}
+	deletes, err := syncedDeletes(baseFileMetadata, fileMetadataDiff)
+	if err != nil {
+		return err
+	}
 	for path, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetFile().GetDir() {
+		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && diff.GetFile().GetDir() {
 			err := os.MkdirAll(path, os.ModePerm)
 			if err != nil {
 				return err
 			}
 		}
 	}
+	renamed, err := applyRenames(fileMetadataDiff, deletes)
+	if err != nil {
+		return err
+	}
+	err = applySymlinks(fileMetadataDiff)
+	if err != nil {
+		return err
+	}
 	var numFiles int64
-	for _, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if hasContents(diff) && !renamed[path] {
 			numFiles += 1
 		}
 	}
 
-	if numFiles == 0 {
-		return nil
-	}
-
-	paths := make(chan string, numFiles)
-	results := make(chan error, numFiles)
+	if numFiles > 0 {
+		paths := make(chan string, numFiles)
+		results := make(chan error, numFiles)
 
-	go downloadCommittedFiles(ctx, apiClient, projectId, commitId, paths, results, numFiles)
+		go downloadCommittedFiles(ctx, apiClient, projectId, commitId, paths, results, numFiles)
 
-	for path, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
-			paths <- path
+		for path, diff := range fileMetadataDiff.GetDiffs() {
+			if hasContents(diff) && !renamed[path] {
+				paths <- path
+			}
 		}
-	}
-	close(paths)
+		close(paths)
 
-	if numFiles > 1000 {
-		fmt.Println("Syncing files")
-		bar := progressbar.Default(numFiles)
-		for res := range results {
-			if res != nil {
-				fmt.Println(res) // Probably should handle this better
+		if numFiles > 1000 {
+			fmt.Println("Syncing files")
+			bar := progressbar.Default(numFiles)
+			for res := range results {
+				if res != nil {
+					fmt.Println(res) // Probably should handle this better
+				}
+				bar.Add(1)
 			}
-			bar.Add(1)
-		}
-	} else {
-		for res := range results {
-			if res != nil {
-				fmt.Println(res) // Probably should handle this better
+		} else {
+			for res := range results {
+				if res != nil {
+					fmt.Println(res) // Probably should handle this better
+				}
 			}
 		}
 	}
-	return nil
+
+	err = removeDeletes(deletes)
+	if err != nil {
+		return err
+	}
+	return applyModes(fileMetadataDiff)
 }
 
-func ApplyFileListDiffWorkspace(apiClient pb.JamHubClient, projectId uint64, workspaceId uint64, changeId uint64, fileMetadataDiff *pb.FileMetadataDiff) error {
+func ApplyFileListDiffWorkspace(apiClient pb.JamHubClient, projectId uint64, workspaceId uint64, changeId uint64, baseFileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff) error {
 	ctx := context.Background()
+	err := checkDiffPaths(fileMetadataDiff)
+	if err != nil {
+		return err
+	}
+	deletes, err := syncedDeletes(baseFileMetadata, fileMetadataDiff)
+	if err != nil {
+		return err
+	}
 	for path, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetFile().GetDir() {
+		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && diff.GetFile().GetDir() {
 			err := os.MkdirAll(path, os.ModePerm)
 			if err != nil {
 				return err
 			}
 		}
 	}
+	renamed, err := applyRenames(fileMetadataDiff, deletes)
+	if err != nil {
+		return err
+	}
+	err = applySymlinks(fileMetadataDiff)
+	if err != nil {
+		return err
+	}
 	var numFiles int64
-	for _, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if hasContents(diff) && !renamed[path] {
 			numFiles += 1
 		}
 	}
 
-	if numFiles == 0 {
-		return nil
-	}
-
-	paths := make(chan string, numFiles)
-	results := make(chan error, numFiles)
+	if numFiles > 0 {
+		paths := make(chan string, numFiles)
+		results := make(chan error, numFiles)
 
-	go downloadWorkspaceFiles(ctx, apiClient, projectId, workspaceId, changeId, paths, results, numFiles)
+		go downloadWorkspaceFiles(ctx, apiClient, projectId, workspaceId, changeId, paths, results, numFiles)
 
-	for path, diff := range fileMetadataDiff.GetDiffs() {
-		if diff.GetType() != pb.FileMetadataDiff_NoOp && diff.GetType() != pb.FileMetadataDiff_Delete && !diff.GetFile().GetDir() {
-			paths <- path
+		for path, diff := range fileMetadataDiff.GetDiffs() {
+			if hasContents(diff) && !renamed[path] {
+				paths <- path
+			}
 		}
-	}
-	close(paths)
+		close(paths)
 
-	if numFiles > 1000 {
-		fmt.Println("Syncing files")
-		bar := progressbar.Default(numFiles)
-		for res := range results {
-			if res != nil {
-				fmt.Println(res) // Probably should handle this better
+		if numFiles > 1000 {
+			fmt.Println("Syncing files")
+			bar := progressbar.Default(numFiles)
+			for res := range results {
+				if res != nil {
+					fmt.Println(res) // Probably should handle this better
+				}
+				bar.Add(1)
 			}
-			bar.Add(1)
-		}
-	} else {
-		for res := range results {
-			if res != nil {
-				fmt.Println(res) // Probably should handle this better
+		} else {
+			for res := range results {
+				if res != nil {
+					fmt.Println(res) // Probably should handle this better
+				}
 			}
 		}
 	}
-	return nil
+
+	err = removeDeletes(deletes)
+	if err != nil {
+		return err
+	}
+	return applyModes(fileMetadataDiff)
 }
 
 func DiffRemoteToLocalCommit(apiClient pb.JamHubClient, projectId uint64, commitId uint64, fileMetadata *pb.FileMetadata) (*pb.FileMetadataDiff, error) {
@@ -720,9 +1179,10 @@ func DiffRemoteToLocalCommit(apiClient pb.JamHubClient, projectId uint64, commit
 	}
 
 	fileMetadataDiff := make(map[string]*pb.FileMetadataDiff_FileDiff, len(fileMetadata.GetFiles()))
-	for filePath := range fileMetadata.GetFiles() {
+	for filePath, file := range fileMetadata.GetFiles() {
 		fileMetadataDiff[filePath] = &pb.FileMetadataDiff_FileDiff{
 			Type: pb.FileMetadataDiff_Delete,
+			File: file,
 		}
 	}
 
@@ -770,9 +1230,10 @@ func DiffRemoteToLocalWorkspace(apiClient pb.JamHubClient, projectId uint64, wor
 	}
 
 	fileMetadataDiff := make(map[string]*pb.FileMetadataDiff_FileDiff, len(fileMetadata.GetFiles()))
-	for filePath := range fileMetadata.GetFiles() {
+	for filePath, file := range fileMetadata.GetFiles() {
 		fileMetadataDiff[filePath] = &pb.FileMetadataDiff_FileDiff{
 			Type: pb.FileMetadataDiff_Delete,
+			File: file,
 		}
 	}
 
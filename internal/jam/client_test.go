@@ -14,24 +14,39 @@ import (
 	"github.com/zdgeier/jamhub/internal/jamenv"
 	"github.com/zdgeier/jamhub/internal/jamhub/file"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverconfig"
 	"golang.org/x/oauth2"
 )
 
 var serverRunning = false
 
+// dataDir is where the test server keeps its data, removed once every test
+// ran.
+var dataDir string
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if dataDir != "" {
+		os.RemoveAll(dataDir)
+	}
+	os.Exit(code)
+}
+
 func setup() (pb.JamHubClient, func(), error) {
 	if !serverRunning {
-		if jamenv.Env() == jamenv.Local {
-			err := os.RemoveAll("jamhubdata/")
+		var err error
+		if dataDir == "" {
+			dataDir, err = os.MkdirTemp("", "jamhubdata")
 			if err != nil {
-				log.Panic(err)
-			}
-			err = os.RemoveAll("jamhub.db")
-			if err != nil {
-				log.Panic(err)
+				return nil, nil, err
 			}
 		}
-		_, err := jamhubgrpc.New()
+		config := serverconfig.Default()
+		config.Env = jamenv.Env().String()
+		config.TLS.CertFile = "x509/publickey.cer"
+		config.TLS.KeyFile = "x509/private.key"
+		config.DataDir = dataDir
+		_, err = jamhubgrpc.New(config)
 		if err != nil && !strings.Contains(err.Error(), "bind: address already in use") {
 			return nil, nil, err
 		}
@@ -219,3 +234,73 @@ func TestClient_UploadDownloadMergedFile(t *testing.T) {
 		})
 	}
 }
+
+// inTempDir runs a test from an empty directory standing in for a project.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Deletes and renames are applied locally, a nil client makes sure nothing is
+// downloaded
+func TestClient_ApplyFileListDiffDeletesAndRenames(t *testing.T) {
+	oldFile := &pb.File{Hash: []byte("old")}
+	dir := &pb.File{Dir: true}
+
+	t.Run("remote delete", func(t *testing.T) {
+		inTempDir(t)
+		require.NoError(t, os.MkdirAll("dir", os.ModePerm))
+		require.NoError(t, os.WriteFile("dir/deleted.txt", []byte("old"), 0644))
+		base := &pb.FileMetadata{Files: map[string]*pb.File{"dir": dir, "dir/deleted.txt": oldFile}}
+		diff := &pb.FileMetadataDiff{Diffs: map[string]*pb.FileMetadataDiff_FileDiff{
+			"dir":             {Type: pb.FileMetadataDiff_Delete, File: dir},
+			"dir/deleted.txt": {Type: pb.FileMetadataDiff_Delete, File: oldFile},
+		}}
+
+		require.NoError(t, ApplyFileListDiffWorkspace(nil, 1, 1, 1, base, diff))
+		require.NoFileExists(t, "dir/deleted.txt")
+		require.NoDirExists(t, "dir")
+	})
+
+	t.Run("remote rename", func(t *testing.T) {
+		inTempDir(t)
+		require.NoError(t, os.WriteFile("old.txt", []byte("old"), 0644))
+		base := &pb.FileMetadata{Files: map[string]*pb.File{"old.txt": oldFile}}
+		diff := &pb.FileMetadataDiff{Diffs: map[string]*pb.FileMetadataDiff_FileDiff{
+			"old.txt":       {Type: pb.FileMetadataDiff_Delete, File: oldFile},
+			"moved/new.txt": {Type: pb.FileMetadataDiff_Create, File: oldFile},
+		}}
+
+		require.NoError(t, ApplyFileListDiffWorkspace(nil, 1, 1, 1, base, diff))
+		require.NoFileExists(t, "old.txt")
+		data, err := os.ReadFile("moved/new.txt")
+		require.NoError(t, err)
+		require.Equal(t, "old", string(data))
+	})
+
+	t.Run("unsynced local file", func(t *testing.T) {
+		inTempDir(t)
+		require.NoError(t, os.WriteFile("local.txt", []byte("local"), 0644))
+		diff := &pb.FileMetadataDiff{Diffs: map[string]*pb.FileMetadataDiff_FileDiff{
+			"local.txt": {Type: pb.FileMetadataDiff_Delete, File: oldFile},
+		}}
+
+		require.NoError(t, ApplyFileListDiffWorkspace(nil, 1, 1, 1, &pb.FileMetadata{}, diff))
+		require.FileExists(t, "local.txt")
+	})
+
+	t.Run("unpushed local change", func(t *testing.T) {
+		inTempDir(t)
+		require.NoError(t, os.WriteFile("changed.txt", []byte("old"), 0644))
+		base := &pb.FileMetadata{Files: map[string]*pb.File{"changed.txt": oldFile}}
+		diff := &pb.FileMetadataDiff{Diffs: map[string]*pb.FileMetadataDiff_FileDiff{
+			"changed.txt": {Type: pb.FileMetadataDiff_Delete, File: &pb.File{Hash: []byte("changed")}},
+		}}
+
+		var unpushed *UnpushedChangesError
+		require.ErrorAs(t, ApplyFileListDiffWorkspace(nil, 1, 1, 1, base, diff), &unpushed)
+		require.FileExists(t, "changed.txt")
+	})
+}
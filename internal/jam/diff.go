@@ -0,0 +1,204 @@
+package jam
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhub/file"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"github.com/zdgeier/jamhub/internal/linediff"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/oauth2"
+)
+
+func Diff() {
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		return
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	args := os.Args[2:]
+	if len(args) == 2 {
+		fromCommitId, fromErr := strconv.ParseUint(args[0], 10, 64)
+		toCommitId, toErr := strconv.ParseUint(args[1], 10, 64)
+		if fromErr == nil && toErr == nil {
+			err = diffCommits(apiClient, state.ProjectId, fromCommitId, toCommitId)
+			if err != nil {
+				log.Panic(err)
+			}
+			return
+		}
+	}
+
+	filter := make(map[string]bool, len(args))
+	for _, arg := range args {
+		filter[filepath.ToSlash(filepath.Clean(arg))] = true
+	}
+
+	fileMetadata := ReadLocalFileList()
+	var localToRemoteDiff *pb.FileMetadataDiff
+	var downloadRemote func(path string, w *bytes.Buffer) error
+	if state.WorkspaceInfo != nil {
+		localToRemoteDiff, err = DiffLocalToRemoteWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId, fileMetadata)
+		downloadRemote = func(path string, w *bytes.Buffer) error {
+			return file.DownloadWorkspaceFile(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId, path, bytes.NewReader([]byte{}), w)
+		}
+	} else {
+		localToRemoteDiff, err = diffLocalToRemoteCommit(apiClient, state.ProjectId, state.CommitInfo.CommitId, fileMetadata)
+		downloadRemote = func(path string, w *bytes.Buffer) error {
+			return file.DownloadCommittedFile(apiClient, state.ProjectId, state.CommitInfo.CommitId, path, bytes.NewReader([]byte{}), w)
+		}
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, path := range sortedDiffPaths(localToRemoteDiff) {
+		diff := localToRemoteDiff.GetDiffs()[path]
+		if len(filter) > 0 && !filter[path] {
+			continue
+		}
+		// Symlinks have no contents to compare
+		if diff.GetType() == pb.FileMetadataDiff_NoOp || diff.GetFile().GetDir() || diff.GetFile().GetSymlinkTarget() != "" {
+			continue
+		}
+
+		remoteData := new(bytes.Buffer)
+		if diff.GetType() != pb.FileMetadataDiff_Create {
+			err = downloadRemote(path, remoteData)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		var localData []byte
+		if diff.GetType() != pb.FileMetadataDiff_Delete {
+			localData, err = os.ReadFile(path)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		err = printFileDiff(path, remoteData.Bytes(), localData, diff.GetType())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+func diffCommits(apiClient pb.JamHubClient, projectId uint64, fromCommitId uint64, toCommitId uint64) error {
+	fromFileList, err := readCommittedFileList(apiClient, projectId, fromCommitId)
+	if err != nil {
+		return err
+	}
+	toFileList, err := readCommittedFileList(apiClient, projectId, toCommitId)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(fromFileList.GetFiles())+len(toFileList.GetFiles()))
+	for path, fromFile := range fromFileList.GetFiles() {
+		toFile, found := toFileList.GetFiles()[path]
+		if !found || !bytes.Equal(fromFile.GetHash(), toFile.GetHash()) {
+			paths = append(paths, path)
+		}
+	}
+	for path := range toFileList.GetFiles() {
+		if _, found := fromFileList.GetFiles()[path]; !found {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		fromFile, inFrom := fromFileList.GetFiles()[path]
+		toFile, inTo := toFileList.GetFiles()[path]
+		if fromFile.GetDir() || toFile.GetDir() || fromFile.GetSymlinkTarget() != "" || toFile.GetSymlinkTarget() != "" {
+			continue
+		}
+
+		diffType := pb.FileMetadataDiff_Update
+		fromData := new(bytes.Buffer)
+		toData := new(bytes.Buffer)
+		if inFrom {
+			err = file.DownloadCommittedFile(apiClient, projectId, fromCommitId, path, bytes.NewReader([]byte{}), fromData)
+			if err != nil {
+				return err
+			}
+		} else {
+			diffType = pb.FileMetadataDiff_Create
+		}
+		if inTo {
+			err = file.DownloadCommittedFile(apiClient, projectId, toCommitId, path, bytes.NewReader([]byte{}), toData)
+			if err != nil {
+				return err
+			}
+		} else {
+			diffType = pb.FileMetadataDiff_Delete
+		}
+
+		err = printFileDiff(path, fromData.Bytes(), toData.Bytes(), diffType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedDiffPaths(fileMetadataDiff *pb.FileMetadataDiff) []string {
+	paths := make([]string, 0, len(fileMetadataDiff.GetDiffs()))
+	for path := range fileMetadataDiff.GetDiffs() {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func printFileDiff(path string, from []byte, to []byte, diffType pb.FileMetadataDiff_Type) error {
+	// Only the modification time changed, or nothing to show for the file
+	if bytes.Equal(from, to) {
+		return nil
+	}
+
+	fromName, toName := "a/"+path, "b/"+path
+	switch diffType {
+	case pb.FileMetadataDiff_Create:
+		fromName = "/dev/null"
+	case pb.FileMetadataDiff_Delete:
+		toName = "/dev/null"
+	}
+
+	fmt.Printf("diff --jam a/%s b/%s\n", path, path)
+	if linediff.IsBinary(from) || linediff.IsBinary(to) {
+		fmt.Printf("Binary files %s (%d bytes, %s) and %s (%d bytes, %s) differ\n", fromName, len(from), contentHash(from), toName, len(to), contentHash(to))
+		return nil
+	}
+	return linediff.Unified(os.Stdout, fromName, toName, linediff.Lines(from), linediff.Lines(to), 3)
+}
+
+func contentHash(data []byte) string {
+	b := xxh3.Hash128(data).Bytes()
+	return fmt.Sprintf("%x", b[:8])
+}
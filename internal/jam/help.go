@@ -12,18 +12,30 @@ func Help(version string, built string) {
 	fmt.Println("\nversion:", version)
 	fmt.Println("built:  ", built)
 	fmt.Println("env:    ", jamenv.Env().String())
-	fmt.Println("\nlogin    - do this first. creates ~/.jamhubauth.")
+	fmt.Println("\nlogin    - do this first. creates ~/.jamhubauth. use --device to log in with a code when there is no browser, e.g. over SSH.")
+	fmt.Println("register - create a user on servers with their own logins, then log in as them.")
 	fmt.Println("init     - initialize a project in the current directory.")
 	fmt.Println("open     - open the current project in the browser.")
 	fmt.Println("status   - print information about the local state of the project.")
+	fmt.Println("check-ignore - explain which .gitignore or .jamignore rule ignores a path.")
+	fmt.Println("diff     - show line changes to local files, or between two commits with `jam diff <commit> <commit>`.")
 	fmt.Println("push     - push up local modifications to a workspace.")
-	fmt.Println("pull     - pull down remote modifications to the mainline or workspace.")
-	fmt.Println("checkout - create or download a workspace.")
+	fmt.Println("pull     - pull down remote modifications to the mainline or workspace. use -merge to merge files you have also changed.")
+	fmt.Println("sync     - watch for local edits and keep the workspace in sync until stopped. also `jam watch`.")
+	fmt.Println("checkout - create or download a workspace. `jam checkout @<commit>` views an older commit, add -b <workspace> to start a workspace from it.")
+	fmt.Println("update   - move the current workspace onto the latest commit and pull down any conflicts.")
+	fmt.Println("merge    - merge the current workspace into mainline. use -m to add a message.")
+	fmt.Println("resolve  - mark conflicts that kept the workspace's version after `jam update` as resolved so the workspace can be merged.")
+	fmt.Println("log      - show mainline commit history. use --path <file> to filter or --json for scripting.")
 	fmt.Println("workspaces - list active workspaces.")
-	fmt.Println("projects - list your projects.")
+	fmt.Println("projects - list your projects and the projects shared with you.")
+	fmt.Println("members  - list project members, or `jam members add <username> [role]` and `jam members rm <username>`. roles are reader, writer, maintainer and owner.")
+	fmt.Println("visibility - `jam visibility public` lets anyone read the project without signing in, `jam visibility private` undoes it.")
+	fmt.Println("token    - create, list and revoke access tokens. set JAMHUB_TOKEN to a token to use jam without signing in, e.g. in CI.")
 	fmt.Println("logout   - deletes ~/.jamhubauth.")
 	fmt.Println("delete   - delete the project in the current directory or by name.")
 	fmt.Println("help     - show this text")
+	fmt.Println("\nAdd --refresh before any command, e.g. `jam --refresh status`, to rehash every file instead of using the local index in .jamhubindex.")
 	fmt.Println("\nHappy jammin'!")
 	os.Exit(0)
 }
@@ -0,0 +1,103 @@
+package indexfile
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FileName is where the index is kept, next to the .jamhub state file.
+const FileName = ".jamhubindex"
+
+// Entry caches the hash of a file along with the stat information it was
+// hashed with. The hash is reused as long as none of it changes.
+type Entry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modtime"`
+	Inode   uint64 `json:"inode"`
+	Hash    []byte `json:"hash"`
+}
+
+// IndexFile is a cache of local file hashes so that unchanged files do not
+// need to be read and hashed again, similar to git's index.
+type IndexFile struct {
+	// WrittenAt is the modification time of the index file when it was read.
+	// Files modified at or after it may have changed again within the same
+	// modification time so their entries are not trusted. It comes from the
+	// same clock as the files' times, unlike the time the index was written.
+	WrittenAt int64            `json:"-"`
+	Files     map[string]Entry `json:"files"`
+}
+
+func NewEntry(info fs.FileInfo, hash []byte) Entry {
+	return Entry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   inode(info),
+		Hash:    hash,
+	}
+}
+
+// Read loads the index at path. A missing or unreadable index is treated as
+// empty since it is only a cache.
+func Read(path string) IndexFile {
+	index := IndexFile{Files: make(map[string]Entry)}
+	info, err := os.Stat(path)
+	if err != nil {
+		return index
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return index
+	}
+	err = json.Unmarshal(data, &index)
+	if err != nil || index.Files == nil {
+		return IndexFile{Files: make(map[string]Entry)}
+	}
+	index.WrittenAt = info.ModTime().UnixNano()
+	return index
+}
+
+// Write saves the index to path, replacing any existing index atomically so
+// an interrupted write never leaves a corrupt index behind.
+func (i IndexFile) Write(path string) error {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Lookup returns the cached hash of the file at path if it has not changed
+// since it was hashed.
+func (i IndexFile) Lookup(path string, info fs.FileInfo) ([]byte, bool) {
+	entry, found := i.Files[path]
+	if !found {
+		return nil, false
+	}
+	modTime := info.ModTime().UnixNano()
+	if modTime >= i.WrittenAt {
+		return nil, false
+	}
+	if entry.Size != info.Size() || entry.ModTime != modTime || entry.Inode != inode(info) {
+		return nil, false
+	}
+	return entry.Hash, true
+}
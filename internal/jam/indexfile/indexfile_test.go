@@ -0,0 +1,129 @@
+package indexfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	indexPath := filepath.Join(dir, FileName)
+
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filePath, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := Read(indexPath)
+	if _, found := index.Lookup("file.txt", info); found {
+		t.Fatal("expected empty index to miss")
+	}
+	index.Files["file.txt"] = NewEntry(info, []byte("hash"))
+	err = index.Write(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index = Read(indexPath)
+	hash, found := index.Lookup("file.txt", info)
+	if !found || string(hash) != "hash" {
+		t.Fatal("expected unchanged file to hit")
+	}
+
+	err = os.WriteFile(filePath, []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filePath, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := index.Lookup("file.txt", info); found {
+		t.Fatal("expected file with a new size to miss")
+	}
+}
+
+func TestLookupRacilyModified(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	indexPath := filepath.Join(dir, FileName)
+
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(filePath, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := Read(indexPath)
+	index.Files["file.txt"] = NewEntry(info, []byte("hash"))
+	err = index.Write(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := Read(indexPath).Lookup("file.txt", info); found {
+		t.Fatal("expected file modified after the index was written to miss")
+	}
+}
+
+func TestLookupModifiedWithIndex(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	indexPath := filepath.Join(dir, FileName)
+
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := Read(indexPath)
+	index.Files["file.txt"] = NewEntry(info, []byte("hash"))
+	err = index.Write(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A coarse filesystem clock can give the index the same time as the file
+	err = os.Chtimes(indexPath, info.ModTime(), info.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := Read(indexPath).Lookup("file.txt", info); found {
+		t.Fatal("expected file modified at the same time as the index to miss")
+	}
+
+	later := info.ModTime().Add(time.Second)
+	err = os.Chtimes(indexPath, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := Read(indexPath).Lookup("file.txt", info); !found {
+		t.Fatal("expected file modified before the index to hit")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package indexfile
+
+import "io/fs"
+
+// Inodes are not available here so only size and modification time are used.
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
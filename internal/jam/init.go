@@ -47,6 +47,7 @@ func InitNewProject(apiClient pb.JamHubClient, projectName string) {
 	mergeResp, err := apiClient.MergeWorkspace(context.Background(), &pb.MergeWorkspaceRequest{
 		ProjectId:   resp.ProjectId,
 		WorkspaceId: workspaceResp.WorkspaceId,
+		Message:     "Initial commit",
 	})
 	if err != nil {
 		panic(err)
@@ -92,7 +93,7 @@ func InitExistingProject(apiClient pb.JamHubClient, projectName string) {
 		log.Panic(err)
 	}
 
-	err = ApplyFileListDiffCommit(apiClient, resp.GetProjectId(), commitResp.CommitId, diffRemoteToLocalResp)
+	err = ApplyFileListDiffCommit(apiClient, resp.GetProjectId(), commitResp.CommitId, &pb.FileMetadata{}, diffRemoteToLocalResp)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -1,59 +1,226 @@
 package jamignore
 
 import (
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
-
-	"github.com/gobwas/glob"
 )
 
+// IgnoreFiles are read from every directory of a project, later files taking
+// precedence over earlier ones.
+var IgnoreFiles = []string{".gitignore", ".jamignore"}
+
+// Pattern is a single line of an ignore file. Matching follows gitignore: a
+// pattern containing a slash is relative to the directory of its ignore file,
+// otherwise it matches a name at any depth below it.
+type Pattern struct {
+	Source string
+	Line   int
+	Text   string
+	Negate bool
+
+	base     string
+	dirOnly  bool
+	anchored bool
+	segments []string
+}
+
+func (p *Pattern) matches(path string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(path, p.base+"/") {
+			return false
+		}
+		path = path[len(p.base)+1:]
+	}
+	if !p.anchored {
+		path = path[strings.LastIndex(path, "/")+1:]
+	}
+	return matchSegments(p.segments, strings.Split(path, "/"))
+}
+
+// matchSegments matches path segments against pattern segments where "**"
+// matches any number of segments.
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			// A trailing "**" matches everything inside but not the directory itself
+			if len(pattern) == 0 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
 type JamHubIgnorer struct {
-	globs []glob.Glob
+	patterns []*Pattern
 }
 
 func NewIgnorer() *JamHubIgnorer {
 	return &JamHubIgnorer{
-		globs: make([]glob.Glob, 0),
+		patterns: make([]*Pattern, 0),
 	}
 }
 
-func (j *JamHubIgnorer) ImportPatterns(filepath string) error {
-	file, err := os.ReadFile(filepath)
+// ImportPatterns reads an ignore file. Its patterns apply to paths below the
+// directory containing it and take precedence over any imported before it.
+// Missing files are skipped.
+func (j *JamHubIgnorer) ImportPatterns(ignoreFile string) error {
+	return j.importFile(ignoreFile, filepath.ToSlash(filepath.Clean(ignoreFile)))
+}
+
+// importFile reads the ignore file at filePath, where source is its slash
+// separated path relative to the project root.
+func (j *JamHubIgnorer) importFile(filePath string, source string) error {
+	file, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil
 	}
 
-	patterns := strings.Split(string(file), "\n")
-	newGlobs := make([]glob.Glob, 0, len(patterns))
+	base := path.Dir(source)
+	if base == "." {
+		base = ""
+	}
 
-	for _, line := range patterns {
-		if strings.HasPrefix(line, "#") || len(strings.TrimSpace(line)) == 0 {
+	for i, line := range strings.Split(string(file), "\n") {
+		pattern, err := parsePattern(strings.TrimSuffix(line, "\r"))
+		if err != nil {
+			return err
+		}
+		if pattern == nil {
 			continue
 		}
+		pattern.Source = source
+		pattern.Line = i + 1
+		pattern.base = base
+		j.patterns = append(j.patterns, pattern)
+	}
+	return nil
+}
 
-		// TODO: Hacking this together for now. This should be made properly.
-		line = strings.ReplaceAll(line, "/", "*")
+func parsePattern(line string) (*Pattern, error) {
+	if strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
 
-		pat, _, _ := strings.Cut(line, "#")
+	// Trailing spaces are ignored unless escaped. Other escapes such as "\#"
+	// and "\!" are handled by path.Match.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	pattern := &Pattern{Text: line}
+	if strings.HasPrefix(line, "!") {
+		pattern.Negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
 
-		lineGlob, err := glob.Compile(strings.TrimSpace(pat))
+	pattern.segments = strings.Split(line, "/")
+	for i, segment := range pattern.segments {
+		// gitignore negates character classes with "!" but path.Match uses "^"
+		segment = strings.ReplaceAll(segment, "[!", "[^")
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+		pattern.segments[i] = segment
+	}
+	return pattern, nil
+}
+
+// ImportTree imports the ignore files of root and every directory below it
+// that is not itself ignored.
+func (j *JamHubIgnorer) ImportTree(root string) error {
+	return filepath.WalkDir(root, func(current string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, current)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".git" || (rel != "." && j.Match(rel, true)) {
+			return filepath.SkipDir
+		}
+		return j.ImportDir(root, rel)
+	})
+}
+
+// ImportDir imports the ignore files of a single directory, given as a slash
+// separated path relative to the project root at root. Walks that already
+// visit every directory can call it on the way down instead of ImportTree,
+// since a directory's ignore files only apply to paths below it.
+func (j *JamHubIgnorer) ImportDir(root string, dir string) error {
+	for _, name := range IgnoreFiles {
+		err := j.importFile(filepath.Join(root, filepath.FromSlash(dir), name), path.Join(dir, name))
 		if err != nil {
 			return err
 		}
-		j.globs = append(j.globs, lineGlob)
 	}
+	return nil
+}
 
-	j.globs = append(j.globs, newGlobs...)
+// MatchingPattern returns the pattern that decides whether a slash separated
+// path relative to the project root is ignored, or nil if none match. As with
+// git, nothing inside an ignored directory can be re-included.
+func (j *JamHubIgnorer) MatchingPattern(filePath string, isDir bool) (*Pattern, bool) {
+	filePath = strings.Trim(path.Clean(filePath), "/")
+	parts := strings.Split(filePath, "/")
+	for i := 1; i < len(parts); i++ {
+		if pattern := j.lastMatch(strings.Join(parts[:i], "/"), true); pattern != nil && !pattern.Negate {
+			return pattern, true
+		}
+	}
 
-	return nil
+	pattern := j.lastMatch(filePath, isDir)
+	return pattern, pattern != nil && !pattern.Negate
 }
 
-func (j *JamHubIgnorer) Match(filepath string) bool {
-	for _, g := range j.globs {
-		match := g.Match(strings.TrimSpace(filepath))
-		if match {
-			return true
+func (j *JamHubIgnorer) lastMatch(filePath string, isDir bool) *Pattern {
+	for i := len(j.patterns) - 1; i >= 0; i-- {
+		if j.patterns[i].matches(filePath, isDir) {
+			return j.patterns[i]
 		}
 	}
-	return false
+	return nil
+}
+
+func (j *JamHubIgnorer) Match(filePath string, isDir bool) bool {
+	_, ignored := j.MatchingPattern(filePath, isDir)
+	return ignored
 }
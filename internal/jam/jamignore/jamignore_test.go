@@ -0,0 +1,78 @@
+package jamignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "# build output\nbuild/\n*.log\n!keep.log\n/root.txt\nnode_modules\n",
+		".jamignore":          "docs/**/*.pdf\n",
+		"sub/.gitignore":      "local.txt\n!/build/\n",
+		"node_modules/.keep":  "",
+		"sub/build/.keep":     "",
+		"sub/nested/.keep":    "",
+		"sub/node_modules/.x": "",
+	}
+	for path, contents := range files {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, path), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignorer := NewIgnorer()
+	err := ignorer.ImportTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"build", true, true},
+		{"build", false, false},
+		{"a/b/build", true, true},
+		{"build/output.bin", false, true},
+		{"error.log", false, true},
+		{"sub/deep/error.log", false, true},
+		{"keep.log", false, false},
+		{"root.txt", false, true},
+		{"sub/root.txt", false, false},
+		{"node_modules/pkg/index.js", false, true},
+		{"sub/node_modules/pkg/index.js", false, true},
+		{"docs/manual.pdf", false, true},
+		{"docs/a/b/manual.pdf", false, true},
+		{"docs/manual.md", false, false},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/build", true, false},
+		{"sub/build/output.bin", false, false},
+		{"sub/other/build", true, true},
+		{"main.go", false, false},
+	}
+
+	for _, test := range tests {
+		if ignored := ignorer.Match(test.path, test.isDir); ignored != test.expected {
+			t.Errorf("%s (dir %v): expected ignored %v, got %v", test.path, test.isDir, test.expected, ignored)
+		}
+	}
+
+	pattern, ignored := ignorer.MatchingPattern("node_modules/pkg/index.js", false)
+	if !ignored || pattern.Source != ".gitignore" || pattern.Line != 6 {
+		t.Errorf("unexpected pattern for node_modules: %+v", pattern)
+	}
+	pattern, ignored = ignorer.MatchingPattern("keep.log", false)
+	if ignored || pattern == nil || !pattern.Negate {
+		t.Errorf("expected keep.log to be re-included, got %+v", pattern)
+	}
+}
@@ -0,0 +1,142 @@
+package jam
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhub/file"
+	"github.com/zdgeier/jamhub/internal/linediff"
+)
+
+// keepLocalChanges compares the local files and the remote files in a diff from
+// DiffRemoteToLocal* against the file list the local files were last synced
+// with. Files only changed locally are dropped from the diff so pulling does
+// not revert them, and the files changed on both sides are returned.
+func keepLocalChanges(baseFileMetadata *pb.FileMetadata, localFileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff) []string {
+	conflicts := make([]string, 0)
+	for path, diff := range fileMetadataDiff.GetDiffs() {
+		if diff.GetType() != pb.FileMetadataDiff_Create && diff.GetType() != pb.FileMetadataDiff_Update {
+			continue
+		}
+		baseFile, inBase := baseFileMetadata.GetFiles()[path]
+		localFile, inLocal := localFileMetadata.GetFiles()[path]
+		if inLocal && sameFile(localFile, diff.GetFile()) {
+			continue
+		}
+
+		localChanged := inBase != inLocal || (inBase && !sameFile(baseFile, localFile))
+		remoteChanged := !inBase || !sameFile(baseFile, diff.GetFile())
+		switch {
+		case !localChanged:
+		case !remoteChanged:
+			diff.Type = pb.FileMetadataDiff_NoOp
+		default:
+			conflicts = append(conflicts, path)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// saveLocalChanges reads the local contents of conflicting regular files so
+// they can be merged with the remote contents once those are pulled. Other
+// conflicts, such as directories or symlinks on either side, keep the local
+// version and are dropped from the diff.
+func saveLocalChanges(localFileMetadata *pb.FileMetadata, fileMetadataDiff *pb.FileMetadataDiff, conflicts []string) (map[string][]byte, error) {
+	saved := make(map[string][]byte, len(conflicts))
+	for _, path := range conflicts {
+		diff := fileMetadataDiff.GetDiffs()[path]
+		localFile, inLocal := localFileMetadata.GetFiles()[path]
+		if !inLocal {
+			// Deleted locally, the remote changes are restored
+			continue
+		}
+		if localFile.GetDir() || localFile.GetSymlinkTarget() != "" || !hasContents(diff) {
+			diff.Type = pb.FileMetadataDiff_NoOp
+			fmt.Println("Kept local version of", path)
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		saved[path] = data
+	}
+	return saved, nil
+}
+
+// readStateFile reads a file as of the commit or workspace change the local
+// files were last synced with.
+func readStateFile(apiClient pb.JamHubClient, state statefile.StateFile, path string) ([]byte, error) {
+	result := new(bytes.Buffer)
+	var err error
+	if state.WorkspaceInfo != nil {
+		err = file.DownloadWorkspaceFile(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId, path, bytes.NewReader([]byte{}), result)
+	} else {
+		err = file.DownloadCommittedFile(apiClient, state.ProjectId, state.CommitInfo.CommitId, path, bytes.NewReader([]byte{}), result)
+	}
+	return result.Bytes(), err
+}
+
+// mergeLocalChanges merges the saved local contents of conflicting files into
+// the remote contents that were pulled over them. Text files get conflict
+// markers where the changes overlap. Binary files keep the local contents and
+// the remote contents are written next to them with a .conflict suffix. The
+// files that still need to be resolved by hand are returned.
+func mergeLocalChanges(apiClient pb.JamHubClient, state statefile.StateFile, baseFileMetadata *pb.FileMetadata, saved map[string][]byte) ([]string, error) {
+	paths := make([]string, 0, len(saved))
+	for path := range saved {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	conflicts := make([]string, 0)
+	for _, path := range paths {
+		local := saved[path]
+		remote, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var base []byte
+		if _, found := baseFileMetadata.GetFiles()[path]; found {
+			base, err = readStateFile(apiClient, state, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if linediff.IsBinary(base) || linediff.IsBinary(local) || linediff.IsBinary(remote) {
+			err = writeLocalFile(path+".conflict", remote)
+			if err != nil {
+				return nil, err
+			}
+			err = writeLocalFile(path, local)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("Conflict in %s, kept local version and wrote remote version to %s.conflict\n", path, path)
+			conflicts = append(conflicts, path)
+			continue
+		}
+
+		lines, conflict := linediff.Merge3(linediff.Lines(base), linediff.Lines(local), linediff.Lines(remote), "local", "remote")
+		err = writeLocalFile(path, []byte(strings.Join(lines, "")))
+		if err != nil {
+			return nil, err
+		}
+		if conflict {
+			fmt.Println("Conflict in", path)
+			conflicts = append(conflicts, path)
+		} else {
+			fmt.Println("Merged", path)
+		}
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,129 @@
+package jam
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+type logEntry struct {
+	CommitId       uint64    `json:"commitid"`
+	ParentCommitId uint64    `json:"parentcommitid"`
+	Author         string    `json:"author"`
+	AuthorId       string    `json:"authorid"`
+	Date           time.Time `json:"date"`
+	Workspace      string    `json:"workspace"`
+	Message        string    `json:"message"`
+}
+
+func Log() {
+	logCmd := flag.NewFlagSet("log", flag.ExitOnError)
+	path := logCmd.String("path", "", "only show commits that changed this file")
+	asJson := logCmd.Bool("json", false, "print all commits as json")
+	pageSize := logCmd.Uint64("n", 10, "number of commits to show per page")
+	logCmd.Parse(os.Args[2:])
+
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		return
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	var pathHash []byte
+	if *path != "" {
+		pathHash = pathToHash(filepath.ToSlash(filepath.Clean(*path)))
+	}
+
+	entries := make([]logEntry, 0)
+	var beforeCommitId uint64
+	for {
+		resp, err := apiClient.ListCommits(context.Background(), &pb.ListCommitsRequest{
+			ProjectId:      state.ProjectId,
+			BeforeCommitId: beforeCommitId,
+			PageSize:       *pageSize,
+			PathHash:       pathHash,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, commit := range resp.GetCommits() {
+			entry := logEntry{
+				CommitId:       commit.GetCommitId(),
+				ParentCommitId: commit.GetParentCommitId(),
+				Author:         commit.GetAuthorUsername(),
+				AuthorId:       commit.GetAuthorId(),
+				Date:           commit.GetTimestamp().AsTime(),
+				Workspace:      commit.GetWorkspaceName(),
+				Message:        commit.GetMessage(),
+			}
+			if *asJson {
+				entries = append(entries, entry)
+			} else {
+				printLogEntry(entry)
+			}
+		}
+
+		commits := resp.GetCommits()
+		if len(commits) == 0 || uint64(len(commits)) < *pageSize || commits[len(commits)-1].GetCommitId() == 0 {
+			break
+		}
+		beforeCommitId = commits[len(commits)-1].GetCommitId()
+
+		if !*asJson {
+			fmt.Print("-- more (enter to continue, q to quit) -- ")
+			var input string
+			fmt.Scanln(&input)
+			if strings.ToLower(input) == "q" {
+				break
+			}
+		}
+	}
+
+	if *asJson {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Println(string(data))
+	}
+}
+
+func printLogEntry(entry logEntry) {
+	fmt.Printf("commit %d\n", entry.CommitId)
+	fmt.Printf("Author:    %s\n", entry.Author)
+	fmt.Printf("Date:      %s\n", entry.Date.Local().Format(time.RFC1123))
+	fmt.Printf("Workspace: %s\n", entry.Workspace)
+	if entry.Message != "" {
+		fmt.Println()
+		for _, line := range strings.Split(entry.Message, "\n") {
+			fmt.Println("    " + line)
+		}
+	}
+	fmt.Println()
+}
@@ -1,11 +1,18 @@
 package jam
 
 import (
+	"flag"
+	"os"
+
 	"github.com/zdgeier/jamhub/internal/jam/authfile"
 )
 
 func Login() {
-	_, err := authfile.Authorize()
+	loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
+	device := loginCmd.Bool("device", false, "log in by entering a code on another device instead of opening a browser, e.g. over SSH")
+	loginCmd.Parse(os.Args[2:])
+
+	_, err := authfile.Login(*device)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,117 @@
+package jam
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+func membersUsage() {
+	fmt.Println("jam members ls")
+	fmt.Println("jam members add <username> [reader|writer|maintainer|owner]")
+	fmt.Println("jam members rm <username>")
+}
+
+// parseRole parses a lowercase role name as shown by `jam members ls`.
+func parseRole(name string) (pb.ProjectMember_Role, bool) {
+	// Role names are capitalized in the enum
+	name = strings.ToLower(name)
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+	}
+	value, found := pb.ProjectMember_Role_value[name]
+	if !found || value == int32(pb.ProjectMember_None) {
+		return pb.ProjectMember_None, false
+	}
+	return pb.ProjectMember_Role(value), true
+}
+
+// Members lists, adds or removes the members of the current project. Members
+// are added as writers unless another role is given, and adding an existing
+// member changes their role.
+func Members() {
+	args := os.Args[2:]
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+	case args[0] == "rm" && len(args) == 2:
+	default:
+		membersUsage()
+		return
+	}
+
+	role := pb.ProjectMember_Writer
+	if args[0] == "add" && len(args) == 3 {
+		var found bool
+		role, found = parseRole(args[2])
+		if !found {
+			fmt.Println("Unknown role", args[2])
+			membersUsage()
+			return
+		}
+	}
+
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		os.Exit(1)
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	switch args[0] {
+	case "ls":
+		resp, err := apiClient.ListProjectMembers(ctx, &pb.ListProjectMembersRequest{ProjectId: state.ProjectId})
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, member := range resp.GetMembers() {
+			fmt.Printf("%-10s %s\n", strings.ToLower(member.GetRole().String()), member.GetUsername())
+		}
+	case "add":
+		_, err = apiClient.AddProjectMember(ctx, &pb.AddProjectMemberRequest{
+			ProjectId: state.ProjectId,
+			Username:  args[1],
+			Role:      role,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Added %s as a %s.\n", args[1], strings.ToLower(role.String()))
+	case "rm":
+		_, err = apiClient.RemoveProjectMember(ctx, &pb.RemoveProjectMemberRequest{
+			ProjectId: state.ProjectId,
+			Username:  args[1],
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Removed", args[1]+".")
+	}
+}
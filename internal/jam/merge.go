@@ -2,6 +2,7 @@ package jam
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -11,9 +12,19 @@ import (
 	"github.com/zdgeier/jamhub/internal/jam/statefile"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// mergeAttempts limits how many times a merge is retried when other merges
+// keep finishing first.
+const mergeAttempts = 3
+
 func Merge() {
+	mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	message := mergeCmd.String("m", "", "message describing the changes being merged")
+	mergeCmd.Parse(os.Args[2:])
+
 	state, err := statefile.Find()
 	if err != nil {
 		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
@@ -49,13 +60,70 @@ func Merge() {
 		return
 	}
 
-	resp, err := apiClient.MergeWorkspace(context.Background(), &pb.MergeWorkspaceRequest{
+	changeResp, err := apiClient.GetWorkspaceCurrentChange(context.Background(), &pb.GetWorkspaceCurrentChangeRequest{
 		ProjectId:   state.ProjectId,
 		WorkspaceId: state.WorkspaceInfo.WorkspaceId,
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+	baseCommitId := changeResp.GetBaseCommitId()
+
+	// The merge only goes through if the head is still the commit the
+	// workspace is based on, otherwise the workspace is updated onto the new
+	// head here, where conflicts can be resolved, and merged again
+	var resp *pb.MergeWorkspaceResponse
+	for attempt := 1; ; attempt++ {
+		resp, err = apiClient.MergeWorkspace(context.Background(), &pb.MergeWorkspaceRequest{
+			ProjectId:            state.ProjectId,
+			WorkspaceId:          state.WorkspaceInfo.WorkspaceId,
+			Message:              *message,
+			ExpectedHeadCommitId: &baseCommitId,
+		})
+		if err == nil {
+			break
+		}
+		if status.Code(err) != codes.Aborted || attempt == mergeAttempts {
+			log.Panic(err)
+		}
+
+		fmt.Println("Other changes were merged since the workspace was updated, updating it and merging again...")
+		remoteFileMetadata, err := readWorkspaceFileList(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId)
+		if err != nil {
+			log.Panic(err)
+		}
+		updateResp, err := updateWorkspace(apiClient, &state, fileMetadata, remoteFileMetadata)
+		if err != nil {
+			log.Panic(err)
+		}
+		if len(updateResp.GetConflicts()) > 0 {
+			err = printUpdateConflicts(apiClient, state, updateResp)
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println("Resolve the conflicts, then run `jam push` and merge again.")
+			os.Exit(1)
+		}
+		baseCommitId = updateResp.GetBaseCommitId()
+		fileMetadata = ReadLocalFileList()
+	}
+
+	if len(resp.GetConflicts()) > 0 {
+		if resp.GetConflicts()[0].GetUnresolved() {
+			fmt.Println("Could not merge, the workspace has unresolved conflicts:")
+		} else {
+			fmt.Printf("Could not merge, the workspace conflicts with changes merged up to commit %d:\n", resp.GetCommitId())
+		}
+		for _, conflict := range resp.GetConflicts() {
+			fmt.Printf("  %s (%s)\n", conflict.GetPath(), conflictDescription(conflict.GetType()))
+		}
+		if resp.GetConflicts()[0].GetUnresolved() {
+			fmt.Println("Push the version of each file to keep, run `jam resolve <path>` for each and merge again.")
+		} else {
+			fmt.Println("Run `jam update` to bring the conflicts into your workspace, resolve them, and merge again.")
+		}
+		os.Exit(1)
+	}
 
 	_, err = apiClient.DeleteWorkspace(context.Background(), &pb.DeleteWorkspaceRequest{
 		ProjectId:   state.ProjectId,
@@ -75,3 +143,16 @@ func Merge() {
 		log.Panic(err)
 	}
 }
+
+func conflictDescription(conflictType pb.MergeConflict_Type) string {
+	switch conflictType {
+	case pb.MergeConflict_Binary:
+		return "binary file changed on both sides"
+	case pb.MergeConflict_ModifyDelete:
+		return "modified on one side and deleted on the other"
+	case pb.MergeConflict_AddAdd:
+		return "added on both sides"
+	default:
+		return "overlapping changes"
+	}
+}
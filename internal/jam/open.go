@@ -44,7 +44,6 @@ func Open() {
 	username := authFile.Username
 	if jamenv.Env() == jamenv.Local {
 		url = "http://localhost:8081/"
-		username = "test@jamhub.dev"
 	}
 
 	err = browser.OpenURL(url + username + "/" + nameResp.ProjectName + "/committedfiles/")
@@ -38,6 +38,10 @@ func ListProjects() {
 	}
 
 	for _, proj := range resp.GetProjects() {
-		fmt.Println(proj.GetName())
+		name := proj.GetName()
+		if proj.GetPublic() {
+			name += " (public)"
+		}
+		fmt.Println(name)
 	}
 }
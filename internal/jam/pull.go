@@ -2,8 +2,10 @@ package jam
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/zdgeier/jamhub/gen/pb"
 	"github.com/zdgeier/jamhub/internal/jam/authfile"
@@ -13,6 +15,10 @@ import (
 )
 
 func Pull() {
+	pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+	merge := pullCmd.Bool("merge", false, "merge files changed both locally and remotely instead of stopping")
+	pullCmd.Parse(os.Args[2:])
+
 	state, err := statefile.Find()
 	if err != nil {
 		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
@@ -43,9 +49,20 @@ func Pull() {
 		if err != nil {
 			log.Panic(err)
 		}
+		baseFileMetadata, err := ReadStateFileList(apiClient, state)
+		if err != nil {
+			log.Panic(err)
+		}
+		saved := pullLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff, *merge)
 
+		var unresolved []string
 		if DiffHasChanges(remoteToLocalDiff) {
-			err = ApplyFileListDiffWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.GetChangeId(), remoteToLocalDiff)
+			err = ApplyFileListDiffWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, changeResp.GetChangeId(), baseFileMetadata, remoteToLocalDiff)
+			if err != nil {
+				exitIfUnpushed(err)
+				log.Panic(err)
+			}
+			unresolved, err = mergeLocalChanges(apiClient, state, baseFileMetadata, saved)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -67,6 +84,7 @@ func Pull() {
 		if err != nil {
 			panic(err)
 		}
+		exitIfUnresolved(unresolved)
 	} else {
 		commitResp, err := apiClient.GetProjectCurrentCommit(context.Background(), &pb.GetProjectCurrentCommitRequest{ProjectId: state.ProjectId})
 		if err != nil {
@@ -78,9 +96,20 @@ func Pull() {
 		if err != nil {
 			log.Panic(err)
 		}
+		baseFileMetadata, err := ReadStateFileList(apiClient, state)
+		if err != nil {
+			log.Panic(err)
+		}
+		saved := pullLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff, *merge)
 
+		var unresolved []string
 		if DiffHasChanges(remoteToLocalDiff) {
-			err = ApplyFileListDiffCommit(apiClient, state.ProjectId, commitResp.CommitId, remoteToLocalDiff)
+			err = ApplyFileListDiffCommit(apiClient, state.ProjectId, commitResp.CommitId, baseFileMetadata, remoteToLocalDiff)
+			if err != nil {
+				exitIfUnpushed(err)
+				log.Panic(err)
+			}
+			unresolved, err = mergeLocalChanges(apiClient, state, baseFileMetadata, saved)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -102,5 +131,36 @@ func Pull() {
 		if err != nil {
 			panic(err)
 		}
+		exitIfUnresolved(unresolved)
+	}
+}
+
+// pullLocalChanges stops the pull if files have changed both locally and
+// remotely, unless they should be merged, in which case their local contents
+// are returned for mergeLocalChanges.
+func pullLocalChanges(baseFileMetadata *pb.FileMetadata, fileMetadata *pb.FileMetadata, remoteToLocalDiff *pb.FileMetadataDiff, merge bool) map[string][]byte {
+	conflicts := keepLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff)
+	if len(conflicts) > 0 && !merge {
+		fmt.Println((&UnpushedChangesError{Paths: conflicts}).Error())
+		fmt.Println("Push your local changes first or run `jam pull -merge` to merge them.")
+		os.Exit(1)
+	}
+
+	saved, err := saveLocalChanges(fileMetadata, remoteToLocalDiff, conflicts)
+	if err != nil {
+		log.Panic(err)
+	}
+	return saved
+}
+
+// exitIfUnresolved lists the files left with conflicts by merging local changes
+// and exits with an error. The pulled changes are still saved as the base of
+// the local files so that pushing the resolved files builds on them.
+func exitIfUnresolved(unresolved []string) {
+	if len(unresolved) == 0 {
+		return
 	}
+	fmt.Println((&syncConflictError{Paths: unresolved}).Error())
+	fmt.Println("Resolve the conflicts and run `jam push`.")
+	os.Exit(1)
 }
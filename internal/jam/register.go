@@ -0,0 +1,15 @@
+package jam
+
+import (
+	"fmt"
+
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+)
+
+func Register() {
+	authFile, err := authfile.Register()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Registered and logged in as", authFile.Username+".")
+}
@@ -0,0 +1,70 @@
+package jam
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+// Resolve marks conflicts left by `jam update` as resolved with the version of
+// the files that was last pushed to the workspace.
+func Resolve() {
+	if len(os.Args) < 3 {
+		fmt.Println("jam resolve <path>...")
+		return
+	}
+
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		os.Exit(1)
+	}
+
+	if state.CommitInfo != nil {
+		fmt.Println("Currently on a commit, checkout a workspace with `jam checkout <workspacename>` to resolve conflicts.")
+		os.Exit(1)
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	paths := make([]string, 0, len(os.Args)-2)
+	for _, path := range os.Args[2:] {
+		paths = append(paths, filepath.ToSlash(filepath.Clean(path)))
+	}
+	resp, err := apiClient.ResolveConflicts(context.Background(), &pb.ResolveConflictsRequest{
+		ProjectId:   state.ProjectId,
+		WorkspaceId: state.WorkspaceInfo.WorkspaceId,
+		Paths:       paths,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if len(resp.GetConflicts()) == 0 {
+		fmt.Println("All conflicts are resolved, run `jam merge` to merge the workspace.")
+		return
+	}
+	fmt.Println("Still unresolved:")
+	for _, conflict := range resp.GetConflicts() {
+		fmt.Printf("  %s (%s)\n", conflict.GetPath(), conflictDescription(conflict.GetType()))
+	}
+}
@@ -0,0 +1,262 @@
+package jam
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/jamignore"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+// Sync watches the working directory and keeps it in sync with the current
+// workspace until interrupted. Local edits are pushed once they settle for the
+// debounce period and remote changes are pulled on every poll interval.
+func Sync() {
+	syncCmd := flag.NewFlagSet("sync", flag.ExitOnError)
+	debounce := syncCmd.Duration("debounce", 2*time.Second, "time to wait after the last local edit before pushing")
+	interval := syncCmd.Duration("interval", 10*time.Second, "how often to check for remote changes")
+	syncCmd.Parse(os.Args[2:])
+
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		os.Exit(1)
+	}
+
+	if state.CommitInfo != nil {
+		fmt.Println("Currently on a commit, checkout a workspace with `jam checkout <workspacename>` to sync changes.")
+		os.Exit(1)
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Panic(err)
+	}
+	defer watcher.Close()
+
+	ignorer := loadIgnorer()
+	err = watchTree(watcher, ignorer, ".")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Println("Syncing, press Ctrl+C to stop.")
+	err = syncWorkspace(apiClient, &state)
+	if stopSync(err) {
+		os.Exit(1)
+	}
+
+	debounceTimer := time.NewTimer(*debounce)
+	debounceTimer.Stop()
+	pollTicker := time.NewTicker(*interval)
+	defer pollTicker.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			path := filepath.ToSlash(filepath.Clean(event.Name))
+			for _, name := range jamignore.IgnoreFiles {
+				if filepath.Base(path) == name {
+					ignorer = loadIgnorer()
+				}
+			}
+			info, statErr := os.Stat(event.Name)
+			isDir := statErr == nil && info.IsDir()
+			if ignoredPath(ignorer, path, isDir) {
+				continue
+			}
+			if event.Has(fsnotify.Create) && isDir {
+				err = watchTree(watcher, ignorer, event.Name)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+			debounceTimer.Reset(*debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(err)
+		case <-debounceTimer.C:
+			err = syncWorkspace(apiClient, &state)
+			if stopSync(err) {
+				os.Exit(1)
+			}
+		case <-pollTicker.C:
+			err = syncWorkspace(apiClient, &state)
+			if stopSync(err) {
+				os.Exit(1)
+			}
+		case <-done:
+			fmt.Println("Stopped syncing.")
+			return
+		}
+	}
+}
+
+// watchTree adds a watch for root and every directory below it since inotify
+// watches are not recursive.
+func watchTree(watcher *fsnotify.Watcher, ignorer *jamignore.JamHubIgnorer, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		slashPath := filepath.ToSlash(path)
+		if slashPath != "." && ignoredPath(ignorer, slashPath, true) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// syncConflictError is returned when files changed both locally and remotely
+// could not be merged without conflicts.
+type syncConflictError struct {
+	Paths []string
+}
+
+func (e *syncConflictError) Error() string {
+	return "Some files have conflicting local and remote changes:\n  " + strings.Join(e.Paths, "\n  ")
+}
+
+// stopSync logs err and reports whether syncing has to stop until the user
+// resolves conflicts, which would otherwise fail again on every sync.
+func stopSync(err error) bool {
+	if err == nil {
+		return false
+	}
+	var conflict *syncConflictError
+	if errors.As(err, &conflict) {
+		fmt.Println(conflict.Error())
+		fmt.Println("Resolve the conflicts, run `jam push` and then `jam sync` again.")
+		return true
+	}
+	var unpushed *UnpushedChangesError
+	if errors.As(err, &unpushed) {
+		fmt.Println(unpushed.Error())
+		fmt.Println("They were deleted remotely. Move them out of the project, run `jam pull` and then `jam sync` again.")
+		return true
+	}
+	log.Println(err)
+	return false
+}
+
+// syncWorkspace pulls down any changes pushed to the workspace by others,
+// merging files that also changed locally, and then pushes local changes. Modification times alone are not considered a
+// change so that pulled files are not pushed straight back up.
+func syncWorkspace(apiClient pb.JamHubClient, state *statefile.StateFile) error {
+	projectId := state.ProjectId
+	workspaceId := state.WorkspaceInfo.WorkspaceId
+
+	changeResp, err := apiClient.GetWorkspaceCurrentChange(context.Background(), &pb.GetWorkspaceCurrentChangeRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+	if err != nil {
+		return err
+	}
+
+	if changeResp.GetChangeId() > state.WorkspaceInfo.ChangeId {
+		fileMetadata := ReadLocalFileList()
+		remoteToLocalDiff, err := DiffRemoteToLocalWorkspace(apiClient, projectId, workspaceId, changeResp.GetChangeId(), fileMetadata)
+		if err != nil {
+			return err
+		}
+		baseFileMetadata, err := readWorkspaceFileList(apiClient, projectId, workspaceId, state.WorkspaceInfo.ChangeId)
+		if err != nil {
+			return err
+		}
+		// Files changed on both sides are merged the same as `jam pull -merge`
+		conflicts := keepLocalChanges(baseFileMetadata, fileMetadata, remoteToLocalDiff)
+		saved, err := saveLocalChanges(fileMetadata, remoteToLocalDiff, conflicts)
+		if err != nil {
+			return err
+		}
+
+		if DiffHasChanges(remoteToLocalDiff) {
+			err = ApplyFileListDiffWorkspace(apiClient, projectId, workspaceId, changeResp.GetChangeId(), baseFileMetadata, remoteToLocalDiff)
+			if err != nil {
+				return err
+			}
+		}
+		unresolved, err := mergeLocalChanges(apiClient, *state, baseFileMetadata, saved)
+		if err != nil {
+			return err
+		}
+
+		state.WorkspaceInfo.ChangeId = changeResp.GetChangeId()
+		err = state.Save()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s Pulled change %d\n", time.Now().Format(time.Kitchen), state.WorkspaceInfo.ChangeId)
+		if len(unresolved) > 0 {
+			return &syncConflictError{Paths: unresolved}
+		}
+	}
+
+	fileMetadata := ReadLocalFileList()
+	remoteFileMetadata, err := readWorkspaceFileList(apiClient, projectId, workspaceId, state.WorkspaceInfo.ChangeId)
+	if err != nil {
+		return err
+	}
+	if !fileListContentChanged(fileMetadata, remoteFileMetadata) {
+		return nil
+	}
+
+	localToRemoteDiff, err := DiffLocalToRemoteWorkspace(apiClient, projectId, workspaceId, state.WorkspaceInfo.ChangeId, fileMetadata)
+	if err != nil {
+		return err
+	}
+
+	changeId := state.WorkspaceInfo.ChangeId + 1
+	err = pushFileListDiffWorkspace(apiClient, projectId, workspaceId, changeId, fileMetadata, localToRemoteDiff)
+	if err != nil {
+		return err
+	}
+
+	state.WorkspaceInfo.ChangeId = changeId
+	err = state.Save()
+	if err != nil {
+		return err
+	}
+	for path, diff := range localToRemoteDiff.GetDiffs() {
+		if diff.GetType() != pb.FileMetadataDiff_NoOp {
+			fmt.Printf("%s Pushed %s\n", time.Now().Format(time.Kitchen), path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package jam
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func tokenUsage() {
+	fmt.Println("jam token create [-scopes read,write] [-expires 720h] [-service-account <name> [-role writer]] <name>")
+	fmt.Println("jam token list [-project]")
+	fmt.Println("jam token revoke <id>")
+}
+
+// Token creates, lists and revokes access tokens. Tokens for service accounts
+// belong to the current project and act as a member of it.
+func Token() {
+	if len(os.Args) < 3 {
+		tokenUsage()
+		return
+	}
+
+	switch os.Args[2] {
+	case "create":
+		createToken()
+	case "list", "ls":
+		listTokens()
+	case "revoke", "rm":
+		revokeToken()
+	default:
+		tokenUsage()
+	}
+}
+
+func connectToken() (pb.JamHubClient, func()) {
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return apiClient, closer
+}
+
+func findProjectId() uint64 {
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		os.Exit(1)
+	}
+	return state.ProjectId
+}
+
+func createToken() {
+	createCmd := flag.NewFlagSet("token create", flag.ExitOnError)
+	scopes := createCmd.String("scopes", "read,write", "comma separated scopes out of read, write and admin")
+	expires := createCmd.Duration("expires", 0, "how long until the token expires, it never expires if unset")
+	serviceAccount := createCmd.String("service-account", "", "issue the token for this service account of the current project")
+	role := createCmd.String("role", "writer", "role of the service account in the project")
+	createCmd.Parse(os.Args[3:])
+	if createCmd.NArg() != 1 {
+		tokenUsage()
+		return
+	}
+
+	req := &pb.CreateAccessTokenRequest{
+		Name:   createCmd.Arg(0),
+		Scopes: strings.Split(*scopes, ","),
+	}
+	if *expires != 0 {
+		req.ExpiresAt = timestamppb.New(time.Now().Add(*expires))
+	}
+	if *serviceAccount != "" {
+		serviceAccountRole, found := parseRole(*role)
+		if !found {
+			fmt.Println("Unknown role", *role)
+			return
+		}
+		req.ProjectId = findProjectId()
+		req.ServiceAccount = *serviceAccount
+		req.Role = serviceAccountRole
+	}
+
+	apiClient, closer := connectToken()
+	defer closer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp, err := apiClient.CreateAccessToken(ctx, req)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Created token %d. Copy it now since it cannot be shown again:\n\n", resp.GetToken().GetId())
+	fmt.Println(resp.GetSecret())
+	fmt.Println("\nSet JAMHUB_TOKEN to it to use it with jam.")
+}
+
+func listTokens() {
+	listCmd := flag.NewFlagSet("token list", flag.ExitOnError)
+	project := listCmd.Bool("project", false, "list the service account tokens of the current project instead")
+	listCmd.Parse(os.Args[3:])
+
+	req := &pb.ListAccessTokensRequest{}
+	if *project {
+		req.ProjectId = findProjectId()
+	}
+
+	apiClient, closer := connectToken()
+	defer closer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp, err := apiClient.ListAccessTokens(ctx, req)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, token := range resp.GetTokens() {
+		expires := "never expires"
+		if token.GetExpiresAt() != nil {
+			expires = "expires " + token.GetExpiresAt().AsTime().Local().Format(time.RFC822)
+		}
+		name := token.GetName()
+		if token.GetServiceAccount() != "" {
+			name += " (" + token.GetServiceAccount() + ")"
+		}
+		fmt.Printf("%-4d %s [%s], %s\n", token.GetId(), name, strings.Join(token.GetScopes(), ","), expires)
+	}
+}
+
+func revokeToken() {
+	if len(os.Args) != 4 {
+		tokenUsage()
+		return
+	}
+	id, err := strconv.ParseUint(os.Args[3], 10, 64)
+	if err != nil {
+		tokenUsage()
+		return
+	}
+
+	apiClient, closer := connectToken()
+	defer closer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = apiClient.RevokeAccessToken(ctx, &pb.RevokeAccessTokenRequest{Id: id})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Revoked token %d.\n", id)
+}
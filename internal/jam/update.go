@@ -0,0 +1,143 @@
+package jam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhub/file"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+// Update moves the current workspace onto the latest commit, merging in the
+// changes made since the workspace was created, and pulls down the result.
+func Update() {
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		return
+	}
+
+	if state.CommitInfo != nil {
+		fmt.Println("Currently on a commit, run `jam pull` to get the latest commit.")
+		os.Exit(1)
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	fileMetadata := ReadLocalFileList()
+	remoteFileMetadata, err := readWorkspaceFileList(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, state.WorkspaceInfo.ChangeId)
+	if err != nil {
+		log.Panic(err)
+	}
+	if fileListContentChanged(fileMetadata, remoteFileMetadata) {
+		fmt.Println("You currently have active changes. Run `jam push` to push your local changes.")
+		return
+	}
+
+	resp, err := updateWorkspace(apiClient, &state, fileMetadata, remoteFileMetadata)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if len(resp.GetConflicts()) > 0 {
+		err = printUpdateConflicts(apiClient, state, resp)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Resolve the conflicts, then run `jam push`.")
+		return
+	}
+	fmt.Printf("Workspace is up to date with commit %d\n", resp.GetBaseCommitId())
+}
+
+// printUpdateConflicts lists the conflicts of an update. Unresolved conflicts
+// kept the workspace's version, so the latest commit's version of those files
+// is written next to them with a .conflict suffix to choose from.
+func printUpdateConflicts(apiClient pb.JamHubClient, state statefile.StateFile, resp *pb.UpdateWorkspaceBaseResponse) error {
+	fmt.Printf("Updated to commit %d with conflicts:\n", resp.GetBaseCommitId())
+	var headFileMetadata *pb.FileMetadata
+	unresolved := false
+	for _, conflict := range resp.GetConflicts() {
+		fmt.Printf("  %s (%s)\n", conflict.GetPath(), conflictDescription(conflict.GetType()))
+		if !conflict.GetUnresolved() {
+			continue
+		}
+		unresolved = true
+
+		if headFileMetadata == nil {
+			var err error
+			headFileMetadata, err = readCommittedFileList(apiClient, state.ProjectId, resp.GetBaseCommitId())
+			if err != nil {
+				return err
+			}
+		}
+		headFile, found := headFileMetadata.GetFiles()[conflict.GetPath()]
+		if !found || headFile.GetDir() || headFile.GetSymlinkTarget() != "" {
+			continue
+		}
+		conflictFile, err := createLocalFile(conflict.GetPath() + ".conflict")
+		if err != nil {
+			return err
+		}
+		err = file.DownloadCommittedFile(apiClient, state.ProjectId, resp.GetBaseCommitId(), conflict.GetPath(), bytes.NewReader([]byte{}), conflictFile)
+		conflictFile.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("    wrote the version of commit %d to %s.conflict\n", resp.GetBaseCommitId(), conflict.GetPath())
+	}
+	if unresolved {
+		fmt.Println("Files that kept the workspace's version have to be marked with `jam resolve <path>` before merging.")
+	}
+	return nil
+}
+
+// updateWorkspace moves the workspace onto the latest commit, applies the
+// result to the local files and saves the new state. The local files must not
+// have any changes that were not pushed.
+func updateWorkspace(apiClient pb.JamHubClient, state *statefile.StateFile, fileMetadata *pb.FileMetadata, remoteFileMetadata *pb.FileMetadata) (*pb.UpdateWorkspaceBaseResponse, error) {
+	resp, err := apiClient.UpdateWorkspaceBase(context.Background(), &pb.UpdateWorkspaceBaseRequest{
+		ProjectId:   state.ProjectId,
+		WorkspaceId: state.WorkspaceInfo.WorkspaceId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	remoteToLocalDiff, err := DiffRemoteToLocalWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, resp.GetChangeId(), fileMetadata)
+	if err != nil {
+		return nil, err
+	}
+	if DiffHasChanges(remoteToLocalDiff) {
+		err = ApplyFileListDiffWorkspace(apiClient, state.ProjectId, state.WorkspaceInfo.WorkspaceId, resp.GetChangeId(), remoteFileMetadata, remoteToLocalDiff)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range sortedDiffPaths(remoteToLocalDiff) {
+			if remoteToLocalDiff.GetDiffs()[path].GetType() != pb.FileMetadataDiff_NoOp {
+				fmt.Println("Updated", path)
+			}
+		}
+	}
+
+	state.WorkspaceInfo.ChangeId = resp.GetChangeId()
+	return resp, state.Save()
+}
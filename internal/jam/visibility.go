@@ -0,0 +1,55 @@
+package jam
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jam/authfile"
+	"github.com/zdgeier/jamhub/internal/jam/statefile"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc"
+	"golang.org/x/oauth2"
+)
+
+// Visibility makes the current project public, so anyone can read it without
+// signing in, or private again.
+func Visibility() {
+	if len(os.Args) != 3 || (os.Args[2] != "public" && os.Args[2] != "private") {
+		fmt.Println("jam visibility public|private")
+		return
+	}
+
+	state, err := statefile.Find()
+	if err != nil {
+		fmt.Println("Could not find a `.jamhub` file. Run `jam init` to initialize the project.")
+		os.Exit(1)
+	}
+
+	authFile, err := authfile.Authorize()
+	if err != nil {
+		panic(err)
+	}
+
+	apiClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{
+		AccessToken: string(authFile.Token),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = apiClient.SetProjectVisibility(ctx, &pb.SetProjectVisibilityRequest{
+		ProjectId: state.ProjectId,
+		Public:    os.Args[2] == "public",
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Project is now " + os.Args[2] + ".")
+}
@@ -30,3 +30,33 @@ func Env() JamEnv {
 		return Prod
 	}
 }
+
+type AuthProvider int
+
+const (
+	Auth0 AuthProvider = iota
+	BuiltinAuth
+)
+
+func (a AuthProvider) String() string {
+	switch a {
+	case Auth0:
+		return "auth0"
+	case BuiltinAuth:
+		return "builtin"
+	}
+	return "unknown"
+}
+
+// Auth is the identity provider the server signs users in with. The built-in
+// provider keeps users and passwords in the server's database so it can run
+// without any external service.
+func Auth() AuthProvider {
+	jamAuthString := os.Getenv("JAM_AUTH")
+	switch jamAuthString {
+	case "builtin":
+		return BuiltinAuth
+	default:
+		return Auth0
+	}
+}
@@ -3,11 +3,31 @@ package changestore
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
+type Commit struct {
+	CommitId       uint64
+	ParentCommitId uint64
+	WorkspaceName  string
+	AuthorId       string
+	Message        string
+	Timestamp      time.Time
+}
+
+// Conflict is a path of a workspace that kept the workspace's version when it
+// was updated and needs to be resolved before the workspace is merged. Type is
+// a pb.MergeConflict_Type.
+type Conflict struct {
+	Path string
+	Type int32
+}
+
 func setup(db *sql.DB) error {
 	sqlStmt := `
 	CREATE TABLE IF NOT EXISTS workspaces (name TEXT, baseCommitId INTEGER, deleted INTEGER, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP);
+	CREATE TABLE IF NOT EXISTS commits (commitId INTEGER PRIMARY KEY, parentCommitId INTEGER, workspaceName TEXT, authorId TEXT, message TEXT, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP);
+	CREATE TABLE IF NOT EXISTS conflicts (workspaceId INTEGER, path TEXT, type INTEGER, UNIQUE(workspaceId, path));
 	`
 	_, err := db.Exec(sqlStmt)
 	return err
@@ -50,6 +70,11 @@ func getWorkspaceBaseCommitId(db *sql.DB, workspaceId uint64) (uint64, error) {
 	return commitId, err
 }
 
+func updateWorkspaceBaseCommitId(db *sql.DB, workspaceId uint64, baseCommitId uint64) error {
+	_, err := db.Exec("UPDATE workspaces SET baseCommitId = ? WHERE rowid = ?", baseCommitId, workspaceId)
+	return err
+}
+
 func getWorkspaceNameById(db *sql.DB, workspaceId uint64) (string, error) {
 	row := db.QueryRow("SELECT name FROM workspaces WHERE rowid = ?", workspaceId)
 	if row.Err() != nil {
@@ -97,3 +122,101 @@ func listWorkspaces(db *sql.DB) (map[string]uint64, error) {
 
 	return data, err
 }
+
+func addCommit(db *sql.DB, commit Commit) error {
+	_, err := db.Exec("INSERT INTO commits(commitId, parentCommitId, workspaceName, authorId, message) VALUES(?, ?, ?, ?, ?)", commit.CommitId, commit.ParentCommitId, commit.WorkspaceName, commit.AuthorId, commit.Message)
+	return err
+}
+
+func deleteCommit(db *sql.DB, commitId uint64) error {
+	_, err := db.Exec("DELETE FROM commits WHERE commitId = ?", commitId)
+	return err
+}
+
+func getCommit(db *sql.DB, commitId uint64) (Commit, error) {
+	row := db.QueryRow("SELECT commitId, parentCommitId, workspaceName, authorId, message, timestamp FROM commits WHERE commitId = ?", commitId)
+	if row.Err() != nil {
+		return Commit{}, row.Err()
+	}
+
+	var commit Commit
+	err := row.Scan(&commit.CommitId, &commit.ParentCommitId, &commit.WorkspaceName, &commit.AuthorId, &commit.Message, &commit.Timestamp)
+	return commit, err
+}
+
+func listCommits(db *sql.DB, beforeCommitId uint64, limit uint64) ([]Commit, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if beforeCommitId == 0 {
+		rows, err = db.Query("SELECT commitId, parentCommitId, workspaceName, authorId, message, timestamp FROM commits ORDER BY commitId DESC LIMIT ?", limit)
+	} else {
+		rows, err = db.Query("SELECT commitId, parentCommitId, workspaceName, authorId, message, timestamp FROM commits WHERE commitId < ? ORDER BY commitId DESC LIMIT ?", beforeCommitId, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]Commit, 0)
+	for rows.Next() {
+		var commit Commit
+		err = rows.Scan(&commit.CommitId, &commit.ParentCommitId, &commit.WorkspaceName, &commit.AuthorId, &commit.Message, &commit.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, commit)
+	}
+
+	return data, rows.Err()
+}
+
+func addConflicts(db *sql.DB, workspaceId uint64, conflicts []Conflict) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, conflict := range conflicts {
+		_, err = tx.Exec("INSERT OR REPLACE INTO conflicts(workspaceId, path, type) VALUES(?, ?, ?)", workspaceId, conflict.Path, conflict.Type)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func resolveConflicts(db *sql.DB, workspaceId uint64, paths []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, path := range paths {
+		_, err = tx.Exec("DELETE FROM conflicts WHERE workspaceId = ? AND path = ?", workspaceId, path)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func listConflicts(db *sql.DB, workspaceId uint64) ([]Conflict, error) {
+	rows, err := db.Query("SELECT path, type FROM conflicts WHERE workspaceId = ? ORDER BY path", workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]Conflict, 0)
+	for rows.Next() {
+		var conflict Conflict
+		err = rows.Scan(&conflict.Path, &conflict.Type)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, conflict)
+	}
+	return data, rows.Err()
+}
@@ -7,12 +7,14 @@ import (
 )
 
 type LocalChangeStore struct {
-	dbs map[uint64]*sql.DB
+	root string
+	dbs  map[uint64]*sql.DB
 }
 
-func NewLocalChangeStore() LocalChangeStore {
+func NewLocalChangeStore(root string) LocalChangeStore {
 	return LocalChangeStore{
-		dbs: make(map[uint64]*sql.DB, 0),
+		root: root,
+		dbs:  make(map[uint64]*sql.DB, 0),
 	}
 }
 
@@ -21,7 +23,7 @@ func (s LocalChangeStore) getLocalProjectDB(ownerId string, projectId uint64) (*
 		return db, nil
 	}
 
-	dir := fmt.Sprintf("jamhubdata/%s/%d", ownerId, projectId)
+	dir := fmt.Sprintf("%s/%s/%d", s.root, ownerId, projectId)
 	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		return nil, err
@@ -64,6 +66,14 @@ func (s LocalChangeStore) GetWorkspaceBaseCommitId(ownerId string, projectId uin
 	return getWorkspaceBaseCommitId(db, workspaceId)
 }
 
+func (s LocalChangeStore) UpdateWorkspaceBaseCommitId(ownerId string, projectId uint64, workspaceId uint64, baseCommitId uint64) error {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	return updateWorkspaceBaseCommitId(db, workspaceId, baseCommitId)
+}
+
 func (s LocalChangeStore) DeleteWorkspace(ownerId string, projectId uint64, workspaceId uint64) error {
 	db, err := s.getLocalProjectDB(ownerId, projectId)
 	if err != nil {
@@ -89,6 +99,62 @@ func (s LocalChangeStore) ListWorkspaces(ownerId string, projectId uint64) (map[
 	return listWorkspaces(db)
 }
 
+func (s LocalChangeStore) AddCommit(ownerId string, projectId uint64, commit Commit) error {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	return addCommit(db, commit)
+}
+
+func (s LocalChangeStore) DeleteCommit(ownerId string, projectId uint64, commitId uint64) error {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	return deleteCommit(db, commitId)
+}
+
+func (s LocalChangeStore) GetCommit(ownerId string, projectId uint64, commitId uint64) (Commit, error) {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return Commit{}, err
+	}
+	return getCommit(db, commitId)
+}
+
+func (s LocalChangeStore) ListCommits(ownerId string, projectId uint64, beforeCommitId uint64, limit uint64) ([]Commit, error) {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return nil, err
+	}
+	return listCommits(db, beforeCommitId, limit)
+}
+
+func (s LocalChangeStore) AddConflicts(ownerId string, projectId uint64, workspaceId uint64, conflicts []Conflict) error {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	return addConflicts(db, workspaceId, conflicts)
+}
+
+func (s LocalChangeStore) ResolveConflicts(ownerId string, projectId uint64, workspaceId uint64, paths []string) error {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	return resolveConflicts(db, workspaceId, paths)
+}
+
+func (s LocalChangeStore) ListConflicts(ownerId string, projectId uint64, workspaceId uint64) ([]Conflict, error) {
+	db, err := s.getLocalProjectDB(ownerId, projectId)
+	if err != nil {
+		return nil, err
+	}
+	return listConflicts(db, workspaceId)
+}
+
 func (s LocalChangeStore) DeleteProject(projectId uint64, ownerId string) error {
-	return os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d", ownerId, projectId))
+	return os.RemoveAll(fmt.Sprintf("%s/%s/%d", s.root, ownerId, projectId))
 }
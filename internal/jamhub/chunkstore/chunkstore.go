@@ -0,0 +1,311 @@
+package chunkstore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// LocalStore keeps chunk data once per distinct content, shared by every file,
+// workspace and project. Chunks are keyed by their sha256 digest and counted
+// per holder, the op data directory that references them, so a chunk is
+// removed once nothing references it anymore.
+type LocalStore struct {
+	root string
+	db   *sql.DB
+	mu   sync.Mutex
+	held map[string]*digestLock
+}
+
+// digestLock serializes writing a chunk. Chunks are held while a Refs has
+// references to them that are not committed yet and are not removed then,
+// even without any committed references.
+type digestLock struct {
+	sync.Mutex
+	holds int
+}
+
+func NewChunkStore(root string) *LocalStore {
+	err := os.MkdirAll(root+"/chunks", os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := sql.Open("sqlite3", root+"/chunks/chunks.db")
+	if err != nil {
+		panic(err)
+	}
+	conn.SetMaxOpenConns(1)
+
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS chunks (digest BLOB PRIMARY KEY, size INTEGER);
+	CREATE TABLE IF NOT EXISTS refs (digest BLOB, holder TEXT, count INTEGER, PRIMARY KEY (digest, holder));
+	`
+	_, err = conn.Exec(sqlStmt)
+	if err != nil {
+		panic(err)
+	}
+	return &LocalStore{root: root, db: conn, held: make(map[string]*digestLock)}
+}
+
+func (s *LocalStore) filePath(digest []byte) string {
+	return fmt.Sprintf("%s/chunks/%02X/%02X", s.root, digest[:1], digest)
+}
+
+func (s *LocalStore) fileDir(digest []byte) string {
+	return fmt.Sprintf("%s/chunks/%02X", s.root, digest[:1])
+}
+
+// hold keeps digest from being removed until it is dropped as many times as
+// it was held, and returns its lock.
+func (s *LocalStore) hold(digest []byte) *digestLock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, found := s.held[string(digest)]
+	if !found {
+		lock = &digestLock{}
+		s.held[string(digest)] = lock
+	}
+	lock.holds++
+	return lock
+}
+
+func (s *LocalStore) drop(digest string, holds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock := s.held[digest]
+	lock.holds -= holds
+	if lock.holds == 0 {
+		delete(s.held, digest)
+	}
+}
+
+// Refs collects the references added by one holder, such as a stream of
+// operations or a file of a commit, so they are recorded in one transaction
+// when committed. It is not safe for concurrent use.
+type Refs struct {
+	s      *LocalStore
+	holder string
+	counts map[string]int
+}
+
+func (s *LocalStore) NewRefs(holder string) *Refs {
+	return &Refs{
+		s:      s,
+		holder: holder,
+		counts: make(map[string]int),
+	}
+}
+
+// Put stores data if no identical chunk is stored yet and adds a reference to
+// it that is recorded when r is committed.
+func (r *Refs) Put(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	digest := sum[:]
+
+	lock := r.s.hold(digest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var size int64
+	err := r.s.db.QueryRow("SELECT size FROM chunks WHERE digest = ?", digest).Scan(&size)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = r.s.writeChunk(digest, data)
+		if err == nil {
+			_, err = r.s.db.Exec("INSERT INTO chunks (digest, size) VALUES (?, ?)", digest, len(data))
+		}
+	}
+	if err != nil {
+		r.s.drop(string(digest), 1)
+		return nil, err
+	}
+	r.counts[string(digest)]++
+	return digest, nil
+}
+
+// Commit records the references added since the last commit. Committing
+// without any is a no-op, so it can also be deferred to record the references
+// of chunks written before an error.
+func (r *Refs) Commit() error {
+	if len(r.counts) == 0 {
+		return nil
+	}
+	counts := r.counts
+	r.counts = make(map[string]int)
+	defer func() {
+		for digest, count := range counts {
+			r.s.drop(digest, count)
+		}
+	}()
+
+	tx, err := r.s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for digest, count := range counts {
+		_, err = tx.Exec("INSERT INTO refs (digest, holder, count) VALUES (?, ?, ?) ON CONFLICT (digest, holder) DO UPDATE SET count = count + excluded.count", []byte(digest), r.holder, count)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeChunk writes through a temporary file so a chunk file is never seen
+// partially written, and syncs it to disk.
+func (s *LocalStore) writeChunk(digest []byte, data []byte) error {
+	err := os.MkdirAll(s.fileDir(digest), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(s.fileDir(digest), "chunk")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	err = os.Rename(tempFile.Name(), s.filePath(digest))
+	if err != nil {
+		return err
+	}
+
+	// Commits refer to chunks once published so they have to survive a crash
+	dir, err := os.Open(s.fileDir(digest))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *LocalStore) Get(digest []byte) ([]byte, error) {
+	return os.ReadFile(s.filePath(digest))
+}
+
+// Release drops every reference held by holders starting with holderPrefix
+// and removes the chunks left without any references.
+func (s *LocalStore) Release(holderPrefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	digests, err := queryDigests(tx, "SELECT DISTINCT digest FROM refs WHERE substr(holder, 1, length(?)) = ?", holderPrefix, holderPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM refs WHERE substr(holder, 1, length(?)) = ?", holderPrefix, holderPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = s.removeUnreferenced(tx, digests)
+	return err
+}
+
+// Reset replaces the references held by holder and every holder starting with
+// it with one reference from holder for each digest, removing the chunks left
+// without any references. It returns the number of bytes removed.
+func (s *LocalStore) Reset(holder string, digests [][]byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	previous, err := queryDigests(tx, "SELECT DISTINCT digest FROM refs WHERE substr(holder, 1, length(?)) = ?", holder, holder)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM refs WHERE substr(holder, 1, length(?)) = ?", holder, holder)
+	if err != nil {
+		return 0, err
+	}
+	for _, digest := range digests {
+		_, err = tx.Exec("INSERT INTO refs (digest, holder, count) VALUES (?, ?, 1) ON CONFLICT (digest, holder) DO UPDATE SET count = count + 1", digest, holder)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.removeUnreferenced(tx, previous)
+}
+
+func queryDigests(tx *sql.Tx, query string, args ...any) ([][]byte, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	digests := make([][]byte, 0)
+	for rows.Next() {
+		var digest []byte
+		err = rows.Scan(&digest)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
+
+// removeUnreferenced commits tx after deleting the chunks out of digests that
+// have no references left and are not held, then removes their files. s.mu
+// must be held.
+func (s *LocalStore) removeUnreferenced(tx *sql.Tx, digests [][]byte) (uint64, error) {
+	unreferenced := make([][]byte, 0)
+	var removed uint64
+	for _, digest := range digests {
+		if _, found := s.held[string(digest)]; found {
+			continue
+		}
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM refs WHERE digest = ?", digest).Scan(&count)
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			continue
+		}
+		var size uint64
+		err = tx.QueryRow("DELETE FROM chunks WHERE digest = ? RETURNING size", digest).Scan(&size)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		unreferenced = append(unreferenced, digest)
+		removed += size
+	}
+
+	err := tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	for _, digest := range unreferenced {
+		err = os.Remove(s.filePath(digest))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
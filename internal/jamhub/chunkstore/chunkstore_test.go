@@ -0,0 +1,130 @@
+package chunkstore
+
+import (
+	"bytes"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func put(t *testing.T, refs *Refs, data string) []byte {
+	digest, err := refs.Put([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func refCount(t *testing.T, s *LocalStore, digest []byte) int {
+	var count int
+	err := s.db.QueryRow("SELECT COALESCE(SUM(count), 0) FROM refs WHERE digest = ?", digest).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func stored(s *LocalStore, digest []byte) bool {
+	_, err := s.Get(digest)
+	return err == nil
+}
+
+func TestRefCounting(t *testing.T) {
+	s := NewChunkStore(t.TempDir())
+
+	first := s.NewRefs("project/1/")
+	digest := put(t, first, "shared")
+	put(t, first, "shared")
+	only := put(t, first, "only")
+	if refCount(t, s, digest) != 0 {
+		t.Fatal("expected references to be recorded on commit")
+	}
+	err := first.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refCount(t, s, digest) != 2 || refCount(t, s, only) != 1 {
+		t.Fatalf("expected 2 and 1 references, got %d and %d", refCount(t, s, digest), refCount(t, s, only))
+	}
+
+	second := s.NewRefs("project/2/")
+	if !bytes.Equal(put(t, second, "shared"), digest) {
+		t.Fatal("expected identical data to have the same digest")
+	}
+	err = second.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Release("project/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored(s, digest) || refCount(t, s, digest) != 1 {
+		t.Fatal("expected chunk still referenced by another holder to be kept")
+	}
+	if stored(s, only) {
+		t.Fatal("expected chunk without references to be removed")
+	}
+
+	err = s.Release("project/2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored(s, digest) {
+		t.Fatal("expected chunk without references to be removed")
+	}
+}
+
+func TestUncommittedRefsAreKept(t *testing.T) {
+	s := NewChunkStore(t.TempDir())
+
+	committed := s.NewRefs("a/")
+	digest := put(t, committed, "data")
+	err := committed.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := s.NewRefs("b/")
+	put(t, pending, "data")
+	err = s.Release("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored(s, digest) {
+		t.Fatal("expected chunk with uncommitted references to be kept")
+	}
+
+	err = pending.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refCount(t, s, digest) != 1 {
+		t.Fatalf("expected 1 reference, got %d", refCount(t, s, digest))
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := NewChunkStore(t.TempDir())
+
+	refs := s.NewRefs("project/1/")
+	kept := put(t, refs, "kept")
+	put(t, refs, "kept")
+	dropped := put(t, refs, "dropped")
+	err := refs.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.Reset("project/", [][]byte{kept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != uint64(len("dropped")) {
+		t.Fatalf("expected %d bytes removed, got %d", len("dropped"), removed)
+	}
+	if stored(s, dropped) || !stored(s, kept) || refCount(t, s, kept) != 1 {
+		t.Fatal("expected references below the holder to be replaced")
+	}
+}
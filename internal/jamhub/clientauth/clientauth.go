@@ -2,15 +2,14 @@ package clientauth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
 
 	cv "github.com/nirasan/go-oauth-pkce-code-verifier"
 	"github.com/skratchdot/open-golang/open"
@@ -20,12 +19,28 @@ import (
 
 var redirectUrl = "http://localhost:8082/callback"
 
-func AuthorizeUser() (string, error) {
+// httpClient makes the requests to the identity provider.
+var httpClient = http.DefaultClient
+
+// scope is what logins ask for, offline_access gets a refresh token with the
+// access token.
+const scope = "write:projects offline_access"
+
+// Tokens are the result of logging in. RefreshToken gets a new AccessToken
+// once it expires.
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var localTokens = Tokens{AccessToken: "local authentication token"}
+
+func AuthorizeUser() (Tokens, error) {
 	if jamenv.Env() == jamenv.Local {
 		viper.Set("AccessToken", "local")
-		return "local authentication token", nil
+		return localTokens, nil
 	}
-	var authenticationCode string
+	var authenticationCode Tokens
 
 	// initialize the code verifier
 	var CodeVerifier, _ = cv.CreateCodeVerifier()
@@ -33,11 +48,11 @@ func AuthorizeUser() (string, error) {
 	// construct the authorization URL (with Auth0 as the authorization provider)
 	authorizationURL := fmt.Sprintf(
 		"https://%s/authorize?audience=api.jamsync.dev"+
-			"&scope=write:projects"+
+			"&scope=%s"+
 			"&response_type=code&client_id=%s"+
 			"&code_challenge=%s"+
 			"&code_challenge_method=S256&redirect_uri=%s",
-		auth0Domain(), auth0ClientID(), CodeVerifier.CodeChallengeS256(), redirectUrl)
+		auth0Domain(), url.QueryEscape(scope), auth0ClientID(), CodeVerifier.CodeChallengeS256(), redirectUrl)
 
 	// start a web server to listen on a callback URL
 	server := &http.Server{Addr: redirectUrl}
@@ -163,17 +178,17 @@ func AuthorizeUser() (string, error) {
 
 	u, err := url.Parse(redirectUrl)
 	if err != nil {
-		return "", fmt.Errorf("bad redirect URL: %s\n", err)
+		return Tokens{}, fmt.Errorf("bad redirect URL: %s\n", err)
 	}
 
 	l, err := net.Listen("tcp", fmt.Sprintf(":%s", u.Port()))
 	if err != nil {
-		return "", fmt.Errorf("can't listen to port %s: %s\n", fmt.Sprintf(":%s", u.Port()), err)
+		return Tokens{}, fmt.Errorf("can't listen to port %s: %s\n", fmt.Sprintf(":%s", u.Port()), err)
 	}
 
 	err = open.Start(authorizationURL)
 	if err != nil {
-		return "", fmt.Errorf("can't open browser to URL %s: %s\n", authorizationURL, err)
+		return Tokens{}, fmt.Errorf("can't open browser to URL %s: %s\n", authorizationURL, err)
 	}
 
 	server.Serve(l)
@@ -194,34 +209,77 @@ func auth0Domain() string {
 	return os.Getenv("AUTH0_DOMAIN")
 }
 
-func getAccessToken(clientID string, codeVerifier string, authorizationCode string, callbackURL string) (string, error) {
-	url := fmt.Sprintf("https://%s/oauth/token", auth0Domain())
-	data := fmt.Sprintf(
-		"grant_type=authorization_code&client_id=%s"+
-			"&code_verifier=%s"+
-			"&code=%s"+
-			"&redirect_uri=%s",
-		clientID, codeVerifier, authorizationCode, callbackURL)
-	payload := strings.NewReader(data)
-
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("content-type", "application/x-www-form-urlencoded")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Printf("HTTP error: %s", err)
-		return "", err
+func getAccessToken(clientID string, codeVerifier string, authorizationCode string, callbackURL string) (Tokens, error) {
+	return requestTokens(url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"code_verifier": {codeVerifier},
+		"code":          {authorizationCode},
+		"redirect_uri":  {callbackURL},
+	})
+}
+
+// tokenError is how the token endpoint reports that it could not issue tokens.
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e tokenError) Error() string {
+	if e.Description == "" {
+		return e.Code
 	}
+	return e.Code + ": " + e.Description
+}
 
+func requestTokens(data url.Values) (Tokens, error) {
+	res, err := httpClient.PostForm(fmt.Sprintf("https://%s/oauth/token", auth0Domain()), data)
+	if err != nil {
+		return Tokens{}, err
+	}
 	defer res.Body.Close()
-	var responseData map[string]interface{}
-	body, _ := ioutil.ReadAll(res.Body)
 
-	err = json.Unmarshal(body, &responseData)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("JSON error: %s", err)
-		return "", err
+		return Tokens{}, err
 	}
+	if res.StatusCode != http.StatusOK {
+		var tokenErr tokenError
+		err = json.Unmarshal(body, &tokenErr)
+		if err != nil || tokenErr.Code == "" {
+			return Tokens{}, fmt.Errorf("token request failed with %s", res.Status)
+		}
+		return Tokens{}, tokenErr
+	}
+
+	var tokens Tokens
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if tokens.AccessToken == "" {
+		return Tokens{}, errors.New("no access token in the token response")
+	}
+	return tokens, nil
+}
 
-	accessToken := responseData["access_token"].(string)
-	return accessToken, nil
+// Refresh gets new tokens with the refresh token from an earlier login.
+func Refresh(refreshToken string) (Tokens, error) {
+	if jamenv.Env() == jamenv.Local {
+		return localTokens, nil
+	}
+
+	tokens, err := requestTokens(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {auth0ClientID()},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+	// The refresh token is only replaced if rotation is turned on
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshToken
+	}
+	return tokens, nil
 }
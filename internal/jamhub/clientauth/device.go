@@ -0,0 +1,87 @@
+package clientauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zdgeier/jamhub/internal/jamenv"
+)
+
+// sleep waits between polls for the tokens of a device login.
+var sleep = time.Sleep
+
+type deviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// AuthorizeDevice logs in with the OAuth device authorization grant, which
+// works without a browser on this machine. The user opens a URL anywhere else
+// and enters the code printed here while this polls for the tokens.
+func AuthorizeDevice() (Tokens, error) {
+	if jamenv.Env() == jamenv.Local {
+		return localTokens, nil
+	}
+
+	res, err := httpClient.PostForm(fmt.Sprintf("https://%s/oauth/device/code", auth0Domain()), url.Values{
+		"client_id": {auth0ClientID()},
+		"scope":     {scope},
+		"audience":  {"api.jamsync.dev"},
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var tokenErr tokenError
+		if json.NewDecoder(res.Body).Decode(&tokenErr) == nil && tokenErr.Code != "" {
+			return Tokens{}, tokenErr
+		}
+		return Tokens{}, fmt.Errorf("device code request failed with %s", res.Status)
+	}
+	var code deviceCode
+	err = json.NewDecoder(res.Body).Decode(&code)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	fmt.Printf("Open %s and enter the code %s to log in.\n", code.VerificationURI, code.UserCode)
+	if code.VerificationURIComplete != "" {
+		fmt.Printf("Or open %s to skip typing the code.\n", code.VerificationURIComplete)
+	}
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		sleep(interval)
+
+		tokens, err := requestTokens(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {code.DeviceCode},
+			"client_id":   {auth0ClientID()},
+		})
+		var tokenErr tokenError
+		if errors.As(err, &tokenErr) {
+			switch tokenErr.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return tokens, err
+	}
+	return Tokens{}, errors.New("the code expired before logging in, run `jam login --device` again")
+}
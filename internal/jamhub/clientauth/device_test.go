@@ -0,0 +1,183 @@
+package clientauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tokenResponse is a reply of the test identity provider's token endpoint.
+type tokenResponse struct {
+	status int
+	body   interface{}
+}
+
+var (
+	pending     = tokenResponse{http.StatusForbidden, tokenError{Code: "authorization_pending"}}
+	slowDown    = tokenResponse{http.StatusTooManyRequests, tokenError{Code: "slow_down"}}
+	granted     = tokenResponse{http.StatusOK, Tokens{AccessToken: "access", RefreshToken: "refresh"}}
+	expired     = tokenResponse{http.StatusForbidden, tokenError{Code: "expired_token"}}
+	denied      = tokenResponse{http.StatusForbidden, tokenError{Code: "access_denied", Description: "denied by the user"}}
+	invalidCode = tokenResponse{http.StatusForbidden, tokenError{Code: "invalid_grant"}}
+)
+
+// redirectTransport sends every request to server, whatever host it was for.
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Host = u.Host
+	return t.server.Client().Transport.RoundTrip(req)
+}
+
+// testIdentityProvider serves the device code and token endpoints, replying
+// to token requests with responses in order. Requests go to it instead of
+// Auth0 until the test ends.
+func testIdentityProvider(t *testing.T, responses []tokenResponse) *[]url.Values {
+	t.Setenv("JAM_ENV", "prod")
+	var requests []url.Values
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Error(err)
+		}
+		switch r.URL.Path {
+		case "/oauth/device/code":
+			json.NewEncoder(w).Encode(deviceCode{DeviceCode: "device", UserCode: "ABCD-EFGH", ExpiresIn: 60, Interval: 1})
+		case "/oauth/token":
+			requests = append(requests, r.PostForm)
+			if len(responses) == 0 {
+				t.Error("unexpected token request")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(responses[0].status)
+			json.NewEncoder(w).Encode(responses[0].body)
+			responses = responses[1:]
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	httpClient = &http.Client{Transport: redirectTransport{server: server}}
+	t.Cleanup(func() { httpClient = http.DefaultClient })
+	return &requests
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []tokenResponse
+		intervals []time.Duration
+		err       string
+	}{
+		{
+			name:      "authorization pending",
+			responses: []tokenResponse{pending, pending, granted},
+			intervals: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:      "slow down",
+			responses: []tokenResponse{pending, slowDown, slowDown, granted},
+			intervals: []time.Duration{time.Second, time.Second, 6 * time.Second, 11 * time.Second},
+		},
+		{
+			name:      "expired code",
+			responses: []tokenResponse{pending, expired},
+			intervals: []time.Duration{time.Second, time.Second},
+			err:       "expired_token",
+		},
+		{
+			name:      "access denied",
+			responses: []tokenResponse{denied},
+			intervals: []time.Duration{time.Second},
+			err:       "access_denied",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := testIdentityProvider(t, test.responses)
+			var intervals []time.Duration
+			sleep = func(d time.Duration) { intervals = append(intervals, d) }
+			t.Cleanup(func() { sleep = time.Sleep })
+
+			tokens, err := AuthorizeDevice()
+			if test.err != "" {
+				var tokenErr tokenError
+				if !errors.As(err, &tokenErr) || tokenErr.Code != test.err {
+					t.Fatalf("expected %s, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if tokens != granted.body {
+				t.Fatalf("unexpected tokens %+v", tokens)
+			}
+			if !reflect.DeepEqual(intervals, test.intervals) {
+				t.Fatalf("expected to wait %v, waited %v", test.intervals, intervals)
+			}
+			for _, request := range *requests {
+				if request.Get("device_code") != "device" {
+					t.Fatalf("unexpected token request %v", request)
+				}
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		response tokenResponse
+		tokens   Tokens
+		err      string
+	}{
+		{
+			name:     "rotated refresh token",
+			response: tokenResponse{http.StatusOK, Tokens{AccessToken: "new access", RefreshToken: "new refresh"}},
+			tokens:   Tokens{AccessToken: "new access", RefreshToken: "new refresh"},
+		},
+		{
+			name:     "same refresh token",
+			response: tokenResponse{http.StatusOK, Tokens{AccessToken: "new access"}},
+			tokens:   Tokens{AccessToken: "new access", RefreshToken: "refresh"},
+		},
+		{
+			name:     "revoked refresh token",
+			response: invalidCode,
+			err:      "invalid_grant",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := testIdentityProvider(t, []tokenResponse{test.response})
+
+			tokens, err := Refresh("refresh")
+			if test.err != "" {
+				var tokenErr tokenError
+				if !errors.As(err, &tokenErr) || tokenErr.Code != test.err {
+					t.Fatalf("expected %s, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if tokens != test.tokens {
+				t.Fatalf("expected %+v, got %+v", test.tokens, tokens)
+			}
+			request := (*requests)[0]
+			if request.Get("grant_type") != "refresh_token" || request.Get("refresh_token") != "refresh" {
+				t.Fatalf("unexpected token request %v", request)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package clientauth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// PromptCredentials asks for the username and password of a user of the
+// server's built-in identity provider. New users are asked to type their
+// password twice with confirm.
+func PromptCredentials(confirm bool) (username string, password string, err error) {
+	fmt.Print("Username: ")
+	username, err = stdin.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+
+	password, err = promptPassword("Password: ")
+	if err != nil {
+		return "", "", err
+	}
+	if confirm {
+		again, err := promptPassword("Confirm password: ")
+		if err != nil {
+			return "", "", err
+		}
+		if again != password {
+			return "", "", errors.New("passwords do not match")
+		}
+	}
+	return strings.TrimSpace(username), password, nil
+}
+
+// promptPassword reads a password without echoing it, or as a plain line when
+// stdin is not a terminal so logins can be scripted.
+func promptPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := stdin.ReadString('\n')
+		return strings.TrimRight(password, "\r\n"), err
+	}
+
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(password), err
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 )
 
@@ -11,12 +12,12 @@ type JamHubDb struct {
 	db *sql.DB
 }
 
-func New() (jamhubDB JamHubDb) {
-	err := os.MkdirAll("./jamhubdata", os.ModePerm)
+func New(root string) (jamhubDB JamHubDb) {
+	err := os.MkdirAll(root, os.ModePerm)
 	if err != nil {
 		panic(err)
 	}
-	conn, err := sql.Open("sqlite3", "./jamhubdata/jamhub.db")
+	conn, err := sql.Open("sqlite3", root+"/jamhub.db")
 	if err != nil {
 		panic(err)
 	}
@@ -24,11 +25,19 @@ func New() (jamhubDB JamHubDb) {
 	sqlStmt := `
 	CREATE TABLE IF NOT EXISTS users (username TEXT, user_id TEXT, UNIQUE(username, user_id));
 	CREATE TABLE IF NOT EXISTS projects (name TEXT, owner TEXT, UNIQUE(name, owner));
+	CREATE TABLE IF NOT EXISTS members (project_id INTEGER, user_id TEXT, role INTEGER, PRIMARY KEY (project_id, user_id));
+	CREATE TABLE IF NOT EXISTS public_projects (project_id INTEGER PRIMARY KEY);
+	CREATE TABLE IF NOT EXISTS passwords (user_id TEXT PRIMARY KEY, hash BLOB);
+	CREATE TABLE IF NOT EXISTS access_tokens (hash BLOB UNIQUE, user_id TEXT, name TEXT, scopes TEXT, project_id INTEGER, created_at INTEGER, expires_at INTEGER);
 	`
 	_, err = conn.Exec(sqlStmt)
 	if err != nil {
 		panic(err)
 	}
+	err = migrateUniqueUsernames(conn)
+	if err != nil {
+		panic(err)
+	}
 	row := conn.QueryRow("SELECT rowid FROM projects WHERE name = ? AND owner = ?", "test", "2")
 	if row.Err() != nil {
 		panic(row.Err())
@@ -39,9 +48,84 @@ func New() (jamhubDB JamHubDb) {
 	return JamHubDb{conn}
 }
 
+// migrateUniqueUsernames makes usernames unique, they used to only be unique
+// per user id. The first user to take a username keeps it and any later ones
+// are renamed to username-2, username-3 and so on. It only runs until the
+// index that keeps usernames unique is created.
+func migrateUniqueUsernames(conn *sql.DB) error {
+	var indexed bool
+	err := conn.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = 'users_username')").Scan(&indexed)
+	if err != nil || indexed {
+		return err
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type user struct {
+		rowid    int64
+		username string
+		userId   string
+	}
+	rows, err := tx.Query("SELECT rowid, username, user_id FROM users WHERE username IN (SELECT username FROM users GROUP BY username HAVING COUNT(*) > 1) ORDER BY username, rowid")
+	if err != nil {
+		return err
+	}
+	duplicates := make([]user, 0)
+	for rows.Next() {
+		u := user{}
+		err = rows.Scan(&u.rowid, &u.username, &u.userId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, u)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	kept := make(map[string]bool)
+	for _, u := range duplicates {
+		if !kept[u.username] {
+			kept[u.username] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			renamed := fmt.Sprintf("%s-%d", u.username, n)
+			var taken bool
+			err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", renamed).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				continue
+			}
+			_, err = tx.Exec("UPDATE users SET username = ? WHERE rowid = ?", renamed, u.rowid)
+			if err != nil {
+				return err
+			}
+			log.Printf("Renamed user %s from %s to %s since another user has the same username", u.userId, u.username, renamed)
+			break
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX users_username ON users(username)")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 type Project struct {
-	Name string
-	Id   uint64
+	Name   string
+	Id     uint64
+	Owner  string
+	Public bool
 }
 
 func (j JamHubDb) AddProject(projectName string, owner string) (uint64, error) {
@@ -64,22 +148,29 @@ func (j JamHubDb) AddProject(projectName string, owner string) (uint64, error) {
 }
 
 func (j JamHubDb) DeleteProject(projectName string, owner string) (uint64, error) {
-	_, err := j.GetProjectId(projectName, owner)
+	id, err := j.GetProjectId(projectName, owner)
 	if errors.Is(sql.ErrNoRows, err) {
 		return 0, fmt.Errorf("project does not exist")
 	}
 
-	res, err := j.db.Exec("DELETE FROM projects WHERE name = ? AND owner = ?", projectName, owner)
+	_, err = j.db.Exec("DELETE FROM projects WHERE name = ? AND owner = ?", projectName, owner)
 	if err != nil {
 		return 0, err
 	}
-
-	var id int64
-	if id, err = res.LastInsertId(); err != nil {
+	_, err = j.db.Exec("DELETE FROM members WHERE project_id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = j.db.Exec("DELETE FROM public_projects WHERE project_id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = j.db.Exec("DELETE FROM access_tokens WHERE project_id = ?", id)
+	if err != nil {
 		return 0, err
 	}
 
-	return uint64(id), nil
+	return id, nil
 }
 
 func (j JamHubDb) GetProjectOwner(projectId uint64) (string, error) {
@@ -104,6 +195,35 @@ func (j JamHubDb) GetProjectId(projectName string, owner string) (uint64, error)
 	return id, err
 }
 
+// GetProjectIdByOwnerUsername finds a project by name and the username of the
+// user that created it. Owners that never set a username are matched by id.
+func (j JamHubDb) GetProjectIdByOwnerUsername(projectName string, ownerUsername string) (uint64, error) {
+	row := j.db.QueryRow("SELECT rowid FROM projects WHERE name = ? AND (owner = ? OR owner IN (SELECT user_id FROM users WHERE username = ?))", projectName, ownerUsername, ownerUsername)
+	if row.Err() != nil {
+		return 0, row.Err()
+	}
+
+	var id uint64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (j JamHubDb) SetProjectPublic(projectId uint64, public bool) error {
+	var err error
+	if public {
+		_, err = j.db.Exec("INSERT OR IGNORE INTO public_projects(project_id) VALUES (?)", projectId)
+	} else {
+		_, err = j.db.Exec("DELETE FROM public_projects WHERE project_id = ?", projectId)
+	}
+	return err
+}
+
+func (j JamHubDb) IsProjectPublic(projectId uint64) (bool, error) {
+	var public bool
+	err := j.db.QueryRow("SELECT EXISTS (SELECT 1 FROM public_projects WHERE project_id = ?)", projectId).Scan(&public)
+	return public, err
+}
+
 func (j JamHubDb) GetProjectName(id uint64, owner string) (string, error) {
 	row := j.db.QueryRow("SELECT name FROM projects WHERE rowid = ? AND owner = ?", id, owner)
 	if row.Err() != nil {
@@ -115,8 +235,29 @@ func (j JamHubDb) GetProjectName(id uint64, owner string) (string, error) {
 	return name, err
 }
 
-func (j JamHubDb) ListUserProjects(owner string) ([]Project, error) {
-	rows, err := j.db.Query("SELECT rowid, name FROM projects WHERE owner = ?", owner)
+// ListUserProjects lists the projects a user created along with the projects
+// they were added to as a member.
+func (j JamHubDb) ListUserProjects(userId string) ([]Project, error) {
+	rows, err := j.db.Query("SELECT rowid, name, owner, rowid IN (SELECT project_id FROM public_projects) FROM projects WHERE owner = ? OR rowid IN (SELECT project_id FROM members WHERE user_id = ?)", userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]Project, 0)
+	for rows.Next() {
+		u := Project{}
+		err = rows.Scan(&u.Id, &u.Name, &u.Owner, &u.Public)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, err
+}
+
+func (j JamHubDb) ListProjects() ([]Project, error) {
+	rows, err := j.db.Query("SELECT rowid, name, owner FROM projects")
 	if err != nil {
 		return nil, err
 	}
@@ -125,7 +266,7 @@ func (j JamHubDb) ListUserProjects(owner string) ([]Project, error) {
 	data := make([]Project, 0)
 	for rows.Next() {
 		u := Project{}
-		err = rows.Scan(&u.Id, &u.Name)
+		err = rows.Scan(&u.Id, &u.Name, &u.Owner)
 		if err != nil {
 			return nil, err
 		}
@@ -134,9 +275,29 @@ func (j JamHubDb) ListUserProjects(owner string) ([]Project, error) {
 	return data, err
 }
 
+// ErrUsernameTaken is returned when a username belongs to another user.
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// CreateUser gives a user a username. Creating the same user again does
+// nothing.
 func (j JamHubDb) CreateUser(username, userId string) error {
-	_, err := j.db.Exec("INSERT OR IGNORE INTO users(username, user_id) VALUES (?, ?)", username, userId)
-	return err
+	res, err := j.db.Exec("INSERT INTO users(username, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING", username, userId)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil || inserted > 0 {
+		return err
+	}
+
+	existingId, err := j.UserId(username)
+	if err != nil {
+		return err
+	}
+	if existingId != userId {
+		return ErrUsernameTaken
+	}
+	return nil
 }
 
 func (j JamHubDb) Username(userId string) (string, error) {
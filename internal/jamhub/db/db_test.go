@@ -0,0 +1,94 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestCreateUser(t *testing.T) {
+	j := New(t.TempDir())
+	err := j.CreateUser("alice", "auth0|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Users are created again every time they sign in
+	err = j.CreateUser("alice", "auth0|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = j.CreateUser("alice", "auth0|2")
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected the username to be taken, got %v", err)
+	}
+	userId, err := j.UserId("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != "auth0|1" {
+		t.Fatalf("expected alice to stay auth0|1, got %s", userId)
+	}
+}
+
+func TestCreatePasswordUser(t *testing.T) {
+	j := New(t.TempDir())
+	err := j.CreateUser("alice", "auth0|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = j.CreatePasswordUser("alice", "jamhub|alice", []byte("hash"))
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected the username to be taken, got %v", err)
+	}
+	_, err = j.GetPasswordHash("jamhub|alice")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected no password to be set, got %v", err)
+	}
+
+	err = j.CreatePasswordUser("bob", "jamhub|bob", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := j.GetPasswordHash("jamhub|bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hash) != "hash" {
+		t.Fatalf("unexpected password hash %q", hash)
+	}
+}
+
+func TestMigrateUniqueUsernames(t *testing.T) {
+	dir := t.TempDir()
+	conn, err := sql.Open("sqlite3", dir+"/jamhub.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Usernames used to only be unique per user id
+	_, err = conn.Exec(`
+	CREATE TABLE users (username TEXT, user_id TEXT, UNIQUE(username, user_id));
+	INSERT INTO users(username, user_id) VALUES ('alice', 'auth0|1'), ('alice', 'auth0|2'), ('alice-2', 'auth0|3'), ('alice', 'auth0|4');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	j := New(dir)
+	for userId, username := range map[string]string{"auth0|1": "alice", "auth0|2": "alice-3", "auth0|3": "alice-2", "auth0|4": "alice-4"} {
+		got, err := j.Username(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != username {
+			t.Fatalf("expected %s to be %s, got %s", userId, username, got)
+		}
+	}
+	err = j.CreateUser("alice", "auth0|5")
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected the username to be taken, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Role is what a user is allowed to do in a project. Every role can do
+// everything the roles below it can.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleWriter
+	RoleMaintainer
+	RoleOwner
+)
+
+type Member struct {
+	UserId string
+	Role   Role
+}
+
+// GetProjectRole returns the role of a user in a project. The user that
+// created the project is always an owner.
+func (j JamHubDb) GetProjectRole(projectId uint64, userId string) (Role, error) {
+	owner, err := j.GetProjectOwner(projectId)
+	if err != nil {
+		return RoleNone, err
+	}
+	if owner == userId {
+		return RoleOwner, nil
+	}
+
+	var role Role
+	err = j.db.QueryRow("SELECT role FROM members WHERE project_id = ? AND user_id = ?", projectId, userId).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoleNone, nil
+	}
+	return role, err
+}
+
+// SetMember adds a user to a project or changes the role of an existing member.
+func (j JamHubDb) SetMember(projectId uint64, userId string, role Role) error {
+	_, err := j.db.Exec("INSERT INTO members(project_id, user_id, role) VALUES (?, ?, ?) ON CONFLICT (project_id, user_id) DO UPDATE SET role = excluded.role", projectId, userId, role)
+	return err
+}
+
+func (j JamHubDb) RemoveMember(projectId uint64, userId string) error {
+	_, err := j.db.Exec("DELETE FROM members WHERE project_id = ? AND user_id = ?", projectId, userId)
+	return err
+}
+
+// ListMembers lists the members added to a project, not including the user
+// that created it.
+func (j JamHubDb) ListMembers(projectId uint64) ([]Member, error) {
+	rows, err := j.db.Query("SELECT user_id, role FROM members WHERE project_id = ? ORDER BY role DESC, user_id", projectId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]Member, 0)
+	for rows.Next() {
+		m := Member{}
+		err = rows.Scan(&m.UserId, &m.Role)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, m)
+	}
+	return data, rows.Err()
+}
+
+// GetMemberProjectId finds a project by name among the projects a user can
+// access, preferring the user's own project over those shared with them.
+func (j JamHubDb) GetMemberProjectId(projectName string, userId string) (uint64, error) {
+	row := j.db.QueryRow(`
+	SELECT p.rowid FROM projects p LEFT JOIN members m ON m.project_id = p.rowid AND m.user_id = ?
+	WHERE p.name = ? AND (p.owner = ? OR m.user_id IS NOT NULL)
+	ORDER BY p.owner = ? DESC, p.rowid LIMIT 1`, userId, projectName, userId, userId)
+	if row.Err() != nil {
+		return 0, row.Err()
+	}
+
+	var id uint64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (j JamHubDb) UserId(username string) (string, error) {
+	row := j.db.QueryRow("SELECT user_id FROM users WHERE username = ?", username)
+	if row.Err() != nil {
+		return "", row.Err()
+	}
+
+	var userId string
+	err := row.Scan(&userId)
+	return userId, err
+}
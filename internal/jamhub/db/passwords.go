@@ -0,0 +1,40 @@
+package db
+
+// CreatePasswordUser creates a user registered with the built-in identity
+// provider along with the bcrypt hash of their password, or neither if the
+// username is already taken.
+func (j JamHubDb) CreatePasswordUser(username, userId string, hash []byte) error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO users(username, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING", username, userId)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrUsernameTaken
+	}
+	_, err = tx.Exec("INSERT INTO passwords(user_id, hash) VALUES (?, ?)", userId, hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (j JamHubDb) GetPasswordHash(userId string) ([]byte, error) {
+	row := j.db.QueryRow("SELECT hash FROM passwords WHERE user_id = ?", userId)
+	if row.Err() != nil {
+		return nil, row.Err()
+	}
+
+	var hash []byte
+	err := row.Scan(&hash)
+	return hash, err
+}
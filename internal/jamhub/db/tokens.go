@@ -0,0 +1,98 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// AccessToken is a token issued by the server for a user, or for a service
+// account of ProjectId. Only the hash of the token itself is kept.
+type AccessToken struct {
+	Id        uint64
+	UserId    string
+	Name      string
+	Scopes    []string
+	ProjectId uint64
+	CreatedAt time.Time
+	// ExpiresAt is zero for tokens that never expire
+	ExpiresAt time.Time
+}
+
+func (j JamHubDb) AddAccessToken(hash []byte, token AccessToken) (uint64, error) {
+	var expiresAt int64
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = token.ExpiresAt.Unix()
+	}
+	res, err := j.db.Exec("INSERT INTO access_tokens(hash, user_id, name, scopes, project_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		hash, token.UserId, token.Name, strings.Join(token.Scopes, " "), token.ProjectId, token.CreatedAt.Unix(), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(id), nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAccessToken(row rowScanner) (AccessToken, error) {
+	var token AccessToken
+	var scopes string
+	var createdAt, expiresAt int64
+	err := row.Scan(&token.Id, &token.UserId, &token.Name, &scopes, &token.ProjectId, &createdAt, &expiresAt)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	token.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt != 0 {
+		token.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	return token, nil
+}
+
+const accessTokenColumns = "rowid, user_id, name, scopes, project_id, created_at, expires_at"
+
+func (j JamHubDb) GetAccessTokenByHash(hash []byte) (AccessToken, error) {
+	return scanAccessToken(j.db.QueryRow("SELECT "+accessTokenColumns+" FROM access_tokens WHERE hash = ?", hash))
+}
+
+func (j JamHubDb) GetAccessToken(id uint64) (AccessToken, error) {
+	return scanAccessToken(j.db.QueryRow("SELECT "+accessTokenColumns+" FROM access_tokens WHERE rowid = ?", id))
+}
+
+// ListAccessTokens lists a user's personal tokens if projectId is 0, otherwise
+// the tokens of the project's service accounts.
+func (j JamHubDb) ListAccessTokens(userId string, projectId uint64) ([]AccessToken, error) {
+	query := "SELECT " + accessTokenColumns + " FROM access_tokens WHERE user_id = ? AND project_id = 0 ORDER BY rowid"
+	arg := any(userId)
+	if projectId != 0 {
+		query = "SELECT " + accessTokenColumns + " FROM access_tokens WHERE project_id = ? ORDER BY rowid"
+		arg = projectId
+	}
+	rows, err := j.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]AccessToken, 0)
+	for rows.Next() {
+		token, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, token)
+	}
+	return data, rows.Err()
+}
+
+func (j JamHubDb) DeleteAccessToken(id uint64) error {
+	_, err := j.db.Exec("DELETE FROM access_tokens WHERE rowid = ?", id)
+	return err
+}
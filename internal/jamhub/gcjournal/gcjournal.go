@@ -0,0 +1,258 @@
+// Package gcjournal swaps in the files rewritten by garbage collection all at
+// once. Rewritten files are staged under new names and only replace the files
+// they rewrite after a journal listing every swap is on disk, so a crash
+// either leaves every old file in place or is finished by Recover.
+package gcjournal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	journalName = "journal"
+	stagingName = "staging"
+)
+
+type swap struct {
+	Staged string `json:"staged"`
+	Target string `json:"target"`
+}
+
+type entries struct {
+	Swaps   []swap   `json:"swaps"`
+	Removes []string `json:"removes"`
+}
+
+// Journal collects the swaps and removals of one commit. The directory it is
+// kept in has to be on the same filesystem as the files it swaps.
+type Journal struct {
+	dir    string
+	staged int
+	entries
+}
+
+// Open finishes any journal left behind in dir and starts a new one.
+func Open(dir string) (*Journal, error) {
+	err := Recover(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(dir, stagingName), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir}, nil
+}
+
+// Recover applies the journal in dir if a crash left one behind and removes
+// the files staged for a journal that was never committed.
+func Recover(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, journalName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var e entries
+		err = json.Unmarshal(data, &e)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", filepath.Join(dir, journalName), err)
+		}
+		err = e.apply()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(filepath.Join(dir, journalName))
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(dir, stagingName))
+}
+
+// Create stages a file that replaces target once the journal is committed.
+func (j *Journal) Create(target string) (*os.File, error) {
+	j.staged++
+	staged := filepath.Join(j.dir, stagingName, strconv.Itoa(j.staged))
+	file, err := os.Create(staged)
+	if err != nil {
+		return nil, err
+	}
+	j.Swaps = append(j.Swaps, swap{Staged: staged, Target: target})
+	return file, nil
+}
+
+// Remove removes target once the journal is committed.
+func (j *Journal) Remove(target string) {
+	j.Removes = append(j.Removes, target)
+}
+
+// Commit swaps in every staged file and removes the files given to Remove.
+// Files staged with Create have to be closed first.
+func (j *Journal) Commit() error {
+	if len(j.Swaps) == 0 && len(j.Removes) == 0 {
+		return nil
+	}
+	err := j.write()
+	if err != nil {
+		return err
+	}
+	err = j.apply()
+	if err != nil {
+		return err
+	}
+	j.entries = entries{}
+	return os.Remove(filepath.Join(j.dir, journalName))
+}
+
+// write puts the journal on disk along with every file it stages. Once it
+// returns the swaps are finished by Recover after a crash.
+func (j *Journal) write() error {
+	for _, s := range j.Swaps {
+		err := syncPath(s.Staged)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+	tempPath := filepath.Join(j.dir, stagingName, journalName)
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, filepath.Join(j.dir, journalName))
+	if err != nil {
+		return err
+	}
+	return syncPath(j.dir)
+}
+
+// apply can be repeated after a crash, swaps that were already done are no
+// longer staged and removed files are already gone.
+func (e entries) apply() error {
+	dirs := make(map[string]bool)
+	for _, s := range e.Swaps {
+		err := os.Rename(s.Staged, s.Target)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dirs[filepath.Dir(s.Target)] = true
+	}
+	for _, target := range e.Removes {
+		err := os.Remove(target)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dirs[filepath.Dir(target)] = true
+	}
+	for dir := range dirs {
+		err := syncPath(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// CompactFile stages a copy of the op data file at path with only the
+// operations at the offsets in live, which maps offsets to lengths, or stages
+// its removal if there are none. It returns the new offset of every kept
+// operation, the chunk digests they refer to and the number of bytes
+// reclaimed.
+func (j *Journal) CompactFile(path string, live map[uint64]uint64) (map[uint64]uint64, [][]byte, uint64, error) {
+	currFile, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer currFile.Close()
+	info, err := currFile.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(live) == 0 {
+		j.Remove(path)
+		return nil, nil, uint64(info.Size()), nil
+	}
+
+	offsets := make([]uint64, 0, len(live))
+	for offset := range live {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	stagedFile, err := j.Create(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer stagedFile.Close()
+
+	moved := make(map[uint64]uint64, len(live))
+	digests := make([][]byte, 0, len(live))
+	var size uint64
+	for _, offset := range offsets {
+		b := make([]byte, live[offset])
+		_, err = currFile.ReadAt(b, int64(offset))
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("reading operation at %d in %s: %w", offset, path, err)
+		}
+		op := new(pb.Operation)
+		err = proto.Unmarshal(b, op)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("reading operation at %d in %s: %w", offset, path, err)
+		}
+		if digest := op.GetChunk().GetDigest(); len(digest) > 0 {
+			digests = append(digests, digest)
+		}
+
+		_, err = stagedFile.Write(b)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		moved[offset] = size
+		size += uint64(len(b))
+	}
+
+	err = stagedFile.Close()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return moved, digests, uint64(info.Size()) - size, nil
+}
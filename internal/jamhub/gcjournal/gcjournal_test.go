@@ -0,0 +1,183 @@
+package gcjournal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func stage(t *testing.T, j *Journal, target, data string) {
+	file, err := j.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	swapped, removed := filepath.Join(dir, "swapped"), filepath.Join(dir, "removed")
+	writeFile(t, swapped, "old")
+	writeFile(t, removed, "old")
+
+	j, err := Open(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(t, j, swapped, "new")
+	j.Remove(removed)
+	if readFile(t, swapped) != "old" || !exists(removed) {
+		t.Fatal("expected nothing to change before the journal is committed")
+	}
+
+	err = j.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, swapped) != "new" || exists(removed) {
+		t.Fatal("expected the journal to be applied")
+	}
+	if exists(filepath.Join(dir, "gc", journalName)) {
+		t.Fatal("expected the journal to be removed")
+	}
+}
+
+func TestRecoverUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	writeFile(t, target, "old")
+
+	j, err := Open(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(t, j, target, "new")
+
+	// A crash before the journal is written leaves the old files in place
+	err = Recover(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, target) != "old" {
+		t.Fatal("expected an uncommitted journal to be ignored")
+	}
+	if exists(filepath.Join(dir, "gc", stagingName)) {
+		t.Fatal("expected staged files to be removed")
+	}
+}
+
+func TestRecoverCommitted(t *testing.T) {
+	dir := t.TempDir()
+	first, second, removed := filepath.Join(dir, "first"), filepath.Join(dir, "second"), filepath.Join(dir, "removed")
+	writeFile(t, first, "old")
+	writeFile(t, second, "old")
+	writeFile(t, removed, "old")
+
+	j, err := Open(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(t, j, first, "new")
+	stage(t, j, second, "new")
+	j.Remove(removed)
+	err = j.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash part way through leaves some files swapped
+	err = os.Rename(j.Swaps[0].Staged, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Recover(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, first) != "new" || readFile(t, second) != "new" || exists(removed) {
+		t.Fatal("expected a written journal to be finished")
+	}
+	if exists(filepath.Join(dir, "gc", journalName)) {
+		t.Fatal("expected the journal to be removed")
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.locs")
+
+	ops := make([][]byte, 0)
+	for _, data := range []string{"first", "second", "third"} {
+		b, err := proto.Marshal(&pb.Operation{Type: pb.Operation_OpData, Chunk: &pb.Chunk{Digest: []byte(data)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, b)
+	}
+	writeFile(t, path, string(ops[0])+string(ops[1])+string(ops[2]))
+	thirdOffset := uint64(len(ops[0]) + len(ops[1]))
+
+	j, err := Open(filepath.Join(dir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, digests, reclaimed, err := j.CompactFile(path, map[uint64]uint64{
+		0:           uint64(len(ops[0])),
+		thirdOffset: uint64(len(ops[2])),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved[0] != 0 || moved[thirdOffset] != uint64(len(ops[0])) {
+		t.Fatalf("unexpected offsets %v", moved)
+	}
+	if len(digests) != 2 || string(digests[0]) != "first" || string(digests[1]) != "third" {
+		t.Fatalf("unexpected digests %q", digests)
+	}
+	if reclaimed != uint64(len(ops[1])) {
+		t.Fatalf("expected %d bytes reclaimed, got %d", len(ops[1]), reclaimed)
+	}
+	if readFile(t, path) != string(ops[0])+string(ops[1])+string(ops[2]) {
+		t.Fatal("expected the data file to be kept until the journal is committed")
+	}
+
+	err = j.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, path) != string(ops[0])+string(ops[2]) {
+		t.Fatal("expected the compacted data file to be swapped in")
+	}
+}
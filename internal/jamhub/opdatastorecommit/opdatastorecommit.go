@@ -1,22 +1,34 @@
 package opdatastorecommit
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/chunkstore"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
 	"google.golang.org/protobuf/proto"
 )
 
+// LocalStore appends the operations of each file to its own file. The data of
+// each operation is kept in the chunk store so only one copy of identical
+// chunks is stored.
 type LocalStore struct {
-	cache *lru.Cache[string, *os.File]
-	mu    sync.Mutex
+	root   string
+	cache  *lru.Cache[string, *os.File]
+	mu     sync.Mutex
+	chunks *chunkstore.LocalStore
 }
 
-func NewOpDataStoreCommit() *LocalStore {
+func NewOpDataStoreCommit(root string, chunks *chunkstore.LocalStore) *LocalStore {
 	cache, err := lru.NewWithEvict(2048, func(path string, file *os.File) {
 		err := file.Close()
 		if err != nil {
@@ -28,16 +40,37 @@ func NewOpDataStoreCommit() *LocalStore {
 		panic(err)
 	}
 	return &LocalStore{
-		cache: cache,
+		root:   root,
+		cache:  cache,
+		chunks: chunks,
 	}
 }
 
+// holder names the references to the chunk store made by the stored
+// operations. It does not include the data root so references made before
+// the root was moved still match.
+func (s *LocalStore) holder(ownerId string, projectId uint64) string {
+	return fmt.Sprintf("jamhubdata/%s/%d/opdatacommit/", ownerId, projectId)
+}
+
+// commitHolder names the references made while writing a commit so they can
+// be dropped if it is discarded. Compacting moves them to the project's holder.
+func (s *LocalStore) commitHolder(ownerId string, projectId uint64, commitId uint64) string {
+	return fmt.Sprintf("%s%d/", s.holder(ownerId, projectId), commitId)
+}
+
+// NewRefs collects the chunk references of operations written for a commit.
+// They have to be committed before the commit is published.
+func (s *LocalStore) NewRefs(ownerId string, projectId uint64, commitId uint64) *chunkstore.Refs {
+	return s.chunks.NewRefs(s.commitHolder(ownerId, projectId, commitId))
+}
+
 func (s *LocalStore) filePath(ownerId string, projectId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/opdatacommit/%02X/%02X.locs", ownerId, projectId, pathHash[:1], pathHash)
+	return fmt.Sprintf("%s/%s/%d/opdatacommit/%02X/%02X.locs", s.root, ownerId, projectId, pathHash[:1], pathHash)
 }
 
 func (s *LocalStore) fileDir(ownerId string, projectId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/opdatacommit/%02X", ownerId, projectId, pathHash[:1])
+	return fmt.Sprintf("%s/%s/%d/opdatacommit/%02X", s.root, ownerId, projectId, pathHash[:1])
 }
 
 func (s *LocalStore) Read(ownerId string, projectId uint64, pathHash []byte, offset uint64, length uint64) (*pb.Operation, error) {
@@ -68,10 +101,17 @@ func (s *LocalStore) Read(ownerId string, projectId uint64, pathHash []byte, off
 	if err != nil {
 		log.Panic(err)
 	}
+	if digest := op.GetChunk().GetDigest(); len(digest) > 0 {
+		op.Chunk.Data, err = s.chunks.Get(digest)
+		if err != nil {
+			return nil, err
+		}
+		op.Chunk.Digest = nil
+	}
 	return op, nil
 }
 
-func (s *LocalStore) Write(ownerId string, projectId uint64, pathHash []byte, op *pb.Operation) (offset uint64, length uint64, err error) {
+func (s *LocalStore) Write(ownerId string, projectId uint64, pathHash []byte, op *pb.Operation, refs *chunkstore.Refs) (offset uint64, length uint64, err error) {
 	err = os.MkdirAll(s.fileDir(ownerId, projectId, pathHash), os.ModePerm)
 	if err != nil {
 		return 0, 0, err
@@ -88,6 +128,19 @@ func (s *LocalStore) Write(ownerId string, projectId uint64, pathHash []byte, op
 		s.cache.Add(filePath, currFile)
 	}
 
+	if op.GetChunk() != nil {
+		// Only digests of data written here are trusted
+		op = proto.Clone(op).(*pb.Operation)
+		op.Chunk.Digest = nil
+		if len(op.Chunk.Data) > 0 {
+			op.Chunk.Digest, err = refs.Put(op.Chunk.Data)
+			if err != nil {
+				return 0, 0, err
+			}
+			op.Chunk.Data = nil
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	info, err := currFile.Stat()
@@ -105,6 +158,97 @@ func (s *LocalStore) Write(ownerId string, projectId uint64, pathHash []byte, op
 	return uint64(info.Size()), uint64(writtenBytes), nil
 }
 
+// Sync flushes the operations written for the given files to disk.
+func (s *LocalStore) Sync(ownerId string, projectId uint64, pathHashes [][]byte) error {
+	dirs := map[string]bool{
+		fmt.Sprintf("%s/%s/%d/opdatacommit", s.root, ownerId, projectId): true,
+	}
+	for _, pathHash := range pathHashes {
+		err := syncPath(s.filePath(ownerId, projectId, pathHash))
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dirs[s.fileDir(ownerId, projectId, pathHash)] = true
+	}
+	for dir := range dirs {
+		err := syncPath(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Compact stages a rewrite of the data file of each path in a project that
+// keeps only the operations at the offsets in live, which maps path hashes to
+// the offsets and lengths of their live operations. The rewritten files
+// replace the current ones when journal is committed. It returns the new
+// offset of every kept operation by path hash and the number of bytes
+// reclaimed, including chunks that are no longer referenced.
+func (s *LocalStore) Compact(ownerId string, projectId uint64, live map[string]map[uint64]uint64, journal *gcjournal.Journal) (map[string]map[uint64]uint64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	moved := make(map[string]map[uint64]uint64)
+	digests := make([][]byte, 0)
+	var reclaimed uint64
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s/%d/opdatacommit", s.root, ownerId, projectId), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".locs") {
+			return nil
+		}
+		pathHash, err := hex.DecodeString(strings.TrimSuffix(d.Name(), ".locs"))
+		if err != nil {
+			return err
+		}
+
+		// Cached handles would keep using the file that is replaced
+		s.cache.Remove(path)
+		fileMoved, fileDigests, fileReclaimed, err := journal.CompactFile(path, live[string(pathHash)])
+		if err != nil {
+			return err
+		}
+		moved[string(pathHash)] = fileMoved
+		digests = append(digests, fileDigests...)
+		reclaimed += fileReclaimed
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	chunkBytes, err := s.chunks.Reset(s.holder(ownerId, projectId), digests)
+	if err != nil {
+		return nil, 0, err
+	}
+	return moved, reclaimed + chunkBytes, nil
+}
+
+// DiscardCommit drops the chunk references of a commit that was never
+// published. Its operations are left in the data files until they are
+// compacted.
+func (s *LocalStore) DiscardCommit(ownerId string, projectId uint64, commitId uint64) error {
+	return s.chunks.Release(s.commitHolder(ownerId, projectId, commitId))
+}
+
 func (s *LocalStore) DeleteProject(ownerId string, projectId uint64) error {
-	return os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d/opdatacommit", ownerId, projectId))
+	err := s.chunks.Release(s.holder(ownerId, projectId))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(fmt.Sprintf("%s/%s/%d/opdatacommit", s.root, ownerId, projectId))
 }
@@ -2,25 +2,34 @@ package opdatastoreworkspace
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/chunkstore"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
 	"google.golang.org/protobuf/proto"
 )
 
+// LocalStore keeps the operations pushed to workspaces, with their data in the
+// shared chunk store like opdatastorecommit.
 type LocalStore struct {
-	cache *lru.Cache[string, *os.File]
-	mu    sync.Mutex
+	root   string
+	cache  *lru.Cache[string, *os.File]
+	mu     sync.Mutex
+	chunks *chunkstore.LocalStore
 }
 
-func NewOpDataStoreWorkspace() *LocalStore {
+func NewOpDataStoreWorkspace(root string, chunks *chunkstore.LocalStore) *LocalStore {
 	cache, err := lru.NewWithEvict(2048, func(path string, file *os.File) {
 		err := file.Close()
 		if err != nil {
@@ -32,16 +41,27 @@ func NewOpDataStoreWorkspace() *LocalStore {
 		panic(err)
 	}
 	return &LocalStore{
-		cache: cache,
+		root:   root,
+		cache:  cache,
+		chunks: chunks,
 	}
 }
 
+func (s *LocalStore) holder(ownerId string, projectId, workspaceId uint64) string {
+	return fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d/", ownerId, projectId, workspaceId)
+}
+
+// NewRefs collects the chunk references of operations written to a workspace.
+func (s *LocalStore) NewRefs(ownerId string, projectId, workspaceId uint64) *chunkstore.Refs {
+	return s.chunks.NewRefs(s.holder(ownerId, projectId, workspaceId))
+}
+
 func (s *LocalStore) filePath(ownerId string, projectId, workspaceId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d/%02X/%02X.locs", ownerId, projectId, workspaceId, pathHash[:1], pathHash)
+	return fmt.Sprintf("%s/%s/%d/opdataworkspace/%d/%02X/%02X.locs", s.root, ownerId, projectId, workspaceId, pathHash[:1], pathHash)
 }
 
 func (s *LocalStore) fileDir(ownerId string, projectId, workspaceId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d/%02X", ownerId, projectId, workspaceId, pathHash[:1])
+	return fmt.Sprintf("%s/%s/%d/opdataworkspace/%d/%02X", s.root, ownerId, projectId, workspaceId, pathHash[:1])
 }
 
 func (s *LocalStore) Read(ownerId string, projectId, workspaceId uint64, pathHash []byte, offset uint64, length uint64) (*pb.Operation, error) {
@@ -72,10 +92,17 @@ func (s *LocalStore) Read(ownerId string, projectId, workspaceId uint64, pathHas
 	if err != nil {
 		log.Panic(err)
 	}
+	if digest := op.GetChunk().GetDigest(); len(digest) > 0 {
+		op.Chunk.Data, err = s.chunks.Get(digest)
+		if err != nil {
+			return nil, err
+		}
+		op.Chunk.Digest = nil
+	}
 	return op, nil
 }
 
-func (s *LocalStore) Write(ownerId string, projectId, workspaceId uint64, pathHash []byte, op *pb.Operation) (offset uint64, length uint64, err error) {
+func (s *LocalStore) Write(ownerId string, projectId, workspaceId uint64, pathHash []byte, op *pb.Operation, refs *chunkstore.Refs) (offset uint64, length uint64, err error) {
 	err = os.MkdirAll(s.fileDir(ownerId, projectId, workspaceId, pathHash), os.ModePerm)
 	if err != nil {
 		return 0, 0, err
@@ -93,6 +120,19 @@ func (s *LocalStore) Write(ownerId string, projectId, workspaceId uint64, pathHa
 		s.cache.Add(filePath, currFile)
 	}
 
+	if op.GetChunk() != nil {
+		// Only digests of data written here are trusted
+		op = proto.Clone(op).(*pb.Operation)
+		op.Chunk.Digest = nil
+		if len(op.Chunk.Data) > 0 {
+			op.Chunk.Digest, err = refs.Put(op.Chunk.Data)
+			if err != nil {
+				return 0, 0, err
+			}
+			op.Chunk.Data = nil
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	info, err := currFile.Stat()
@@ -111,7 +151,7 @@ func (s *LocalStore) Write(ownerId string, projectId, workspaceId uint64, pathHa
 }
 
 func (s *LocalStore) GetChangedPathHashes(ownerId string, projectId uint64, workspaceId uint64) ([][]byte, error) {
-	projectDataDir := fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d", ownerId, projectId, workspaceId)
+	projectDataDir := fmt.Sprintf("%s/%s/%d/opdataworkspace/%d", s.root, ownerId, projectId, workspaceId)
 	dirs, err := ioutil.ReadDir(projectDataDir)
 	if err != nil {
 		return nil, err
@@ -136,18 +176,91 @@ func (s *LocalStore) GetChangedPathHashes(ownerId string, projectId uint64, work
 	return pathHashes, nil
 }
 
+// Compact stages a rewrite of the data files of a workspace like
+// opdatastorecommit.LocalStore.Compact does for a project.
+func (s *LocalStore) Compact(ownerId string, projectId, workspaceId uint64, live map[string]map[uint64]uint64, journal *gcjournal.Journal) (map[string]map[uint64]uint64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	moved := make(map[string]map[uint64]uint64)
+	digests := make([][]byte, 0)
+	var reclaimed uint64
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s/%d/opdataworkspace/%d", s.root, ownerId, projectId, workspaceId), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".locs") {
+			return nil
+		}
+		pathHash, err := hex.DecodeString(strings.TrimSuffix(d.Name(), ".locs"))
+		if err != nil {
+			return err
+		}
+
+		s.cache.Remove(path)
+		fileMoved, fileDigests, fileReclaimed, err := journal.CompactFile(path, live[string(pathHash)])
+		if err != nil {
+			return err
+		}
+		moved[string(pathHash)] = fileMoved
+		digests = append(digests, fileDigests...)
+		reclaimed += fileReclaimed
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	chunkBytes, err := s.chunks.Reset(s.holder(ownerId, projectId, workspaceId), digests)
+	if err != nil {
+		return nil, 0, err
+	}
+	return moved, reclaimed + chunkBytes, nil
+}
+
+// ListWorkspaceIds lists the workspaces that have data stored, including ones
+// that were deleted.
+func (s *LocalStore) ListWorkspaceIds(ownerId string, projectId uint64) ([]uint64, error) {
+	dirs, err := os.ReadDir(fmt.Sprintf("%s/%s/%d/opdataworkspace", s.root, ownerId, projectId))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workspaceIds := make([]uint64, 0, len(dirs))
+	for _, dir := range dirs {
+		workspaceId, err := strconv.ParseUint(dir.Name(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		workspaceIds = append(workspaceIds, workspaceId)
+	}
+	return workspaceIds, nil
+}
+
 func (s *LocalStore) DeleteProject(ownerId string, projectId uint64) error {
-	return os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace", ownerId, projectId))
+	err := s.chunks.Release(fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/", ownerId, projectId))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(fmt.Sprintf("%s/%s/%d/opdataworkspace", s.root, ownerId, projectId))
 }
 
 func (s *LocalStore) DeleteWorkspace(ownerId string, projectId uint64, workspaceId uint64) error {
-	dirs, err := ioutil.ReadDir(fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d", ownerId, projectId, workspaceId))
+	err := s.chunks.Release(s.holder(ownerId, projectId, workspaceId))
+	if err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(fmt.Sprintf("%s/%s/%d/opdataworkspace/%d", s.root, ownerId, projectId, workspaceId))
 	if err != nil {
 		return err
 	}
 
 	for _, dir := range dirs {
-		err := os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d/opdataworkspace/%d/%s", ownerId, projectId, workspaceId, dir.Name()))
+		err := os.RemoveAll(fmt.Sprintf("%s/%s/%d/opdataworkspace/%d/%s", s.root, ownerId, projectId, workspaceId, dir.Name()))
 		if err != nil {
 			return err
 		}
@@ -2,34 +2,39 @@ package oplocstorecommit
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
 	"google.golang.org/protobuf/proto"
 )
 
 type LocalOpLocStore struct {
+	root  string
 	cache *lru.Cache[string, *os.File]
 	mu    sync.Mutex
 }
 
 func (s *LocalOpLocStore) filePath(ownerId string, projectId uint64, commitId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/oplocstorecommit/%d/%02X/%02X.locs", ownerId, projectId, commitId, pathHash[:1], pathHash)
+	return fmt.Sprintf("%s/%s/%d/oplocstorecommit/%d/%02X/%02X.locs", s.root, ownerId, projectId, commitId, pathHash[:1], pathHash)
 }
 
 func (s *LocalOpLocStore) fileDir(ownerId string, projectId uint64, commitId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/oplocstorecommit/%d/%02X", ownerId, projectId, commitId, pathHash[:1])
+	return fmt.Sprintf("%s/%s/%d/oplocstorecommit/%d/%02X", s.root, ownerId, projectId, commitId, pathHash[:1])
 }
 
-func NewOpLocStoreCommit() *LocalOpLocStore {
+func NewOpLocStoreCommit(root string) *LocalOpLocStore {
 	cache, err := lru.NewWithEvict(2048, func(path string, file *os.File) {
 		err := file.Close()
 		if err != nil {
@@ -41,6 +46,7 @@ func NewOpLocStoreCommit() *LocalOpLocStore {
 		panic(err)
 	}
 	return &LocalOpLocStore{
+		root:  root,
 		cache: cache,
 	}
 }
@@ -74,30 +80,116 @@ func (s *LocalOpLocStore) InsertOperationLocations(opLocs *pb.CommitOperationLoc
 	return err
 }
 
+func (s *LocalOpLocStore) headPath(ownerId string, projectId uint64) string {
+	return fmt.Sprintf("%s/%s/%d/oplocstorecommit/HEAD", s.root, ownerId, projectId)
+}
+
+func (s *LocalOpLocStore) commitDir(ownerId string, projectId uint64, commitId uint64) string {
+	return fmt.Sprintf("%s/%s/%d/oplocstorecommit/%d", s.root, ownerId, projectId, commitId)
+}
+
+// MaxCommitId returns the head commit of a project, the latest commit that was
+// published. Commits are written before they are published so any later ones
+// are still being merged or were left behind by a crash.
 func (s *LocalOpLocStore) MaxCommitId(ownerId string, projectId uint64) (uint64, error) {
-	commitDir := fmt.Sprintf("jamhubdata/%s/%d/oplocstorecommit/", ownerId, projectId)
-	_, err := os.Stat(commitDir)
+	// ErrNotExists returned when no commit has been published yet (probably a new project)
+	data, err := os.ReadFile(s.headPath(ownerId, projectId))
 	if err != nil {
-		// ErrNotExists returned when no commit directory has been created yet (probably a new project)
 		return 0, err
 	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
 
-	files, err := ioutil.ReadDir(fmt.Sprintf("jamhubdata/%s/%d/oplocstorecommit/", ownerId, projectId))
+// ListCommitIds lists every commit with operation locations written, whether
+// it was published or not.
+func (s *LocalOpLocStore) ListCommitIds(ownerId string, projectId uint64) ([]uint64, error) {
+	files, err := os.ReadDir(fmt.Sprintf("%s/%s/%d/oplocstorecommit", s.root, ownerId, projectId))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	maxChangeId := 0
+	commitIds := make([]uint64, 0, len(files))
 	for _, file := range files {
-		changeId, err := strconv.Atoi(file.Name())
+		if !file.IsDir() {
+			continue
+		}
+		commitId, err := strconv.ParseUint(file.Name(), 10, 64)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		if changeId > maxChangeId {
-			maxChangeId = changeId
+		commitIds = append(commitIds, commitId)
+	}
+	return commitIds, nil
+}
+
+// PublishCommit makes a commit the head once all of its operation locations
+// are written. They are synced to disk first and the head is replaced
+// atomically so a crash never leaves a partially written head.
+func (s *LocalOpLocStore) PublishCommit(ownerId string, projectId uint64, commitId uint64) error {
+	commitDir := s.commitDir(ownerId, projectId, commitId)
+	err := filepath.WalkDir(commitDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return syncPath(path)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	headPath := s.headPath(ownerId, projectId)
+	err = os.MkdirAll(filepath.Dir(headPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(headPath), "HEAD")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.WriteString(strconv.FormatUint(commitId, 10))
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile.Name(), headPath)
+	if err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(headPath))
+}
+
+// DiscardCommit removes the operation locations of a commit that was never
+// published.
+func (s *LocalOpLocStore) DiscardCommit(ownerId string, projectId uint64, commitId uint64) error {
+	commitDir := s.commitDir(ownerId, projectId, commitId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Cached handles would keep writing to the removed files
+	for _, path := range s.cache.Keys() {
+		if strings.HasPrefix(path, commitDir+"/") {
+			s.cache.Remove(path)
 		}
 	}
-	return uint64(maxChangeId), nil
+	return os.RemoveAll(commitDir)
+}
+
+// syncPath flushes a file or directory to disk.
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
 }
 
 func (s *LocalOpLocStore) ListOperationLocations(ownerId string, projectId uint64, commitId uint64, pathHash []byte) (opLocs *pb.CommitOperationLocations, err error) {
@@ -131,6 +223,67 @@ func (s *LocalOpLocStore) ListOperationLocations(ownerId string, projectId uint6
 	return opLocs, err
 }
 
+// HasOperationLocations reports whether the file was changed in the commit.
+func (s *LocalOpLocStore) HasOperationLocations(ownerId string, projectId uint64, commitId uint64, pathHash []byte) (bool, error) {
+	_, err := os.Stat(s.filePath(ownerId, projectId, commitId, pathHash))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListPathHashes lists the files that have operation locations in the commit.
+func (s *LocalOpLocStore) ListPathHashes(ownerId string, projectId uint64, commitId uint64) ([][]byte, error) {
+	commitDir := fmt.Sprintf("%s/%s/%d/oplocstorecommit/%d", s.root, ownerId, projectId, commitId)
+	dirs, err := os.ReadDir(commitDir)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pathHashes := make([][]byte, 0)
+	for _, dir := range dirs {
+		files, err := os.ReadDir(filepath.Join(commitDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			pathHash, err := hex.DecodeString(strings.TrimSuffix(file.Name(), ".locs"))
+			if err != nil {
+				return nil, err
+			}
+			pathHashes = append(pathHashes, pathHash)
+		}
+	}
+	return pathHashes, nil
+}
+
+// ReplaceOperationLocations stages new operation locations for a file that
+// replace the current ones when journal is committed.
+func (s *LocalOpLocStore) ReplaceOperationLocations(opLocs *pb.CommitOperationLocations, journal *gcjournal.Journal) error {
+	filePath := s.filePath(opLocs.GetOwnerId(), opLocs.GetProjectId(), opLocs.GetCommitId(), opLocs.GetPathHash())
+	data, err := proto.Marshal(opLocs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Cached handles would keep using the file that is replaced
+	s.cache.Remove(filePath)
+	stagedFile, err := journal.Create(filePath)
+	if err != nil {
+		return err
+	}
+	_, err = stagedFile.Write(data)
+	if closeErr := stagedFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (s *LocalOpLocStore) DeleteProject(ownerId string, projectId uint64) error {
-	return os.RemoveAll(fmt.Sprintf("jamhubdata/oplocs/%s/%d", ownerId, projectId))
+	return os.RemoveAll(fmt.Sprintf("%s/%s/%d/oplocstorecommit", s.root, ownerId, projectId))
 }
@@ -2,34 +2,39 @@ package oplocstoreworkspace
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
 	"google.golang.org/protobuf/proto"
 )
 
 type LocalOpLocStore struct {
+	root  string
 	cache *lru.Cache[string, *os.File]
 	mu    sync.Mutex
 }
 
 func (s *LocalOpLocStore) filePath(ownerId string, projectId, workspaceId, changeId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d/%d/%02X/%02X.locs", ownerId, projectId, workspaceId, changeId, pathHash[:1], pathHash)
+	return fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d/%d/%02X/%02X.locs", s.root, ownerId, projectId, workspaceId, changeId, pathHash[:1], pathHash)
 }
 
 func (s *LocalOpLocStore) fileDir(ownerId string, projectId, workspaceId, changeId uint64, pathHash []byte) string {
-	return fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d/%d/%02X", ownerId, projectId, workspaceId, changeId, pathHash[:1])
+	return fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d/%d/%02X", s.root, ownerId, projectId, workspaceId, changeId, pathHash[:1])
 }
 
-func NewOpLocStoreWorkspace() *LocalOpLocStore {
+func NewOpLocStoreWorkspace(root string) *LocalOpLocStore {
 	cache, err := lru.NewWithEvict(2048, func(path string, file *os.File) {
 		err := file.Close()
 		if err != nil {
@@ -41,6 +46,7 @@ func NewOpLocStoreWorkspace() *LocalOpLocStore {
 		panic(err)
 	}
 	return &LocalOpLocStore{
+		root:  root,
 		cache: cache,
 	}
 }
@@ -107,13 +113,13 @@ func (s *LocalOpLocStore) ListOperationLocations(ownerId string, projectId, work
 }
 
 func (s *LocalOpLocStore) MaxChangeId(ownerId string, projectId, workspaceId uint64) (uint64, error) {
-	workspaceDir := fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d", ownerId, projectId, workspaceId)
+	workspaceDir := fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d", s.root, ownerId, projectId, workspaceId)
 	_, err := os.Stat(workspaceDir)
 	if err != nil && errors.Is(err, os.ErrNotExist) {
 		return 0, nil
 	}
 
-	files, err := ioutil.ReadDir(fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d", ownerId, projectId, workspaceId))
+	files, err := ioutil.ReadDir(fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d", s.root, ownerId, projectId, workspaceId))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -131,18 +137,92 @@ func (s *LocalOpLocStore) MaxChangeId(ownerId string, projectId, workspaceId uin
 	return uint64(maxChangeId), nil
 }
 
+// ListPathHashes lists the files that have operation locations in the change.
+func (s *LocalOpLocStore) ListPathHashes(ownerId string, projectId, workspaceId, changeId uint64) ([][]byte, error) {
+	changeDir := fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d/%d", s.root, ownerId, projectId, workspaceId, changeId)
+	dirs, err := os.ReadDir(changeDir)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pathHashes := make([][]byte, 0)
+	for _, dir := range dirs {
+		files, err := os.ReadDir(filepath.Join(changeDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			pathHash, err := hex.DecodeString(strings.TrimSuffix(file.Name(), ".locs"))
+			if err != nil {
+				return nil, err
+			}
+			pathHashes = append(pathHashes, pathHash)
+		}
+	}
+	return pathHashes, nil
+}
+
+// ReplaceOperationLocations stages new operation locations for a file that
+// replace the current ones when journal is committed.
+func (s *LocalOpLocStore) ReplaceOperationLocations(opLocs *pb.WorkspaceOperationLocations, journal *gcjournal.Journal) error {
+	filePath := s.filePath(opLocs.GetOwnerId(), opLocs.GetProjectId(), opLocs.GetWorkspaceId(), opLocs.GetChangeId(), opLocs.GetPathHash())
+	data, err := proto.Marshal(opLocs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Cached handles would keep using the file that is replaced
+	s.cache.Remove(filePath)
+	stagedFile, err := journal.Create(filePath)
+	if err != nil {
+		return err
+	}
+	_, err = stagedFile.Write(data)
+	if closeErr := stagedFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ListWorkspaceIds lists the workspaces that have operation locations stored,
+// including ones that were deleted.
+func (s *LocalOpLocStore) ListWorkspaceIds(ownerId string, projectId uint64) ([]uint64, error) {
+	dirs, err := os.ReadDir(fmt.Sprintf("%s/%s/%d/oplocstoreworkspace", s.root, ownerId, projectId))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workspaceIds := make([]uint64, 0, len(dirs))
+	for _, dir := range dirs {
+		workspaceId, err := strconv.ParseUint(dir.Name(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		workspaceIds = append(workspaceIds, workspaceId)
+	}
+	return workspaceIds, nil
+}
+
 func (s *LocalOpLocStore) DeleteProject(ownerId string, projectId uint64) error {
-	return os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace", ownerId, projectId))
+	return os.RemoveAll(fmt.Sprintf("%s/%s/%d/oplocstoreworkspace", s.root, ownerId, projectId))
 }
 
 func (s *LocalOpLocStore) DeleteWorkspace(ownerId string, projectId uint64, workspaceId uint64) error {
-	dirs, err := ioutil.ReadDir(fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d", ownerId, projectId, workspaceId))
+	dirs, err := ioutil.ReadDir(fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d", s.root, ownerId, projectId, workspaceId))
 	if err != nil {
 		return err
 	}
 
 	for _, dir := range dirs {
-		err := os.RemoveAll(fmt.Sprintf("jamhubdata/%s/%d/oplocstoreworkspace/%d/%s", ownerId, projectId, workspaceId, dir.Name()))
+		err := os.RemoveAll(fmt.Sprintf("%s/%s/%d/oplocstoreworkspace/%d/%s", s.root, ownerId, projectId, workspaceId, dir.Name()))
 		if err != nil {
 			return err
 		}
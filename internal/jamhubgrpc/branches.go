@@ -1,16 +1,16 @@
 package jamhubgrpc
 
 import (
-	"bytes"
 	"context"
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"os"
 
 	"github.com/zdgeier/jamhub/gen/pb"
 	"github.com/zdgeier/jamhub/internal/fastcdc"
+	"github.com/zdgeier/jamhub/internal/jamhub/changestore"
+	"github.com/zdgeier/jamhub/internal/jamhub/chunkstore"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -21,13 +21,26 @@ func (s JamHub) CreateWorkspace(ctx context.Context, in *pb.CreateWorkspaceReque
 	if err != nil {
 		return nil, err
 	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleWriter)
+	if err != nil {
+		return nil, err
+	}
 
-	maxCommitId, err := s.oplocstorecommit.MaxCommitId(userId, in.GetProjectId())
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	maxCommitId, err := s.oplocstorecommit.MaxCommitId(ownerId, in.GetProjectId())
+	noCommits := errors.Is(err, os.ErrNotExist)
+	if err != nil && !noCommits {
 		return nil, err
 	}
 
-	workspaceId, err := s.changestore.AddWorkspace(userId, in.GetProjectId(), in.GetWorkspaceName(), maxCommitId)
+	baseCommitId := maxCommitId
+	if in.GetUseBaseCommitId() {
+		if noCommits || in.GetBaseCommitId() > maxCommitId {
+			return nil, status.Errorf(codes.NotFound, "commit %d not found", in.GetBaseCommitId())
+		}
+		baseCommitId = in.GetBaseCommitId()
+	}
+
+	workspaceId, err := s.changestore.AddWorkspace(ownerId, in.GetProjectId(), in.GetWorkspaceName(), baseCommitId)
 	if err != nil {
 		return nil, err
 	}
@@ -38,12 +51,16 @@ func (s JamHub) CreateWorkspace(ctx context.Context, in *pb.CreateWorkspaceReque
 }
 
 func (s JamHub) GetWorkspaceName(ctx context.Context, in *pb.GetWorkspaceNameRequest) (*pb.GetWorkspaceNameResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
-	workspaceName, err := s.changestore.GetWorkspaceNameById(userId, in.GetProjectId(), in.GetWorkspaceId())
+	workspaceName, err := s.changestore.GetWorkspaceNameById(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil {
 		return nil, err
 	}
@@ -54,12 +71,16 @@ func (s JamHub) GetWorkspaceName(ctx context.Context, in *pb.GetWorkspaceNameReq
 }
 
 func (s JamHub) GetWorkspaceId(ctx context.Context, in *pb.GetWorkspaceIdRequest) (*pb.GetWorkspaceIdResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
-	workspaceId, err := s.changestore.GetWorkspaceIdByName(userId, in.GetProjectId(), in.GetWorkspaceName())
+	workspaceId, err := s.changestore.GetWorkspaceIdByName(ownerId, in.GetProjectId(), in.GetWorkspaceName())
 	if err != nil {
 		return nil, err
 	}
@@ -70,28 +91,273 @@ func (s JamHub) GetWorkspaceId(ctx context.Context, in *pb.GetWorkspaceIdRequest
 }
 
 func (s JamHub) GetWorkspaceCurrentChange(ctx context.Context, in *pb.GetWorkspaceCurrentChangeRequest) (*pb.GetWorkspaceCurrentChangeResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
-	changeId, err := s.oplocstoreworkspace.MaxChangeId(userId, in.GetProjectId(), in.GetWorkspaceId())
+	changeId, err := s.oplocstoreworkspace.MaxChangeId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	baseCommitId, err := s.changestore.GetWorkspaceBaseCommitId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil {
 		return nil, err
 	}
 
 	return &pb.GetWorkspaceCurrentChangeResponse{
-		ChangeId: changeId,
+		ChangeId:     changeId,
+		BaseCommitId: baseCommitId,
 	}, nil
 }
 
-func (s JamHub) ListWorkspaces(ctx context.Context, in *pb.ListWorkspacesRequest) (*pb.ListWorkspacesResponse, error) {
+func (s JamHub) UpdateWorkspaceBase(ctx context.Context, in *pb.UpdateWorkspaceBaseRequest) (*pb.UpdateWorkspaceBaseResponse, error) {
 	userId, err := serverauth.ParseIdFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	baseCommitId, err := s.changestore.GetWorkspaceBaseCommitId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	changeId, err := s.oplocstoreworkspace.MaxChangeId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId(ownerId, in.GetProjectId())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err != nil || baseCommitId >= headCommitId {
+		// Already up to date
+		return &pb.UpdateWorkspaceBaseResponse{
+			BaseCommitId: baseCommitId,
+			ChangeId:     changeId,
+		}, nil
+	}
+
+	changedPathHashes, err := s.opdatastoreworkspace.GetChangedPathHashes(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(changedPathHashes) == 0 {
+		err = s.changestore.UpdateWorkspaceBaseCommitId(ownerId, in.GetProjectId(), in.GetWorkspaceId(), headCommitId)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.UpdateWorkspaceBaseResponse{
+			BaseCommitId: headCommitId,
+			ChangeId:     changeId,
+		}, nil
+	}
+
+	merged, err := s.threeWayMerge(ownerId, in.GetProjectId(), in.GetWorkspaceId(), changeId, baseCommitId, headCommitId, changedPathHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every changed file is rewritten as a new change against the latest commit
+	// since the operations of earlier changes refer to the old base commit
+	pathHashes := make(map[string]bool, len(changedPathHashes))
+	for _, pathHash := range changedPathHashes {
+		pathHashes[string(pathHash)] = true
+	}
+	for pathHash := range merged.files {
+		pathHashes[pathHash] = true
+	}
+	for pathHash := range pathHashes {
+		reader, err := s.openMergedFile(ownerId, in.GetProjectId(), in.GetWorkspaceId(), changeId, headCommitId, merged, []byte(pathHash))
+		if err != nil {
+			return nil, err
+		}
+		err = s.writeRebasedWorkspaceFile(ownerId, in.GetProjectId(), in.GetWorkspaceId(), changeId+1, headCommitId, []byte(pathHash), reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Conflicts without conflict markers kept the workspace's version, so they
+	// are recorded before the base moves past the other side's change and the
+	// workspace cannot be merged until they are resolved
+	unresolved := make([]changestore.Conflict, 0)
+	for _, conflict := range merged.conflicts {
+		if _, found := merged.files[string(pathToHash(conflict.GetPath()))]; !found {
+			conflict.Unresolved = true
+			unresolved = append(unresolved, changestore.Conflict{Path: conflict.GetPath(), Type: int32(conflict.GetType())})
+		}
+	}
+	err = s.changestore.AddConflicts(ownerId, in.GetProjectId(), in.GetWorkspaceId(), unresolved)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.changestore.UpdateWorkspaceBaseCommitId(ownerId, in.GetProjectId(), in.GetWorkspaceId(), headCommitId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateWorkspaceBaseResponse{
+		BaseCommitId: headCommitId,
+		ChangeId:     changeId + 1,
+		Conflicts:    merged.conflicts,
+	}, nil
+}
+
+func (s JamHub) ResolveConflicts(ctx context.Context, in *pb.ResolveConflictsRequest) (*pb.ResolveConflictsResponse, error) {
+	userId, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.changestore.ResolveConflicts(ownerId, in.GetProjectId(), in.GetWorkspaceId(), in.GetPaths())
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := s.unresolvedConflicts(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ResolveConflictsResponse{Conflicts: conflicts}, nil
+}
+
+// unresolvedConflicts lists the conflicts recorded by UpdateWorkspaceBase that
+// have not been resolved yet.
+func (s JamHub) unresolvedConflicts(ownerId string, projectId, workspaceId uint64) ([]*pb.MergeConflict, error) {
+	conflicts, err := s.changestore.ListConflicts(ownerId, projectId, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*pb.MergeConflict, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		result = append(result, &pb.MergeConflict{
+			Path:       conflict.Path,
+			Type:       pb.MergeConflict_Type(conflict.Type),
+			Unresolved: true,
+		})
+	}
+	return result, nil
+}
+
+// writeRebasedWorkspaceFile stores the contents of source as a workspace file at
+// changeId, reusing chunks of the file as of commitId wherever possible.
+func (s JamHub) writeRebasedWorkspaceFile(ownerId string, projectId, workspaceId, changeId, commitId uint64, pathHash []byte, source io.Reader) error {
+	committedReader, err := s.regenCommittedFile(ownerId, projectId, commitId, pathHash)
+	if err != nil {
+		return err
+	}
+	defer committedReader.Close()
+	committedChunker, err := fastcdc.NewChunker(committedReader, fastcdc.Options{
+		AverageSize: 1024 * 64,
+		Seed:        84372,
+	})
+	if err != nil {
+		return err
+	}
+	sig := make([]*pb.ChunkHash, 0)
+	err = committedChunker.CreateSignature(func(ch *pb.ChunkHash) error {
+		sig = append(sig, ch)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var commitOpLocs *pb.CommitOperationLocations
+	for i := int(commitId); i >= 0 && commitOpLocs == nil; i-- {
+		commitOpLocs, err = s.oplocstorecommit.ListOperationLocations(ownerId, projectId, uint64(i), pathHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	sourceChunker, err := fastcdc.NewChunker(source, fastcdc.Options{
+		AverageSize: 1024 * 64,
+		Seed:        84372,
+	})
+	if err != nil {
+		return err
+	}
+
+	refs := s.opdatastoreworkspace.NewRefs(ownerId, projectId, workspaceId)
+	defer refs.Commit()
+	opLocs := make([]*pb.WorkspaceOperationLocations_OperationLocation, 0)
+	err = sourceChunker.CreateDelta(sig, func(op *pb.Operation) error {
+		if op.GetType() == pb.Operation_OpData {
+			offset, length, err := s.opdatastoreworkspace.Write(ownerId, projectId, workspaceId, pathHash, op, refs)
+			if err != nil {
+				return err
+			}
+			opLocs = append(opLocs, &pb.WorkspaceOperationLocations_OperationLocation{
+				Offset: offset,
+				Length: length,
+				ChunkHash: &pb.ChunkHash{
+					Offset: op.GetChunk().GetOffset(),
+					Length: op.GetChunk().GetLength(),
+					Hash:   op.GetChunk().GetHash(),
+				},
+			})
+			return nil
+		}
+
+		for _, loc := range commitOpLocs.GetOpLocs() {
+			if loc.GetChunkHash().GetHash() == op.GetChunkHash().GetHash() {
+				opLocs = append(opLocs, &pb.WorkspaceOperationLocations_OperationLocation{
+					CommitOffset: loc.GetOffset(),
+					CommitLength: loc.GetLength(),
+					ChunkHash: &pb.ChunkHash{
+						Offset: op.GetChunkHash().GetOffset(),
+						Length: op.GetChunkHash().GetLength(),
+						Hash:   op.GetChunkHash().GetHash(),
+					},
+				})
+				return nil
+			}
+		}
+		return status.Errorf(codes.Internal, "operation of type block but hash could not be found in commit %d", commitId)
+	})
+	if err != nil {
+		return err
+	}
+	err = refs.Commit()
+	if err != nil {
+		return err
+	}
+
+	return s.oplocstoreworkspace.InsertOperationLocations(&pb.WorkspaceOperationLocations{
+		ProjectId:   projectId,
+		OwnerId:     ownerId,
+		WorkspaceId: workspaceId,
+		ChangeId:    changeId,
+		PathHash:    pathHash,
+		OpLocs:      opLocs,
+	})
+}
+
+func (s JamHub) ListWorkspaces(ctx context.Context, in *pb.ListWorkspacesRequest) (*pb.ListWorkspacesResponse, error) {
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return nil, err
+	}
 
-	workspaces, err := s.changestore.ListWorkspaces(userId, in.GetProjectId())
+	workspaces, err := s.changestore.ListWorkspaces(ownerId, in.GetProjectId())
 	if err != nil {
 		return nil, err
 	}
@@ -108,8 +374,15 @@ func (s JamHub) WriteWorkspaceOperationsStream(srv pb.JamHub_WriteWorkspaceOpera
 	}
 
 	var projectOwner string
-	var projectId, workspaceId, changeId, operationProject uint64
+	var projectId, workspaceId, changeId, operationProject, operationWorkspace, operationChange uint64
 	pathHashToOpLocs := make(map[string][]*pb.WorkspaceOperationLocations_OperationLocation, 0)
+	pathHashToBlocks := make(map[string]blockLocations)
+	var refs *chunkstore.Refs
+	defer func() {
+		if refs != nil {
+			refs.Commit()
+		}
+	}()
 	for {
 		in, err := srv.Recv()
 		if err == io.EOF {
@@ -123,27 +396,33 @@ func (s JamHub) WriteWorkspaceOperationsStream(srv pb.JamHub_WriteWorkspaceOpera
 		workspaceId = in.GetWorkspaceId()
 		changeId = in.GetChangeId()
 		if operationProject == 0 {
-			owner, err := s.db.GetProjectOwner(projectId)
+			owner, err := s.authorize(srv.Context(), userId, projectId, db.RoleWriter)
 			if err != nil {
 				return err
 			}
-			if userId != owner {
-				return status.Errorf(codes.Unauthenticated, "unauthorized")
-			}
 			projectOwner = owner
 			operationProject = projectId
+			refs = s.opdatastoreworkspace.NewRefs(projectOwner, projectId, workspaceId)
 		}
 
 		if operationProject != projectId {
 			return status.Errorf(codes.Unauthenticated, "unauthorized")
 		}
+		// Every operation is stored under the last change so a stream only
+		// writes to one
+		if operationWorkspace == 0 {
+			operationWorkspace, operationChange = workspaceId, changeId
+		}
+		if operationWorkspace != workspaceId || operationChange != changeId {
+			return status.Errorf(codes.InvalidArgument, "operations of a stream must be for a single workspace change")
+		}
 
 		pathHash := in.GetPathHash()
 
 		var chunkHash *pb.ChunkHash
 		var workspaceOffset, workspaceLength, commitOffset, commitLength uint64
 		if in.GetOp().GetType() == pb.Operation_OpData {
-			workspaceOffset, workspaceLength, err = s.opdatastoreworkspace.Write(userId, projectId, workspaceId, pathHash, in.GetOp())
+			workspaceOffset, workspaceLength, err = s.opdatastoreworkspace.Write(projectOwner, projectId, workspaceId, pathHash, in.GetOp(), refs)
 			if err != nil {
 				return err
 			}
@@ -161,41 +440,24 @@ func (s JamHub) WriteWorkspaceOperationsStream(srv pb.JamHub_WriteWorkspaceOpera
 		}
 
 		if in.GetOp().GetType() == pb.Operation_OpBlock {
-			opLocs, err := s.oplocstoreworkspace.ListOperationLocations(projectOwner, projectId, workspaceId, changeId-1, pathHash)
-			if err != nil {
-				return err
-			}
-			for _, loc := range opLocs.GetOpLocs() {
-				if loc.GetChunkHash().GetHash() == in.GetOp().GetChunkHash().GetHash() {
-					workspaceOffset = loc.GetOffset()
-					workspaceLength = loc.GetLength()
-					break
-				}
-			}
-
-			if workspaceOffset == 0 && workspaceLength == 0 {
-				commitId, err := s.changestore.GetWorkspaceBaseCommitId(projectOwner, projectId, workspaceId)
-				if err != nil {
-					return err
-				}
-
-				commitOpLocs, err := s.oplocstorecommit.ListOperationLocations(projectOwner, projectId, commitId, pathHash)
+			blocks, found := pathHashToBlocks[string(pathHash)]
+			if !found {
+				blocks, err = s.readBlockLocations(projectOwner, projectId, workspaceId, changeId, pathHash)
 				if err != nil {
 					return err
 				}
-				fmt.Println("HERE", commitOpLocs, projectOwner, projectId, commitId, pathHash)
-				for _, loc := range commitOpLocs.GetOpLocs() {
-					if loc.GetChunkHash().GetHash() == in.GetOp().GetChunkHash().GetHash() {
-						commitOffset = loc.GetOffset()
-						commitLength = loc.GetLength()
-						break
-					}
-				}
+				pathHashToBlocks[string(pathHash)] = blocks
+			}
 
-				if commitOffset == 0 && commitLength == 0 {
-					fmt.Println(projectOwner, projectId, commitId, pathHash, commitOffset, commitLength, commitOpLocs)
-					log.Panic("Operation of type block but hash could not be found in workspace or commit")
-				}
+			hash := in.GetOp().GetChunkHash().GetHash()
+			if loc, found := blocks.workspace[hash]; found {
+				workspaceOffset = loc.GetOffset()
+				workspaceLength = loc.GetLength()
+			} else if loc, found := blocks.commit[hash]; found {
+				commitOffset = loc.GetOffset()
+				commitLength = loc.GetLength()
+			} else {
+				return status.Errorf(codes.InvalidArgument, "operation of type block but hash could not be found in workspace or commit")
 			}
 		}
 
@@ -209,6 +471,13 @@ func (s JamHub) WriteWorkspaceOperationsStream(srv pb.JamHub_WriteWorkspaceOpera
 		pathHashToOpLocs[string(pathHash)] = append(pathHashToOpLocs[string(pathHash)], operationLocation)
 	}
 
+	if refs != nil {
+		err = refs.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
 	for pathHash, opLocs := range pathHashToOpLocs {
 		err = s.oplocstoreworkspace.InsertOperationLocations(&pb.WorkspaceOperationLocations{
 			ProjectId:   projectId,
@@ -226,19 +495,86 @@ func (s JamHub) WriteWorkspaceOperationsStream(srv pb.JamHub_WriteWorkspaceOpera
 	return srv.SendAndClose(&pb.WriteOperationStreamResponse{})
 }
 
-func (s JamHub) ReadWorkspaceChunkHashes(ctx context.Context, in *pb.ReadWorkspaceChunkHashesRequest) (*pb.ReadWorkspaceChunkHashesResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+// blockLocations maps the chunk hashes of the version of a file a change
+// builds on to where the chunk is stored, so block operations are resolved
+// without reading the file's history again. Chunks stored by the workspace
+// take precedence over those of its base commit.
+type blockLocations struct {
+	workspace map[uint64]*pb.WorkspaceOperationLocations_OperationLocation
+	commit    map[uint64]*pb.CommitOperationLocations_OperationLocation
+}
+
+func (s JamHub) readBlockLocations(ownerId string, projectId, workspaceId, changeId uint64, pathHash []byte) (blockLocations, error) {
+	blocks := blockLocations{
+		workspace: make(map[uint64]*pb.WorkspaceOperationLocations_OperationLocation),
+	}
+
+	var err error
+	var opLocs *pb.WorkspaceOperationLocations
+	for i := int(changeId) - 1; i >= 0 && opLocs == nil; i-- {
+		opLocs, err = s.oplocstoreworkspace.ListOperationLocations(ownerId, projectId, workspaceId, uint64(i), pathHash)
+		if err != nil {
+			return blockLocations{}, err
+		}
+	}
+	for _, loc := range opLocs.GetOpLocs() {
+		// Locations pointing into the commit are found below
+		if loc.GetLength() == 0 {
+			continue
+		}
+		if _, found := blocks.workspace[loc.GetChunkHash().GetHash()]; !found {
+			blocks.workspace[loc.GetChunkHash().GetHash()] = loc
+		}
+	}
+
+	commitId, err := s.changestore.GetWorkspaceBaseCommitId(ownerId, projectId, workspaceId)
 	if err != nil {
-		if in.GetProjectId() != 1 {
+		return blockLocations{}, err
+	}
+	blocks.commit, err = s.readCommitBlockLocations(ownerId, projectId, commitId, pathHash)
+	if err != nil {
+		return blockLocations{}, err
+	}
+	return blocks, nil
+}
+
+// readCommitBlockLocations maps the chunk hashes of a file as of a commit to
+// where they are stored. The file may not have changed in that commit so the
+// commit it was last written in is used.
+func (s JamHub) readCommitBlockLocations(ownerId string, projectId, commitId uint64, pathHash []byte) (map[uint64]*pb.CommitOperationLocations_OperationLocation, error) {
+	var err error
+	var opLocs *pb.CommitOperationLocations
+	for i := int(commitId); i >= 0 && opLocs == nil; i-- {
+		opLocs, err = s.oplocstorecommit.ListOperationLocations(ownerId, projectId, uint64(i), pathHash)
+		if err != nil {
 			return nil, err
 		}
 	}
+	blocks := make(map[uint64]*pb.CommitOperationLocations_OperationLocation)
+	for _, loc := range opLocs.GetOpLocs() {
+		if _, found := blocks[loc.GetChunkHash().GetHash()]; !found {
+			blocks[loc.GetChunkHash().GetHash()] = loc
+		}
+	}
+	return blocks, nil
+}
 
-	targetBuffer, err := s.regenWorkspaceFile(userId, in.GetProjectId(), in.GetWorkspaceId(), in.GetChangeId(), in.GetPathHash())
+func (s JamHub) ReadWorkspaceChunkHashes(ctx context.Context, in *pb.ReadWorkspaceChunkHashesRequest) (*pb.ReadWorkspaceChunkHashesResponse, error) {
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
+	targetBuffer, err := s.regenWorkspaceFile(ownerId, in.GetProjectId(), in.GetWorkspaceId(), in.GetChangeId(), in.GetPathHash())
+	if err != nil {
+		return nil, err
+	}
+	defer targetBuffer.Close()
+
 	targetChunker, err := fastcdc.NewChunker(targetBuffer, fastcdc.Options{
 		AverageSize: 1024 * 64,
 		Seed:        84372,
@@ -256,82 +592,62 @@ func (s JamHub) ReadWorkspaceChunkHashes(ctx context.Context, in *pb.ReadWorkspa
 	}, err
 }
 
-func (s JamHub) regenWorkspaceFile(userId string, projectId, workspaceId, changeId uint64, pathHash []byte) (*bytes.Reader, error) {
-	commitId, err := s.changestore.GetWorkspaceBaseCommitId(userId, projectId, workspaceId)
-	if err != nil {
-		return nil, err
-	}
-
-	committedFileReader, err := s.regenCommittedFile(userId, projectId, commitId, pathHash)
+func (s JamHub) regenWorkspaceFile(ownerId string, projectId, workspaceId, changeId uint64, pathHash []byte) (io.ReadSeekCloser, error) {
+	commitId, err := s.changestore.GetWorkspaceBaseCommitId(ownerId, projectId, workspaceId)
 	if err != nil {
 		return nil, err
 	}
 
 	var operationLocations *pb.WorkspaceOperationLocations
 	for i := int(changeId); i >= 0 && operationLocations == nil; i-- {
-		operationLocations, err = s.oplocstoreworkspace.ListOperationLocations(userId, projectId, workspaceId, uint64(i), pathHash)
+		operationLocations, err = s.oplocstoreworkspace.ListOperationLocations(ownerId, projectId, workspaceId, uint64(i), pathHash)
 		if err != nil {
 			return nil, err
 		}
 	}
+
+	committedFileReader, err := s.regenCommittedFile(ownerId, projectId, commitId, pathHash)
+	if err != nil {
+		return nil, err
+	}
 	if operationLocations == nil {
 		return committedFileReader, nil
 	}
+	defer committedFileReader.Close()
 
-	ops := make(chan *pb.Operation)
-	go func() {
-		for _, loc := range operationLocations.GetOpLocs() {
-			if loc.GetCommitLength() != 0 {
-				op, err := s.opdatastorecommit.Read(userId, projectId, pathHash, loc.GetCommitOffset(), loc.GetCommitLength())
-				if err != nil {
-					log.Panic(err)
-				}
-				ops <- op
-			} else {
-				op, err := s.opdatastoreworkspace.Read(userId, projectId, workspaceId, pathHash, loc.GetOffset(), loc.GetLength())
-				if err != nil {
-					log.Panic(err)
-				}
-				ops <- op
-			}
+	locs := operationLocations.GetOpLocs()
+	return regenFromOps(committedFileReader, len(locs), func(i int) (*pb.Operation, error) {
+		if locs[i].GetCommitLength() != 0 {
+			return s.opdatastorecommit.Read(ownerId, projectId, pathHash, locs[i].GetCommitOffset(), locs[i].GetCommitLength())
 		}
-		close(ops)
-	}()
-	result := new(bytes.Buffer)
-	chunker, err := fastcdc.NewChunker(committedFileReader, fastcdc.Options{
-		AverageSize: 1024 * 64,
-		Seed:        84372,
+		return s.opdatastoreworkspace.Read(ownerId, projectId, workspaceId, pathHash, locs[i].GetOffset(), locs[i].GetLength())
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-	err = chunker.ApplyDelta(result, committedFileReader, ops)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return bytes.NewReader(result.Bytes()), nil
 }
 
 func (s JamHub) ReadWorkspaceFile(in *pb.ReadWorkspaceFileRequest, srv pb.JamHub_ReadWorkspaceFileServer) error {
-	userId, err := serverauth.ParseIdFromCtx(srv.Context())
+	userId, err := serverauth.ParseOptionalIdFromCtx(srv.Context())
+	if err != nil {
+		return err
+	}
+	ownerId, err := s.authorize(srv.Context(), userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return err
 	}
 
 	changeId := in.GetChangeId()
 	if changeId == 0 {
-		maxChangeId, err := s.oplocstoreworkspace.MaxChangeId(userId, in.GetProjectId(), in.GetWorkspaceId())
+		maxChangeId, err := s.oplocstoreworkspace.MaxChangeId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 		if err != nil {
 			return err
 		}
 		changeId = maxChangeId
 	}
 
-	sourceBuffer, err := s.regenWorkspaceFile(userId, in.GetProjectId(), in.GetWorkspaceId(), changeId, in.GetPathHash())
+	sourceBuffer, err := s.regenWorkspaceFile(ownerId, in.GetProjectId(), in.GetWorkspaceId(), changeId, in.GetPathHash())
 	if err != nil {
 		return err
 	}
+	defer sourceBuffer.Close()
 
 	sourceChunker, err := fastcdc.NewChunker(sourceBuffer, fastcdc.Options{
 		AverageSize: 1024 * 64,
@@ -341,31 +657,7 @@ func (s JamHub) ReadWorkspaceFile(in *pb.ReadWorkspaceFileRequest, srv pb.JamHub
 		return err
 	}
 
-	opsOut := make(chan *pb.Operation)
-	tot := 0
-	go func() {
-		var blockCt, dataCt, bytes int
-		defer close(opsOut)
-		err := sourceChunker.CreateDelta(in.GetChunkHashes(), func(op *pb.Operation) error {
-			tot += int(op.Chunk.GetLength()) + int(op.ChunkHash.GetLength())
-			switch op.Type {
-			case pb.Operation_OpBlock:
-				blockCt++
-			case pb.Operation_OpData:
-				b := make([]byte, len(op.Chunk.Data))
-				copy(b, op.Chunk.Data)
-				op.Chunk.Data = b
-				dataCt++
-				bytes += len(op.Chunk.Data)
-			}
-			opsOut <- op
-			return nil
-		})
-		if err != nil {
-			panic(err)
-		}
-	}()
-
+	opsOut, deltaErr := streamDelta(srv.Context(), sourceChunker, in.GetChunkHashes())
 	for op := range opsOut {
 		err = srv.Send(&pb.WorkspaceFileOperation{
 			WorkspaceId: in.WorkspaceId,
@@ -377,7 +669,7 @@ func (s JamHub) ReadWorkspaceFile(in *pb.ReadWorkspaceFileRequest, srv pb.JamHub
 			return err
 		}
 	}
-	return nil
+	return <-deltaErr
 }
 
 func (s JamHub) DeleteWorkspace(ctx context.Context, in *pb.DeleteWorkspaceRequest) (*pb.DeleteWorkspaceResponse, error) {
@@ -385,18 +677,22 @@ func (s JamHub) DeleteWorkspace(ctx context.Context, in *pb.DeleteWorkspaceReque
 	if err != nil {
 		return nil, err
 	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleWriter)
+	if err != nil {
+		return nil, err
+	}
 
-	err = s.opdatastoreworkspace.DeleteWorkspace(userId, in.GetProjectId(), in.GetWorkspaceId())
+	err = s.opdatastoreworkspace.DeleteWorkspace(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
 
-	err = s.oplocstoreworkspace.DeleteWorkspace(userId, in.GetProjectId(), in.GetWorkspaceId())
+	err = s.oplocstoreworkspace.DeleteWorkspace(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
 
-	err = s.changestore.DeleteWorkspace(userId, in.GetProjectId(), in.GetWorkspaceId())
+	err = s.changestore.DeleteWorkspace(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil {
 		return nil, err
 	}
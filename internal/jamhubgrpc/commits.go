@@ -3,22 +3,35 @@ package jamhubgrpc
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"errors"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"github.com/zdgeier/jamhub/gen/pb"
 	"github.com/zdgeier/jamhub/internal/fastcdc"
+	"github.com/zdgeier/jamhub/internal/jamhub/changestore"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func (s JamHub) GetProjectCurrentCommit(ctx context.Context, in *pb.GetProjectCurrentCommitRequest) (*pb.GetProjectCurrentCommitResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
-	commitId, err := s.oplocstorecommit.MaxCommitId(userId, in.ProjectId)
+	commitId, err := s.oplocstorecommit.MaxCommitId(ownerId, in.ProjectId)
 	if err != nil {
 		return nil, err
 	}
@@ -29,17 +42,20 @@ func (s JamHub) GetProjectCurrentCommit(ctx context.Context, in *pb.GetProjectCu
 }
 
 func (s JamHub) ReadCommitChunkHashes(ctx context.Context, in *pb.ReadCommitChunkHashesRequest) (*pb.ReadCommitChunkHashesResponse, error) {
-	userId, err := serverauth.ParseIdFromCtx(ctx)
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
 	if err != nil {
-		if in.GetProjectId() != 1 {
-			return nil, err
-		}
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return nil, err
 	}
 
-	targetBuffer, err := s.regenCommittedFile(userId, in.GetProjectId(), in.GetCommitId(), in.GetPathHash())
+	targetBuffer, err := s.regenCommittedFile(ownerId, in.GetProjectId(), in.GetCommitId(), in.GetPathHash())
 	if err != nil {
 		return nil, err
 	}
+	defer targetBuffer.Close()
 
 	targetChunker, err := fastcdc.NewChunker(targetBuffer, fastcdc.Options{
 		AverageSize: 1024 * 64,
@@ -58,67 +74,124 @@ func (s JamHub) ReadCommitChunkHashes(ctx context.Context, in *pb.ReadCommitChun
 	}, err
 }
 
-func (s JamHub) regenCommittedFile(userId string, projectId uint64, commitId uint64, pathHash []byte) (*bytes.Reader, error) {
+// regenFile holds a regenerated file on disk so that files larger than memory
+// can be served. The file is removed when closed.
+type regenFile struct {
+	*os.File
+}
+
+func newRegenFile() (*regenFile, error) {
+	f, err := os.CreateTemp("", "jamhub-regen-*")
+	if err != nil {
+		return nil, err
+	}
+	return &regenFile{f}, nil
+}
+
+func (f *regenFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// nopReadSeekCloser is used for files that are already held in memory.
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
+
+func (s JamHub) regenCommittedFile(ownerId string, projectId uint64, commitId uint64, pathHash []byte) (io.ReadSeekCloser, error) {
 	var err error
 	var operationLocations *pb.CommitOperationLocations
 	for i := int(commitId); i >= 0 && operationLocations == nil; i-- {
-		operationLocations, err = s.oplocstorecommit.ListOperationLocations(userId, projectId, uint64(i), pathHash)
+		operationLocations, err = s.oplocstorecommit.ListOperationLocations(ownerId, projectId, uint64(i), pathHash)
 		if err != nil {
 			return nil, err
 		}
 	}
 	if operationLocations == nil {
-		return bytes.NewReader([]byte{}), nil
+		return nopReadSeekCloser{bytes.NewReader([]byte{})}, nil
 	}
 
+	locs := operationLocations.GetOpLocs()
+	return regenFromOps(bytes.NewReader([]byte{}), len(locs), func(i int) (*pb.Operation, error) {
+		return s.opdatastorecommit.Read(ownerId, projectId, pathHash, locs[i].GetOffset(), locs[i].GetLength())
+	})
+}
+
+// regenFromOps applies numOps operations, read one at a time by readOp, on top
+// of base. Operations are read in the background while the file is written so
+// only one is held in memory. The regenerated file is removed if anything
+// fails.
+func regenFromOps(base io.ReadSeeker, numOps int, readOp func(i int) (*pb.Operation, error)) (io.ReadSeekCloser, error) {
 	ops := make(chan *pb.Operation)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
 	go func() {
-		for _, loc := range operationLocations.GetOpLocs() {
-			op, err := s.opdatastorecommit.Read(userId, projectId, pathHash, loc.GetOffset(), loc.GetLength())
+		defer close(ops)
+		for i := 0; i < numOps; i++ {
+			op, err := readOp(i)
 			if err != nil {
-				log.Panic(err)
+				readErr <- err
+				return
+			}
+			select {
+			case ops <- op:
+			case <-done:
+				readErr <- nil
+				return
 			}
-			ops <- op
 		}
-		close(ops)
+		readErr <- nil
 	}()
 
-	result := new(bytes.Buffer)
-	resultChunker, err := fastcdc.NewChunker(result, fastcdc.Options{
-		AverageSize: 1024 * 64,
-		Seed:        84372,
-	})
-	if err != nil {
-		log.Panic(err)
+	result, err := newRegenFile()
+	if err == nil {
+		var chunker *fastcdc.Chunker
+		chunker, err = fastcdc.NewChunker(base, fastcdc.Options{
+			AverageSize: 1024 * 64,
+			Seed:        84372,
+		})
+		if err == nil {
+			err = chunker.ApplyDelta(result, base, ops)
+		}
+	}
+	// Stop the reader if the delta ended early, its error explains a delta
+	// that ended because the operations stopped
+	close(done)
+	if opErr := <-readErr; err == nil {
+		err = opErr
+	}
+	if err == nil {
+		_, err = result.Seek(0, io.SeekStart)
 	}
-	targetBuffer := bytes.NewBuffer([]byte{})
-	err = resultChunker.ApplyDelta(result, bytes.NewReader(targetBuffer.Bytes()), ops)
 	if err != nil {
-		log.Panic(err)
+		if result != nil {
+			result.Close()
+		}
+		return nil, err
 	}
-
-	return bytes.NewReader(result.Bytes()), nil
+	return result, nil
 }
 
 func (s JamHub) ReadCommittedFile(in *pb.ReadCommittedFileRequest, srv pb.JamHub_ReadCommittedFileServer) error {
-	userId, err := serverauth.ParseIdFromCtx(srv.Context())
+	userId, err := serverauth.ParseOptionalIdFromCtx(srv.Context())
 	if err != nil {
 		return err
 	}
-
-	commitId := in.GetCommitId()
-	if commitId == 0 {
-		maxCommitId, err := s.oplocstorecommit.MaxCommitId(userId, in.GetProjectId())
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			return err
-		}
-		commitId = maxCommitId
+	ownerId, err := s.authorize(srv.Context(), userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return err
 	}
 
-	sourceBuffer, err := s.regenCommittedFile(userId, in.GetProjectId(), commitId, in.GetPathHash())
+	sourceBuffer, err := s.regenCommittedFile(ownerId, in.GetProjectId(), in.GetCommitId(), in.GetPathHash())
 	if err != nil {
 		return err
 	}
+	defer sourceBuffer.Close()
 
 	sourceChunker, err := fastcdc.NewChunker(sourceBuffer, fastcdc.Options{
 		AverageSize: 1024 * 64,
@@ -128,31 +201,7 @@ func (s JamHub) ReadCommittedFile(in *pb.ReadCommittedFileRequest, srv pb.JamHub
 		return err
 	}
 
-	opsOut := make(chan *pb.Operation)
-	tot := 0
-	go func() {
-		var blockCt, dataCt, bytes int
-		defer close(opsOut)
-		err := sourceChunker.CreateDelta(in.GetChunkHashes(), func(op *pb.Operation) error {
-			tot += int(op.Chunk.GetLength()) + int(op.ChunkHash.GetLength())
-			switch op.Type {
-			case pb.Operation_OpBlock:
-				blockCt++
-			case pb.Operation_OpData:
-				b := make([]byte, len(op.Chunk.Data))
-				copy(b, op.Chunk.Data)
-				op.Chunk.Data = b
-				dataCt++
-				bytes += len(op.Chunk.Data)
-			}
-			opsOut <- op
-			return nil
-		})
-		if err != nil {
-			panic(err)
-		}
-	}()
-
+	opsOut, deltaErr := streamDelta(srv.Context(), sourceChunker, in.GetChunkHashes())
 	for op := range opsOut {
 		err = srv.Send(&pb.CommittedFileOperation{
 			ProjectId: in.GetProjectId(),
@@ -163,27 +212,79 @@ func (s JamHub) ReadCommittedFile(in *pb.ReadCommittedFileRequest, srv pb.JamHub
 			return err
 		}
 	}
-	return nil
+	return <-deltaErr
+}
+
+// streamDelta creates the delta of the chunker's file against chunkHashes one
+// operation at a time so only a single chunk is held in memory. The operations
+// channel is closed once the delta is complete, after which the error channel
+// receives the result. The delta stops early if ctx is cancelled.
+func streamDelta(ctx context.Context, chunker *fastcdc.Chunker, chunkHashes []*pb.ChunkHash) (<-chan *pb.Operation, <-chan error) {
+	opsOut := make(chan *pb.Operation)
+	deltaErr := make(chan error, 1)
+	go func() {
+		defer close(opsOut)
+		deltaErr <- chunker.CreateDelta(chunkHashes, func(op *pb.Operation) error {
+			if op.Type == pb.Operation_OpData {
+				// Chunk data is only valid until the next chunk is read
+				b := make([]byte, len(op.Chunk.Data))
+				copy(b, op.Chunk.Data)
+				op.Chunk.Data = b
+			}
+			select {
+			case opsOut <- op:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return opsOut, deltaErr
 }
 
 func (s JamHub) MergeWorkspace(ctx context.Context, in *pb.MergeWorkspaceRequest) (*pb.MergeWorkspaceResponse, error) {
 	userId, err := serverauth.ParseIdFromCtx(ctx)
 	if err != nil {
-		if in.GetProjectId() != 1 {
-			return nil, err
-		}
+		return nil, err
 	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merges are serialized so each one builds on the head left by the last
+	unlock := s.mergeLocks.lock(ownerId, in.GetProjectId())
+	defer unlock()
 
 	isFirstCommit := false
-	prevCommitId, err := s.oplocstorecommit.MaxCommitId(userId, in.GetProjectId())
+	prevCommitId, err := s.oplocstorecommit.MaxCommitId(ownerId, in.GetProjectId())
 	if err != nil && errors.Is(err, os.ErrNotExist) {
 		isFirstCommit = true
 	} else if err != nil {
 		return nil, err
 	}
+	if in.ExpectedHeadCommitId != nil {
+		if isFirstCommit {
+			return nil, status.Errorf(codes.Aborted, "expected head commit %d but the project has no commits", in.GetExpectedHeadCommitId())
+		}
+		if prevCommitId != in.GetExpectedHeadCommitId() {
+			return nil, status.Errorf(codes.Aborted, "expected head commit %d but the head is commit %d", in.GetExpectedHeadCommitId(), prevCommitId)
+		}
+	}
+
+	unresolved, err := s.unresolvedConflicts(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	if len(unresolved) > 0 {
+		return &pb.MergeWorkspaceResponse{
+			CommitId:  prevCommitId,
+			Conflicts: unresolved,
+		}, nil
+	}
 
 	// Regen every file that has been changed in workspace
-	changedPathHashes, err := s.opdatastoreworkspace.GetChangedPathHashes(userId, in.GetProjectId(), in.GetWorkspaceId())
+	changedPathHashes, err := s.opdatastoreworkspace.GetChangedPathHashes(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
@@ -192,183 +293,396 @@ func (s JamHub) MergeWorkspace(ctx context.Context, in *pb.MergeWorkspaceRequest
 		return &pb.MergeWorkspaceResponse{CommitId: prevCommitId}, nil
 	}
 
-	maxChangeId, err := s.oplocstoreworkspace.MaxChangeId(userId, in.GetProjectId(), in.GetWorkspaceId())
+	maxChangeId, err := s.oplocstoreworkspace.MaxChangeId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
 	if err != nil {
 		return nil, err
 	}
 
-	pathHashes := make(chan []byte)
-	results := make(chan error)
+	// Other workspaces have been merged since this one was created so their
+	// changes need to be merged with this workspace's changes
+	baseCommitId, err := s.changestore.GetWorkspaceBaseCommitId(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
+	var merged *mergeResult
+	if !isFirstCommit && baseCommitId < prevCommitId {
+		merged, err = s.threeWayMerge(ownerId, in.GetProjectId(), in.GetWorkspaceId(), maxChangeId, baseCommitId, prevCommitId, changedPathHashes)
+		if err != nil {
+			return nil, err
+		}
+		if len(merged.conflicts) > 0 {
+			return &pb.MergeWorkspaceResponse{
+				CommitId:  prevCommitId,
+				Conflicts: merged.conflicts,
+			}, nil
+		}
+	}
 
-	makeDiff := func() {
-		for changedPathHash := range pathHashes {
-			sourceReader, err := s.regenWorkspaceFile(userId, in.GetProjectId(), in.GetWorkspaceId(), maxChangeId, changedPathHash)
-			if err != nil {
-				results <- err
-				return
-			}
+	commit := changestore.Commit{
+		CommitId:       prevCommitId + 1,
+		ParentCommitId: prevCommitId,
+		AuthorId:       userId,
+		Message:        in.GetMessage(),
+	}
+	if isFirstCommit {
+		commit.CommitId = 0
+		commit.ParentCommitId = 0
+	}
+	commit.WorkspaceName, err = s.changestore.GetWorkspaceNameById(ownerId, in.GetProjectId(), in.GetWorkspaceId())
+	if err != nil {
+		return nil, err
+	}
 
-			workspaceOperationLocations, err := s.ReadCommitChunkHashes(ctx, &pb.ReadCommitChunkHashesRequest{
-				ProjectId: in.GetProjectId(),
-				CommitId:  prevCommitId,
-				PathHash:  []byte(changedPathHash),
-			})
-			if err != nil {
+	// The commit is written in full before the head is moved to it, anything
+	// written for it by an earlier merge that failed is thrown away first
+	err = s.discardCommit(ownerId, in.GetProjectId(), commit.CommitId)
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeCommit(ctx, ownerId, in.GetProjectId(), in.GetWorkspaceId(), maxChangeId, prevCommitId, commit.CommitId, merged, changedPathHashes)
+	if err == nil {
+		err = s.opdatastorecommit.Sync(ownerId, in.GetProjectId(), changedPathHashes)
+	}
+	if err == nil {
+		err = s.changestore.AddCommit(ownerId, in.GetProjectId(), commit)
+	}
+	if err == nil {
+		err = s.oplocstorecommit.PublishCommit(ownerId, in.GetProjectId(), commit.CommitId)
+	}
+	if err != nil {
+		if discardErr := s.discardCommit(ownerId, in.GetProjectId(), commit.CommitId); discardErr != nil {
+			log.Println(discardErr)
+		}
+		return nil, err
+	}
+
+	return &pb.MergeWorkspaceResponse{
+		CommitId: commit.CommitId,
+	}, nil
+}
+
+// writeCommit writes the op locations of every file changed in a workspace
+// for a new commit. Files are written concurrently and the first error stops
+// the rest.
+func (s JamHub) writeCommit(ctx context.Context, ownerId string, projectId, workspaceId, changeId, prevCommitId, commitId uint64, merged *mergeResult, changedPathHashes [][]byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pathHashes := make(chan []byte)
+	results := make(chan error, len(changedPathHashes))
+	for i := 0; i < 64; i++ {
+		go func() {
+			for pathHash := range pathHashes {
+				err := s.writeCommitFile(ctx, ownerId, projectId, workspaceId, changeId, prevCommitId, commitId, merged, pathHash)
+				if err != nil {
+					cancel()
+				}
 				results <- err
-				return
 			}
+		}()
+	}
 
-			sourceChunker, err := fastcdc.NewChunker(sourceReader, fastcdc.Options{
-				AverageSize: 1024 * 64,
-				Seed:        84372,
-			})
+	go func() {
+		for _, pathHash := range changedPathHashes {
+			pathHashes <- pathHash
+		}
+		close(pathHashes)
+	}()
+
+	var err error
+	for range changedPathHashes {
+		if result := <-results; result != nil && err == nil {
+			err = result
+		}
+	}
+	return err
+}
+
+func (s JamHub) writeCommitFile(ctx context.Context, ownerId string, projectId, workspaceId, changeId, prevCommitId, commitId uint64, merged *mergeResult, pathHash []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	sourceReader, err := s.openMergedFile(ownerId, projectId, workspaceId, changeId, prevCommitId, merged, pathHash)
+	if err != nil {
+		return err
+	}
+	defer sourceReader.Close()
+
+	workspaceOperationLocations, err := s.ReadCommitChunkHashes(ctx, &pb.ReadCommitChunkHashesRequest{
+		ProjectId: projectId,
+		CommitId:  prevCommitId,
+		PathHash:  pathHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	sourceChunker, err := fastcdc.NewChunker(sourceReader, fastcdc.Options{
+		AverageSize: 1024 * 64,
+		Seed:        84372,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stops the delta if the file is not written in full
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opsOut, deltaErr := streamDelta(ctx, sourceChunker, workspaceOperationLocations.GetChunkHashes())
+
+	refs := s.opdatastorecommit.NewRefs(ownerId, projectId, commitId)
+	defer refs.Commit()
+	opLocs := make([]*pb.CommitOperationLocations_OperationLocation, 0)
+	// Read the first time a block of the previous commit is reused
+	var prevBlocks map[uint64]*pb.CommitOperationLocations_OperationLocation
+	for op := range opsOut {
+		var offset, length uint64
+		var chunkHash *pb.ChunkHash
+		if op.GetType() == pb.Operation_OpData {
+			offset, length, err = s.opdatastorecommit.Write(ownerId, projectId, pathHash, op, refs)
 			if err != nil {
-				results <- err
-				return
+				return err
+			}
+			chunkHash = &pb.ChunkHash{
+				Offset: op.GetChunk().GetOffset(),
+				Length: op.GetChunk().GetLength(),
+				Hash:   op.GetChunk().GetHash(),
+			}
+		} else {
+			chunkHash = &pb.ChunkHash{
+				Offset: op.GetChunkHash().GetOffset(),
+				Length: op.GetChunkHash().GetLength(),
+				Hash:   op.GetChunkHash().GetHash(),
 			}
 
-			opsOut := make(chan *pb.Operation)
-			go func() {
-				var blockCt, dataCt, bytes int
-				defer close(opsOut)
-				err := sourceChunker.CreateDelta(workspaceOperationLocations.GetChunkHashes(), func(op *pb.Operation) error {
-					switch op.Type {
-					case pb.Operation_OpBlock:
-						blockCt++
-					case pb.Operation_OpData:
-						b := make([]byte, len(op.Chunk.Data))
-						copy(b, op.Chunk.Data)
-						op.Chunk.Data = b
-						dataCt++
-						bytes += len(op.Chunk.Data)
-					}
-					opsOut <- op
-					return nil
-				})
+			if prevBlocks == nil {
+				prevBlocks, err = s.readCommitBlockLocations(ownerId, projectId, prevCommitId, pathHash)
 				if err != nil {
-					panic(err)
+					return err
 				}
-			}()
+			}
+			loc, found := prevBlocks[op.GetChunkHash().GetHash()]
+			if !found {
+				return status.Errorf(codes.Internal, "operation of type block but hash could not be found in commit %d", prevCommitId)
+			}
+			offset = loc.GetOffset()
+			length = loc.GetLength()
+		}
 
-			pathHashToOpLocs := make(map[string][]*pb.CommitOperationLocations_OperationLocation, 0)
-			for op := range opsOut {
-				offset, length, err := s.opdatastorecommit.Write(userId, in.GetProjectId(), []byte(changedPathHash), op)
-				if err != nil {
-					results <- err
-					return
-				}
+		opLocs = append(opLocs, &pb.CommitOperationLocations_OperationLocation{
+			Offset:    offset,
+			Length:    length,
+			ChunkHash: chunkHash,
+		})
+	}
+	err = <-deltaErr
+	if err != nil {
+		return err
+	}
+	err = refs.Commit()
+	if err != nil {
+		return err
+	}
+	if len(opLocs) == 0 {
+		return nil
+	}
 
-				var chunkHash *pb.ChunkHash
-				if op.GetType() == pb.Operation_OpData {
-					chunkHash = &pb.ChunkHash{
-						Offset: op.GetChunk().GetOffset(),
-						Length: op.GetChunk().GetLength(),
-						Hash:   op.GetChunk().GetHash(),
-					}
-				} else {
-					chunkHash = &pb.ChunkHash{
-						Offset: op.GetChunkHash().GetOffset(),
-						Length: op.GetChunkHash().GetLength(),
-						Hash:   op.GetChunkHash().GetHash(),
-					}
-				}
+	return s.oplocstorecommit.InsertOperationLocations(&pb.CommitOperationLocations{
+		ProjectId: projectId,
+		OwnerId:   ownerId,
+		CommitId:  commitId,
+		PathHash:  pathHash,
+		OpLocs:    opLocs,
+	})
+}
 
-				if op.GetType() == pb.Operation_OpBlock {
-					opLocs, err := s.oplocstorecommit.ListOperationLocations(userId, in.GetProjectId(), prevCommitId, []byte(changedPathHash))
-					if err != nil {
-						results <- err
-						return
-					}
-					found := false
-					var reusedOffset, reusedLength uint64
-					for _, loc := range opLocs.GetOpLocs() {
-						if loc.GetChunkHash().GetHash() == op.GetChunkHash().GetHash() {
-							found = true
-							reusedOffset = loc.GetOffset()
-							reusedLength = loc.GetLength()
-							break
-						}
-					}
-					if !found {
-						log.Fatal("Operation of type block but hash could not be found")
-					}
-					offset = reusedOffset
-					length = reusedLength
-				}
+// headsMarker is written to the data directory once every project has a
+// head. Projects without one after that never finished their first merge.
+const headsMarker = "heads"
+
+// recoverCommits throws away the commits left unpublished by a crash during a
+// merge. The first time it runs on a data directory, projects from before
+// commits were published have no head and their latest commit is published
+// instead as it was their head then.
+func (s JamHub) recoverCommits(dataDir string) error {
+	_, err := os.Stat(filepath.Join(dataDir, headsMarker))
+	legacy := errors.Is(err, os.ErrNotExist)
+	if err != nil && !legacy {
+		return err
+	}
 
-				operationLocation := &pb.CommitOperationLocations_OperationLocation{
-					Offset:    offset,
-					Length:    length,
-					ChunkHash: chunkHash,
-				}
-				pathHashToOpLocs[string(changedPathHash)] = append(pathHashToOpLocs[string(changedPathHash)], operationLocation)
-			}
+	projects, err := s.db.ListProjects()
+	if err != nil {
+		return err
+	}
+	for _, project := range projects {
+		commitIds, err := s.oplocstorecommit.ListCommitIds(project.Owner, project.Id)
+		if err != nil {
+			return err
+		}
+		if len(commitIds) == 0 {
+			continue
+		}
+		sort.Slice(commitIds, func(i, j int) bool { return commitIds[i] > commitIds[j] })
 
-			if isFirstCommit {
-				for pathHash, opLocs := range pathHashToOpLocs {
-					err = s.oplocstorecommit.InsertOperationLocations(&pb.CommitOperationLocations{
-						ProjectId: in.GetProjectId(),
-						OwnerId:   userId,
-						CommitId:  0,
-						PathHash:  []byte(pathHash),
-						OpLocs:    opLocs,
-					})
-					if err != nil {
-						results <- err
-						return
-					}
-				}
-			} else {
-				for pathHash, opLocs := range pathHashToOpLocs {
-					err = s.oplocstorecommit.InsertOperationLocations(&pb.CommitOperationLocations{
-						ProjectId: in.GetProjectId(),
-						OwnerId:   userId,
-						CommitId:  prevCommitId + 1,
-						PathHash:  []byte(pathHash),
-						OpLocs:    opLocs,
-					})
-					if err != nil {
-						results <- err
-						return
-					}
-				}
+		headCommitId, err := s.oplocstorecommit.MaxCommitId(project.Owner, project.Id)
+		noHead := errors.Is(err, os.ErrNotExist)
+		if err != nil && !noHead {
+			return err
+		}
+		if noHead && legacy {
+			headCommitId, err = s.legacyHeadCommitId(project.Owner, project.Id, commitIds)
+			if err != nil {
+				return err
+			}
+			err = s.oplocstorecommit.PublishCommit(project.Owner, project.Id, headCommitId)
+			if err != nil {
+				return err
+			}
+			noHead = false
+		}
 
+		// Without a head the project's first merge never finished
+		for _, commitId := range commitIds {
+			if !noHead && commitId <= headCommitId {
+				break
 			}
+			log.Printf("Discarding unpublished commit %d of project %d", commitId, project.Id)
+			err = s.discardCommit(project.Owner, project.Id, commitId)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-			results <- nil
+	if legacy {
+		return os.WriteFile(filepath.Join(dataDir, headsMarker), nil, 0644)
+	}
+	return nil
+}
+
+// legacyHeadCommitId finds the head of a project from before heads were
+// published. Merges record their commit once it is written, so the latest
+// recorded commit is the head. Commits from before they were recorded are
+// only on disk, then the latest of those is used.
+func (s JamHub) legacyHeadCommitId(ownerId string, projectId uint64, commitIds []uint64) (uint64, error) {
+	for _, commitId := range commitIds {
+		_, err := s.changestore.GetCommit(ownerId, projectId, commitId)
+		if err == nil {
+			return commitId, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
 		}
 	}
+	return commitIds[0], nil
+}
 
-	for i := 0; i < 64; i++ {
-		go makeDiff()
+// discardCommit removes a commit that was not published along with the
+// references to the chunks written for it.
+func (s JamHub) discardCommit(ownerId string, projectId, commitId uint64) error {
+	err := s.oplocstorecommit.DiscardCommit(ownerId, projectId, commitId)
+	if err != nil {
+		return err
+	}
+	err = s.opdatastorecommit.DiscardCommit(ownerId, projectId, commitId)
+	if err != nil {
+		return err
 	}
+	return s.changestore.DeleteCommit(ownerId, projectId, commitId)
+}
 
-	go func() {
-		for _, c := range changedPathHashes {
-			pathHashes <- c
+func (s JamHub) GetCommit(ctx context.Context, in *pb.GetCommitRequest) (*pb.GetCommitResponse, error) {
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := s.changestore.GetCommit(ownerId, in.GetProjectId(), in.GetCommitId())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "commit %d not found", in.GetCommitId())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetCommitResponse{
+		Commit: s.commitToPb(commit),
+	}, nil
+}
+
+const defaultCommitPageSize = 50
+
+func (s JamHub) ListCommits(ctx context.Context, in *pb.ListCommitsRequest) (*pb.ListCommitsResponse, error) {
+	userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := in.GetPageSize()
+	if pageSize == 0 {
+		pageSize = defaultCommitPageSize
+	}
+
+	commitsPb := make([]*pb.Commit, 0, pageSize)
+	beforeCommitId := in.GetBeforeCommitId()
+	for uint64(len(commitsPb)) < pageSize {
+		commits, err := s.changestore.ListCommits(ownerId, in.GetProjectId(), beforeCommitId, pageSize)
+		if err != nil {
+			return nil, err
 		}
-	}()
 
-	completed := 0
-	for e := range results {
-		if e != nil {
-			panic(e)
+		for _, commit := range commits {
+			if len(in.GetPathHash()) > 0 {
+				changed, err := s.oplocstorecommit.HasOperationLocations(ownerId, in.GetProjectId(), commit.CommitId, in.GetPathHash())
+				if err != nil {
+					return nil, err
+				}
+				if !changed {
+					continue
+				}
+			}
+			commitsPb = append(commitsPb, s.commitToPb(commit))
+			if uint64(len(commitsPb)) == pageSize {
+				break
+			}
 		}
-		completed += 1
 
-		if completed == len(changedPathHashes) {
-			close(pathHashes)
-			close(results)
+		// Commit 0 is the root commit so there is nothing left to page through
+		if uint64(len(commits)) < pageSize || commits[len(commits)-1].CommitId == 0 {
+			break
 		}
+		beforeCommitId = commits[len(commits)-1].CommitId
 	}
 
-	if isFirstCommit {
-		return &pb.MergeWorkspaceResponse{
-			CommitId: 0,
-		}, nil
-	} else {
-		return &pb.MergeWorkspaceResponse{
-			CommitId: prevCommitId + 1,
-		}, nil
+	return &pb.ListCommitsResponse{
+		Commits: commitsPb,
+	}, nil
+}
+
+func (s JamHub) commitToPb(commit changestore.Commit) *pb.Commit {
+	// Fall back to the raw id for authors that never set a username
+	username, err := s.db.Username(commit.AuthorId)
+	if err != nil {
+		username = commit.AuthorId
+	}
+
+	return &pb.Commit{
+		CommitId:       commit.CommitId,
+		ParentCommitId: commit.ParentCommitId,
+		WorkspaceName:  commit.WorkspaceName,
+		AuthorId:       commit.AuthorId,
+		AuthorUsername: username,
+		Message:        commit.Message,
+		Timestamp:      timestamppb.New(commit.Timestamp),
 	}
 }
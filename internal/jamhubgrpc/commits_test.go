@@ -0,0 +1,397 @@
+package jamhubgrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/changestore"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"github.com/zeebo/xxh3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeTestCommits writes the op locations of commits without publishing any.
+func writeTestCommits(t *testing.T, s JamHub, ownerId string, projectId uint64, commitIds ...uint64) {
+	for _, commitId := range commitIds {
+		err := s.oplocstorecommit.InsertOperationLocations(&pb.CommitOperationLocations{
+			OwnerId:   ownerId,
+			ProjectId: projectId,
+			CommitId:  commitId,
+			PathHash:  []byte{0x01},
+			OpLocs:    []*pb.CommitOperationLocations_OperationLocation{{Length: 1}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commitIds(t *testing.T, s JamHub, ownerId string, projectId uint64) []uint64 {
+	commitIds, err := s.oplocstorecommit.ListCommitIds(ownerId, projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(commitIds, func(i, j int) bool { return commitIds[i] < commitIds[j] })
+	return commitIds
+}
+
+func TestRecoverCommitsWithoutHead(t *testing.T) {
+	config := testConfig(t)
+	s := newJamHub(config)
+	projectId, err := s.db.AddProject("baseline", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Projects from before commits were published have neither a head nor
+	// any recorded commits
+	writeTestCommits(t, s, "owner", projectId, 0, 1, 2)
+
+	err = s.recoverCommits(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId("owner", projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headCommitId != 2 {
+		t.Fatalf("expected the latest commit 2 to be published, got %d", headCommitId)
+	}
+	if len(commitIds(t, s, "owner", projectId)) != 3 {
+		t.Fatal("expected every commit to be kept")
+	}
+}
+
+func TestRecoverCommitsWithoutHeadDiscardsUnrecorded(t *testing.T) {
+	config := testConfig(t)
+	s := newJamHub(config)
+	projectId, err := s.db.AddProject("recorded", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The merge of commit 2 was interrupted before it was recorded
+	writeTestCommits(t, s, "owner", projectId, 0, 1, 2)
+	for _, commitId := range []uint64{0, 1} {
+		err = s.changestore.AddCommit("owner", projectId, changestore.Commit{CommitId: commitId})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.recoverCommits(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId("owner", projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := commitIds(t, s, "owner", projectId)
+	if headCommitId != 1 || len(ids) != 2 {
+		t.Fatalf("expected commit 2 to be discarded, head %d and commits %v", headCommitId, ids)
+	}
+}
+
+func TestRecoverCommitsFirstMergeInterrupted(t *testing.T) {
+	config := testConfig(t)
+	s := newJamHub(config)
+	err := s.recoverCommits(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once every project has a head a project without one never finished
+	// its first merge
+	projectId, err := s.db.AddProject("new", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCommits(t, s, "owner", projectId, 0)
+	err = s.recoverCommits(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.oplocstorecommit.MaxCommitId("owner", projectId)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no head, got %v", err)
+	}
+	if len(commitIds(t, s, "owner", projectId)) != 0 {
+		t.Fatal("expected the interrupted commit to be discarded")
+	}
+}
+
+func TestRecoverCommitsDiscardsUnpublished(t *testing.T) {
+	config := testConfig(t)
+	s := newJamHub(config)
+	projectId, err := s.db.AddProject("project", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCommits(t, s, "owner", projectId, 0, 1)
+	err = s.oplocstorecommit.PublishCommit("owner", projectId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCommits(t, s, "owner", projectId, 2)
+
+	err = s.recoverCommits(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId("owner", projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := commitIds(t, s, "owner", projectId)
+	if headCommitId != 1 || len(ids) != 2 || ids[1] != 1 {
+		t.Fatalf("expected commit 2 to be discarded, head %d and commits %v", headCommitId, ids)
+	}
+}
+
+// testServer returns a JamHub whose handlers can be called directly, every
+// request is made as serverauth.TestUserId.
+func testServer(t *testing.T) JamHub {
+	serverauth.Configure(serverauth.Options{Disabled: true})
+	t.Cleanup(func() { serverauth.Configure(serverauth.Options{}) })
+	return newJamHub(testConfig(t))
+}
+
+func createTestWorkspace(t *testing.T, s JamHub, projectId uint64, name string) uint64 {
+	resp, err := s.CreateWorkspace(context.Background(), &pb.CreateWorkspaceRequest{ProjectId: projectId, WorkspaceName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.GetWorkspaceId()
+}
+
+// pushTestFiles writes files as a change to a workspace the way a push does,
+// along with a file list holding just those files.
+func pushTestFiles(t *testing.T, s JamHub, projectId, workspaceId, changeId uint64, files map[string][]byte) {
+	fileList := &pb.FileMetadata{Files: make(map[string]*pb.File)}
+	for path, data := range files {
+		hash := xxh3.Hash128(data).Bytes()
+		fileList.Files[path] = &pb.File{Hash: hash[:], Mode: 0644}
+	}
+	fileListData, err := proto.Marshal(fileList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files[fileListPath] = fileListData
+
+	refs := s.opdatastoreworkspace.NewRefs(serverauth.TestUserId, projectId, workspaceId)
+	for path, data := range files {
+		op := &pb.Operation{
+			Type:  pb.Operation_OpData,
+			Chunk: &pb.Chunk{Data: data, Length: uint64(len(data)), Hash: xxh3.Hash(data)},
+		}
+		offset, length, err := s.opdatastoreworkspace.Write(serverauth.TestUserId, projectId, workspaceId, pathToHash(path), op, refs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.oplocstoreworkspace.InsertOperationLocations(&pb.WorkspaceOperationLocations{
+			OwnerId:     serverauth.TestUserId,
+			ProjectId:   projectId,
+			WorkspaceId: workspaceId,
+			ChangeId:    changeId,
+			PathHash:    pathToHash(path),
+			OpLocs: []*pb.WorkspaceOperationLocations_OperationLocation{{
+				Offset:    offset,
+				Length:    length,
+				ChunkHash: &pb.ChunkHash{Length: uint64(len(data)), Hash: xxh3.Hash(data)},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = refs.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestCommittedFile(t *testing.T, s JamHub, projectId, commitId uint64, path string) []byte {
+	reader, err := s.regenCommittedFile(serverauth.TestUserId, projectId, commitId, pathToHash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMergeWorkspaceReusesBlocks(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+	project, err := s.AddProject(ctx, &pb.AddProjectRequest{ProjectName: "blocks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId := project.GetProjectId()
+
+	// Big enough to be split into many chunks
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	workspaceId := createTestWorkspace(t, s, projectId, "first")
+	pushTestFiles(t, s, projectId, workspaceId, 1, map[string][]byte{"file": data})
+	_, err = s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := bytes.Clone(data)
+	copy(changed[len(changed)/2:], "changed")
+	workspaceId = createTestWorkspace(t, s, projectId, "second")
+	pushTestFiles(t, s, projectId, workspaceId, 1, map[string][]byte{"file": changed})
+	merge, err := s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readTestCommittedFile(t, s, projectId, merge.GetCommitId(), "file"), changed) {
+		t.Fatal("unexpected contents after merging")
+	}
+	// Only the changed chunk is written again, the rest point at the chunks
+	// written by the first commit
+	firstOpLocs, err := s.oplocstorecommit.ListOperationLocations(serverauth.TestUserId, projectId, 0, pathToHash("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opLocs, err := s.oplocstorecommit.ListOperationLocations(serverauth.TestUserId, projectId, merge.GetCommitId(), pathToHash("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstOffsets := make(map[uint64]bool)
+	for _, loc := range firstOpLocs.GetOpLocs() {
+		firstOffsets[loc.GetOffset()] = true
+	}
+	reused := 0
+	for _, loc := range opLocs.GetOpLocs() {
+		if firstOffsets[loc.GetOffset()] {
+			reused++
+		}
+	}
+	if len(opLocs.GetOpLocs()) < 4 || reused < len(opLocs.GetOpLocs())-2 {
+		t.Fatalf("expected the unchanged chunks to be reused, %d of %d were", reused, len(opLocs.GetOpLocs()))
+	}
+}
+
+func TestMergeWorkspaceExpectedHead(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+	project, err := s.AddProject(ctx, &pb.AddProjectRequest{ProjectName: "expected"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId := project.GetProjectId()
+	workspaceId := createTestWorkspace(t, s, projectId, "init")
+	pushTestFiles(t, s, projectId, workspaceId, 1, map[string][]byte{"a": []byte("a")})
+	_, err = s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := createTestWorkspace(t, s, projectId, "first")
+	second := createTestWorkspace(t, s, projectId, "second")
+	pushTestFiles(t, s, projectId, first, 1, map[string][]byte{"a": []byte("a"), "b": []byte("b")})
+	pushTestFiles(t, s, projectId, second, 1, map[string][]byte{"a": []byte("a"), "c": []byte("c")})
+	baseCommitId := uint64(0)
+	_, err = s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: first, ExpectedHeadCommitId: &baseCommitId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second workspace was based on the commit the first one replaced
+	_, err = s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: second, ExpectedHeadCommitId: &baseCommitId})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("expected the merge to be aborted, got %v", err)
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId(serverauth.TestUserId, projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headCommitId != 1 {
+		t.Fatalf("expected the aborted merge to leave the head at 1, got %d", headCommitId)
+	}
+}
+
+func TestMergeWorkspaceConcurrent(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+	project, err := s.AddProject(ctx, &pb.AddProjectRequest{ProjectName: "concurrent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId := project.GetProjectId()
+	workspaceId := createTestWorkspace(t, s, projectId, "init")
+	pushTestFiles(t, s, projectId, workspaceId, 1, map[string][]byte{"init": []byte("init")})
+	_, err = s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every workspace adds its own file to the same base commit
+	const numWorkspaces = 8
+	workspaceIds := make([]uint64, numWorkspaces)
+	for i := range workspaceIds {
+		name := fmt.Sprintf("file%d", i)
+		workspaceIds[i] = createTestWorkspace(t, s, projectId, name)
+		pushTestFiles(t, s, projectId, workspaceIds[i], 1, map[string][]byte{"init": []byte("init"), name: []byte(name)})
+	}
+	commitIds := make([]uint64, numWorkspaces)
+	errs := make([]error, numWorkspaces)
+	var wg sync.WaitGroup
+	for i, workspaceId := range workspaceIds {
+		wg.Add(1)
+		go func(i int, workspaceId uint64) {
+			defer wg.Done()
+			resp, err := s.MergeWorkspace(ctx, &pb.MergeWorkspaceRequest{ProjectId: projectId, WorkspaceId: workspaceId})
+			commitIds[i], errs[i] = resp.GetCommitId(), err
+		}(i, workspaceId)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for i := range workspaceIds {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[commitIds[i]] {
+			t.Fatalf("commit %d was made by two merges", commitIds[i])
+		}
+		seen[commitIds[i]] = true
+	}
+	headCommitId, err := s.oplocstorecommit.MaxCommitId(serverauth.TestUserId, projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headCommitId != numWorkspaces {
+		t.Fatalf("expected the head to be commit %d, got %d", numWorkspaces, headCommitId)
+	}
+
+	// Each merge built on the last so the head has every file
+	fileList := &pb.FileMetadata{}
+	err = proto.Unmarshal(readTestCommittedFile(t, s, projectId, headCommitId, fileListPath), fileList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numWorkspaces; i++ {
+		if _, found := fileList.GetFiles()[fmt.Sprintf("file%d", i)]; !found {
+			t.Fatalf("expected file%d in the head commit", i)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+
+package jamhubgrpc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDataDir takes an exclusive lock on the data directory so the server and
+// garbage collection never use it at the same time. The lock is released by
+// the returned function or when the process exits.
+func lockDataDir(dataDir string) (func(), error) {
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(filepath.Join(dataDir, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lockFile.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("data directory %s is in use by another jamhub process", dataDir)
+		}
+		return nil, err
+	}
+	return func() { lockFile.Close() }, nil
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package jamhubgrpc
+
+// File locks are not available here so the data directory is not locked.
+func lockDataDir(dataDir string) (func(), error) {
+	return func() {}, nil
+}
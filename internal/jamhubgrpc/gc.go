@@ -0,0 +1,255 @@
+package jamhubgrpc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverconfig"
+)
+
+// GCStats reports what CollectGarbage removed.
+type GCStats struct {
+	Projects   int
+	Workspaces int
+	Bytes      uint64
+}
+
+// CollectGarbage removes the op data that no commit or live workspace refers
+// to in every project. The data files of a project are rewritten along with
+// the op locations pointing into them and swapped in together through a
+// journal, so a crash leaves each project either untouched or, once the
+// journal is recovered, fully compacted. The data directory is locked so the
+// server cannot run at the same time.
+func CollectGarbage(config serverconfig.Config) (*GCStats, error) {
+	unlock, err := lockDataDir(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	journal, err := gcjournal.Open(gcJournalDir(config.DataDir))
+	if err != nil {
+		return nil, err
+	}
+	s := newJamHub(config)
+	err = s.recoverCommits(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := s.db.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &GCStats{}
+	for _, project := range projects {
+		err = s.collectProjectGarbage(project.Owner, project.Id, journal, stats)
+		if err != nil {
+			return nil, fmt.Errorf("collecting garbage in project %s: %w", project.Name, err)
+		}
+		stats.Projects++
+	}
+	return stats, nil
+}
+
+// gcJournalDir is where garbage collection stages the files it rewrites.
+func gcJournalDir(dataDir string) string {
+	return filepath.Join(dataDir, "gc")
+}
+
+// liveOps holds the offsets and lengths of the operations still referred to
+// in a data store by path hash.
+type liveOps map[string]map[uint64]uint64
+
+func (l liveOps) mark(pathHash []byte, offset, length uint64) {
+	if l[string(pathHash)] == nil {
+		l[string(pathHash)] = make(map[uint64]uint64)
+	}
+	l[string(pathHash)][offset] = length
+}
+
+func (s JamHub) collectProjectGarbage(ownerId string, projectId uint64, journal *gcjournal.Journal, stats *GCStats) error {
+	workspaces, err := s.changestore.ListWorkspaces(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	workspaceIds := make([]uint64, 0, len(workspaces))
+	live := make(map[uint64]bool, len(workspaces))
+	for _, workspaceId := range workspaces {
+		workspaceIds = append(workspaceIds, workspaceId)
+		live[workspaceId] = true
+	}
+
+	err = s.removeDeletedWorkspaces(ownerId, projectId, live, journal, stats)
+	if err != nil {
+		return err
+	}
+
+	commitLive := make(liveOps)
+	workspaceLive := make(map[uint64]liveOps, len(workspaceIds))
+	for _, workspaceId := range workspaceIds {
+		workspaceLive[workspaceId] = make(liveOps)
+	}
+	err = s.visitOpLocs(ownerId, projectId, workspaceIds, func(opLocs *pb.CommitOperationLocations) error {
+		for _, loc := range opLocs.GetOpLocs() {
+			commitLive.mark(opLocs.GetPathHash(), loc.GetOffset(), loc.GetLength())
+		}
+		return nil
+	}, func(opLocs *pb.WorkspaceOperationLocations) error {
+		for _, loc := range opLocs.GetOpLocs() {
+			if loc.GetCommitLength() != 0 {
+				commitLive.mark(opLocs.GetPathHash(), loc.GetCommitOffset(), loc.GetCommitLength())
+			} else {
+				workspaceLive[opLocs.GetWorkspaceId()].mark(opLocs.GetPathHash(), loc.GetOffset(), loc.GetLength())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	commitMoved, reclaimed, err := s.opdatastorecommit.Compact(ownerId, projectId, commitLive, journal)
+	if err != nil {
+		return err
+	}
+	stats.Bytes += reclaimed
+	workspaceMoved := make(map[uint64]map[string]map[uint64]uint64, len(workspaceIds))
+	for _, workspaceId := range workspaceIds {
+		workspaceMoved[workspaceId], reclaimed, err = s.opdatastoreworkspace.Compact(ownerId, projectId, workspaceId, workspaceLive[workspaceId], journal)
+		if err != nil {
+			return err
+		}
+		stats.Bytes += reclaimed
+	}
+
+	// Point the op locations at where their operations were moved to
+	err = s.visitOpLocs(ownerId, projectId, workspaceIds, func(opLocs *pb.CommitOperationLocations) error {
+		moved := commitMoved[string(opLocs.GetPathHash())]
+		changed := false
+		for _, loc := range opLocs.GetOpLocs() {
+			if offset, found := moved[loc.GetOffset()]; found && offset != loc.GetOffset() {
+				loc.Offset = offset
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return s.oplocstorecommit.ReplaceOperationLocations(opLocs, journal)
+	}, func(opLocs *pb.WorkspaceOperationLocations) error {
+		moved := workspaceMoved[opLocs.GetWorkspaceId()][string(opLocs.GetPathHash())]
+		movedCommit := commitMoved[string(opLocs.GetPathHash())]
+		changed := false
+		for _, loc := range opLocs.GetOpLocs() {
+			if loc.GetCommitLength() != 0 {
+				if offset, found := movedCommit[loc.GetCommitOffset()]; found && offset != loc.GetCommitOffset() {
+					loc.CommitOffset = offset
+					changed = true
+				}
+			} else if offset, found := moved[loc.GetOffset()]; found && offset != loc.GetOffset() {
+				loc.Offset = offset
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return s.oplocstoreworkspace.ReplaceOperationLocations(opLocs, journal)
+	})
+	if err != nil {
+		return err
+	}
+	return journal.Commit()
+}
+
+// removeDeletedWorkspaces removes any data left behind by workspaces that are
+// not live anymore.
+func (s JamHub) removeDeletedWorkspaces(ownerId string, projectId uint64, live map[uint64]bool, journal *gcjournal.Journal, stats *GCStats) error {
+	dataIds, err := s.opdatastoreworkspace.ListWorkspaceIds(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+	locIds, err := s.oplocstoreworkspace.ListWorkspaceIds(ownerId, projectId)
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[uint64]bool)
+	for _, workspaceId := range append(dataIds, locIds...) {
+		if live[workspaceId] || deleted[workspaceId] {
+			continue
+		}
+		deleted[workspaceId] = true
+
+		_, reclaimed, err := s.opdatastoreworkspace.Compact(ownerId, projectId, workspaceId, nil, journal)
+		if err != nil {
+			return err
+		}
+		stats.Bytes += reclaimed
+		err = s.opdatastoreworkspace.DeleteWorkspace(ownerId, projectId, workspaceId)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		err = s.oplocstoreworkspace.DeleteWorkspace(ownerId, projectId, workspaceId)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		stats.Workspaces++
+	}
+	return nil
+}
+
+// visitOpLocs calls commitFn with the op locations of every file changed in
+// every commit of a project and workspaceFn with those of every change in the
+// given workspaces.
+func (s JamHub) visitOpLocs(ownerId string, projectId uint64, workspaceIds []uint64, commitFn func(*pb.CommitOperationLocations) error, workspaceFn func(*pb.WorkspaceOperationLocations) error) error {
+	maxCommitId, err := s.oplocstorecommit.MaxCommitId(ownerId, projectId)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for commitId := uint64(0); commitId <= maxCommitId; commitId++ {
+		pathHashes, err := s.oplocstorecommit.ListPathHashes(ownerId, projectId, commitId)
+		if err != nil {
+			return err
+		}
+		for _, pathHash := range pathHashes {
+			opLocs, err := s.oplocstorecommit.ListOperationLocations(ownerId, projectId, commitId, pathHash)
+			if err != nil {
+				return err
+			}
+			err = commitFn(opLocs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, workspaceId := range workspaceIds {
+		maxChangeId, err := s.oplocstoreworkspace.MaxChangeId(ownerId, projectId, workspaceId)
+		if err != nil {
+			return err
+		}
+		for changeId := uint64(0); changeId <= maxChangeId; changeId++ {
+			pathHashes, err := s.oplocstoreworkspace.ListPathHashes(ownerId, projectId, workspaceId, changeId)
+			if err != nil {
+				return err
+			}
+			for _, pathHash := range pathHashes {
+				opLocs, err := s.oplocstoreworkspace.ListOperationLocations(ownerId, projectId, workspaceId, changeId, pathHash)
+				if err != nil {
+					return err
+				}
+				err = workspaceFn(opLocs)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
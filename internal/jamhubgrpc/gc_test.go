@@ -0,0 +1,107 @@
+package jamhubgrpc
+
+import (
+	"io"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverconfig"
+)
+
+func testConfig(t *testing.T) serverconfig.Config {
+	config := serverconfig.Default()
+	config.DataDir = t.TempDir()
+	return config
+}
+
+func TestCollectProjectGarbage(t *testing.T) {
+	config := testConfig(t)
+	s := newJamHub(config)
+	ownerId, projectId, pathHash := "owner", uint64(1), []byte{0xAB, 0xCD}
+
+	// Only the first and last operation are still referred to by the commit
+	refs := s.opdatastorecommit.NewRefs(ownerId, projectId, 0)
+	opLocs := make([]*pb.CommitOperationLocations_OperationLocation, 0)
+	for i, data := range []string{"kept ", "dropped ", "also kept"} {
+		offset, length, err := s.opdatastorecommit.Write(ownerId, projectId, pathHash, &pb.Operation{
+			Type:  pb.Operation_OpData,
+			Chunk: &pb.Chunk{Data: []byte(data), Length: uint64(len(data)), Hash: uint64(i)},
+		}, refs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 1 {
+			opLocs = append(opLocs, &pb.CommitOperationLocations_OperationLocation{
+				Offset:    offset,
+				Length:    length,
+				ChunkHash: &pb.ChunkHash{Length: uint64(len(data)), Hash: uint64(i)},
+			})
+		}
+	}
+	err := refs.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.oplocstorecommit.InsertOperationLocations(&pb.CommitOperationLocations{
+		OwnerId:   ownerId,
+		ProjectId: projectId,
+		CommitId:  0,
+		PathHash:  pathHash,
+		OpLocs:    opLocs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.oplocstorecommit.PublishCommit(ownerId, projectId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := gcjournal.Open(gcJournalDir(config.DataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &GCStats{}
+	err = s.collectProjectGarbage(ownerId, projectId, journal, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bytes == 0 {
+		t.Fatal("expected the dropped operation to be reclaimed")
+	}
+
+	// A fresh server reads the compacted files instead of cached handles
+	s = newJamHub(config)
+	reader, err := s.regenCommittedFile(ownerId, projectId, 0, pathHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "kept also kept" {
+		t.Fatalf("unexpected file after compaction %q", data)
+	}
+}
+
+func TestCollectGarbageLocksDataDir(t *testing.T) {
+	config := testConfig(t)
+	unlock, err := lockDataDir(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CollectGarbage(config)
+	if err == nil {
+		t.Fatal("expected garbage collection to fail while the data directory is locked")
+	}
+
+	unlock()
+	_, err = CollectGarbage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,34 @@
+package jamhubgrpc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// projectLocks holds a mutex for each project so that operations moving a
+// project's head run one at a time.
+type projectLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newProjectLocks() *projectLocks {
+	return &projectLocks{
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+// lock locks a project and returns the function that unlocks it.
+func (l *projectLocks) lock(ownerId string, projectId uint64) func() {
+	key := fmt.Sprintf("%s/%d", ownerId, projectId)
+	l.mu.Lock()
+	projectLock, found := l.locks[key]
+	if !found {
+		projectLock = &sync.Mutex{}
+		l.locks[key] = projectLock
+	}
+	l.mu.Unlock()
+
+	projectLock.Lock()
+	return projectLock.Unlock
+}
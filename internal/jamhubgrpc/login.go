@@ -0,0 +1,100 @@
+package jamhubgrpc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// loginTokenTTL is how long a login with the built-in identity provider lasts.
+const loginTokenTTL = 30 * 24 * time.Hour
+
+// Usernames end up in URLs and user ids end up in store paths
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,38}$`)
+
+// builtinUserId is the id of a user registered with the built-in identity
+// provider, in the same provider|id form as Auth0 user ids.
+func builtinUserId(username string) string {
+	return "jamhub|" + username
+}
+
+func (s JamHub) GetAuthProvider(ctx context.Context, in *pb.GetAuthProviderRequest) (*pb.GetAuthProviderResponse, error) {
+	if s.issuer != nil {
+		return &pb.GetAuthProviderResponse{Provider: pb.GetAuthProviderResponse_Builtin}, nil
+	}
+	return &pb.GetAuthProviderResponse{Provider: pb.GetAuthProviderResponse_Auth0}, nil
+}
+
+func (s JamHub) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	if s.issuer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the server does not use the built-in identity provider")
+	}
+	if !usernamePattern.MatchString(in.GetUsername()) {
+		return nil, status.Errorf(codes.InvalidArgument, "usernames are up to 39 letters, digits, '.', '_' or '-'")
+	}
+	// bcrypt ignores anything after 72 bytes
+	if len(in.GetPassword()) < 8 || len(in.GetPassword()) > 72 {
+		return nil, status.Errorf(codes.InvalidArgument, "passwords must be 8 to 72 bytes long")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(in.GetPassword()), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	userId := builtinUserId(in.GetUsername())
+	err = s.db.CreatePasswordUser(in.GetUsername(), userId, hash)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		return nil, status.Errorf(codes.AlreadyExists, "%s is already taken", in.GetUsername())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.issuer.Sign(userId, loginTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RegisterResponse{Token: token}, nil
+}
+
+func (s JamHub) Login(ctx context.Context, in *pb.LoginRequest) (*pb.LoginResponse, error) {
+	if s.issuer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the server does not use the built-in identity provider")
+	}
+
+	// Unknown users and wrong passwords look the same so usernames cannot be
+	// probed
+	invalid := status.Errorf(codes.Unauthenticated, "invalid username or password")
+	userId, err := s.db.UserId(in.GetUsername())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash, err := s.db.GetPasswordHash(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(in.GetPassword()))
+	if err != nil {
+		return nil, invalid
+	}
+
+	token, err := s.issuer.Sign(userId, loginTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LoginResponse{Token: token}, nil
+}
@@ -0,0 +1,187 @@
+package jamhubgrpc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authorize checks that a user has at least minRole in a project and that the
+// request's access token, if any, has the scope for it. It returns the id of
+// the project's owner, which the project's data is stored under. Anyone can
+// read a public project, including anonymous users with an empty userId.
+func (s JamHub) authorize(ctx context.Context, userId string, projectId uint64, minRole db.Role) (string, error) {
+	ownerId, err := s.db.GetProjectOwner(projectId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", status.Errorf(codes.NotFound, "project %d not found", projectId)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	role := db.RoleNone
+	if userId != "" {
+		role, err = s.db.GetProjectRole(projectId, userId)
+		if err != nil {
+			return "", err
+		}
+	}
+	if role == db.RoleNone {
+		public, err := s.db.IsProjectPublic(projectId)
+		if err != nil {
+			return "", err
+		}
+		if public {
+			role = db.RoleReader
+		}
+	}
+	if role == db.RoleNone {
+		// Projects the user cannot see are reported the same as missing ones
+		return "", status.Errorf(codes.NotFound, "project %d not found", projectId)
+	}
+	if role < minRole {
+		if userId == "" {
+			return "", status.Errorf(codes.Unauthenticated, "sign in for %s access to project %d", roleName(minRole), projectId)
+		}
+		return "", status.Errorf(codes.PermissionDenied, "%s access to project %d is required", roleName(minRole), projectId)
+	}
+	if userId != "" {
+		err = requireScope(ctx, roleScope(minRole))
+		if err != nil {
+			return "", err
+		}
+	}
+	return ownerId, nil
+}
+
+func roleName(role db.Role) string {
+	return strings.ToLower(pb.ProjectMember_Role(role).String())
+}
+
+func (s JamHub) AddProjectMember(ctx context.Context, in *pb.AddProjectMemberRequest) (*pb.AddProjectMemberResponse, error) {
+	userId, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.authorize(ctx, userId, in.GetProjectId(), db.RoleMaintainer)
+	if err != nil {
+		return nil, err
+	}
+
+	role := db.Role(in.GetRole())
+	if role <= db.RoleNone || role > db.RoleOwner {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role %d", in.GetRole())
+	}
+	memberId, err := s.manageableMember(userId, in.GetProjectId(), in.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+	userRole, err := s.db.GetProjectRole(in.GetProjectId(), userId)
+	if err != nil {
+		return nil, err
+	}
+	if role > userRole {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot give a role above your own")
+	}
+
+	err = s.db.SetMember(in.GetProjectId(), memberId, role)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AddProjectMemberResponse{}, nil
+}
+
+func (s JamHub) RemoveProjectMember(ctx context.Context, in *pb.RemoveProjectMemberRequest) (*pb.RemoveProjectMemberResponse, error) {
+	userId, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.authorize(ctx, userId, in.GetProjectId(), db.RoleMaintainer)
+	if err != nil {
+		return nil, err
+	}
+
+	memberId, err := s.manageableMember(userId, in.GetProjectId(), in.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.RemoveMember(in.GetProjectId(), memberId)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RemoveProjectMemberResponse{}, nil
+}
+
+// manageableMember looks up the user id of a member that userId is allowed to
+// add, change or remove. The user that created a project always stays its
+// owner so it cannot be managed.
+func (s JamHub) manageableMember(userId string, projectId uint64, username string) (string, error) {
+	memberId, err := s.db.UserId(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", status.Errorf(codes.NotFound, "user %s not found", username)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ownerId, err := s.db.GetProjectOwner(projectId)
+	if err != nil {
+		return "", err
+	}
+	if memberId == ownerId {
+		return "", status.Errorf(codes.FailedPrecondition, "%s created the project and cannot be changed", username)
+	}
+
+	userRole, err := s.db.GetProjectRole(projectId, userId)
+	if err != nil {
+		return "", err
+	}
+	memberRole, err := s.db.GetProjectRole(projectId, memberId)
+	if err != nil {
+		return "", err
+	}
+	if memberRole > userRole {
+		return "", status.Errorf(codes.PermissionDenied, "cannot change a member with a role above your own")
+	}
+	return memberId, nil
+}
+
+func (s JamHub) ListProjectMembers(ctx context.Context, in *pb.ListProjectMembersRequest) (*pb.ListProjectMembersResponse, error) {
+	userId, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ownerId, err := s.authorize(ctx, userId, in.GetProjectId(), db.RoleReader)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.db.ListMembers(in.GetProjectId())
+	if err != nil {
+		return nil, err
+	}
+	members = append([]db.Member{{UserId: ownerId, Role: db.RoleOwner}}, members...)
+
+	membersPb := make([]*pb.ProjectMember, len(members))
+	for i, member := range members {
+		// Fall back to the raw id for users that never set a username
+		username, err := s.db.Username(member.UserId)
+		if err != nil {
+			username = member.UserId
+		}
+		membersPb[i] = &pb.ProjectMember{
+			Username: username,
+			UserId:   member.UserId,
+			Role:     pb.ProjectMember_Role(member.Role),
+		}
+	}
+	return &pb.ListProjectMembersResponse{Members: membersPb}, nil
+}
@@ -0,0 +1,280 @@
+package jamhubgrpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/linediff"
+	"github.com/zeebo/xxh3"
+	"google.golang.org/protobuf/proto"
+)
+
+const fileListPath = ".jamhubfilelist"
+
+func pathToHash(path string) []byte {
+	h := xxh3.Hash128([]byte(path)).Bytes()
+	return h[:]
+}
+
+// mergeResult is the outcome of merging a workspace with the latest commit.
+// Files changed in the workspace that are in neither files nor fromHead keep
+// the workspace's contents.
+type mergeResult struct {
+	// files holds contents that were merged line by line, keyed by path hash
+	files map[string][]byte
+	// fromHead holds the path hashes of files that take the latest commit's
+	// contents
+	fromHead  map[string]bool
+	conflicts []*pb.MergeConflict
+}
+
+// readMergeText reads a file for a line by line merge. Binary files are
+// detected from the start of the file and are not read any further since they
+// cannot be merged.
+func readMergeText(reader io.ReadSeekCloser, err error) ([]byte, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	prefix := make([]byte, 8000)
+	n, err := io.ReadFull(reader, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	if linediff.IsBinary(prefix[:n]) {
+		return nil, true, nil
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+	return append(prefix[:n], rest...), false, nil
+}
+
+// threeWayMerge merges the changes made in a workspace with the changes merged
+// into the project since the workspace's base commit. Files are compared by
+// the hashes in the file lists so only files changed on both sides are read.
+// Conflicting text files contain conflict markers and every other conflict
+// keeps the workspace's version.
+func (s JamHub) threeWayMerge(ownerId string, projectId, workspaceId, changeId, baseCommitId, headCommitId uint64, changedPathHashes [][]byte) (*mergeResult, error) {
+	readFileList := func(reader io.ReadSeekCloser, err error) (*pb.FileMetadata, error) {
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		fileMetadata := &pb.FileMetadata{}
+		err = proto.Unmarshal(data, fileMetadata)
+		return fileMetadata, err
+	}
+
+	fileListHash := pathToHash(fileListPath)
+	baseFiles, err := readFileList(s.regenCommittedFile(ownerId, projectId, baseCommitId, fileListHash))
+	if err != nil {
+		return nil, err
+	}
+	headFiles, err := readFileList(s.regenCommittedFile(ownerId, projectId, headCommitId, fileListHash))
+	if err != nil {
+		return nil, err
+	}
+	workspaceFiles, err := readFileList(s.regenWorkspaceFile(ownerId, projectId, workspaceId, changeId, fileListHash))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only path hashes are stored with the file data so map them back to paths
+	// using every file list involved
+	hashToPath := make(map[string]string)
+	for _, files := range []*pb.FileMetadata{baseFiles, headFiles, workspaceFiles} {
+		for path := range files.GetFiles() {
+			hashToPath[string(pathToHash(path))] = path
+		}
+	}
+
+	result := &mergeResult{
+		files:     make(map[string][]byte),
+		fromHead:  make(map[string]bool),
+		conflicts: make([]*pb.MergeConflict, 0),
+	}
+	conflicted := make(map[string]bool)
+	mergedHashes := make(map[string][]byte)
+	for _, pathHash := range changedPathHashes {
+		path, found := hashToPath[string(pathHash)]
+		if !found || path == fileListPath {
+			continue
+		}
+
+		// Deleted files are left for the file list merge below
+		baseFile := baseFiles.GetFiles()[path]
+		headFile := headFiles.GetFiles()[path]
+		workspaceFile := workspaceFiles.GetFiles()[path]
+		if headFile == nil || workspaceFile == nil {
+			continue
+		}
+
+		switch {
+		case baseFile != nil && bytes.Equal(baseFile.GetHash(), headFile.GetHash()):
+			continue
+		case bytes.Equal(headFile.GetHash(), workspaceFile.GetHash()), baseFile != nil && bytes.Equal(baseFile.GetHash(), workspaceFile.GetHash()):
+			result.fromHead[string(pathHash)] = true
+			continue
+		}
+
+		workspace, workspaceBinary, err := readMergeText(s.regenWorkspaceFile(ownerId, projectId, workspaceId, changeId, pathHash))
+		if err != nil {
+			return nil, err
+		}
+		head, headBinary, err := readMergeText(s.regenCommittedFile(ownerId, projectId, headCommitId, pathHash))
+		if err != nil {
+			return nil, err
+		}
+		var base []byte
+		var baseBinary bool
+		if baseFile != nil {
+			base, baseBinary, err = readMergeText(s.regenCommittedFile(ownerId, projectId, baseCommitId, pathHash))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if baseBinary || headBinary || workspaceBinary {
+			result.conflicts = append(result.conflicts, &pb.MergeConflict{Path: path, Type: pb.MergeConflict_Binary})
+			conflicted[path] = true
+			continue
+		}
+
+		lines, conflict := linediff.Merge3(linediff.Lines(base), linediff.Lines(workspace), linediff.Lines(head), "workspace", fmt.Sprintf("commit %d", headCommitId))
+		if conflict {
+			conflictType := pb.MergeConflict_Content
+			if baseFile == nil {
+				conflictType = pb.MergeConflict_AddAdd
+			}
+			result.conflicts = append(result.conflicts, &pb.MergeConflict{Path: path, Type: conflictType})
+			conflicted[path] = true
+		}
+		data := []byte(strings.Join(lines, ""))
+		result.files[string(pathHash)] = data
+		hash := xxh3.Hash128(data).Bytes()
+		mergedHashes[path] = hash[:]
+	}
+
+	mergedFiles, fileListConflicts := mergeFileLists(baseFiles, headFiles, workspaceFiles, mergedHashes)
+	for _, conflict := range fileListConflicts {
+		if !conflicted[conflict.GetPath()] {
+			result.conflicts = append(result.conflicts, conflict)
+		}
+	}
+	sort.Slice(result.conflicts, func(i, j int) bool {
+		return result.conflicts[i].GetPath() < result.conflicts[j].GetPath()
+	})
+
+	data, err := proto.Marshal(mergedFiles)
+	if err != nil {
+		return nil, err
+	}
+	result.files[string(fileListHash)] = data
+	return result, nil
+}
+
+// openMergedFile opens the merged contents of a file changed in a workspace.
+// Without a merge result the workspace's contents are used.
+func (s JamHub) openMergedFile(ownerId string, projectId, workspaceId, changeId, headCommitId uint64, merged *mergeResult, pathHash []byte) (io.ReadSeekCloser, error) {
+	if merged != nil {
+		if data, found := merged.files[string(pathHash)]; found {
+			return nopReadSeekCloser{bytes.NewReader(data)}, nil
+		}
+		if merged.fromHead[string(pathHash)] {
+			return s.regenCommittedFile(ownerId, projectId, headCommitId, pathHash)
+		}
+	}
+	return s.regenWorkspaceFile(ownerId, projectId, workspaceId, changeId, pathHash)
+}
+
+// mergeFileLists merges the file entries of the workspace and head file lists,
+// keeping the workspace's entry for any conflicting path. Modification times
+// are ignored when comparing entries since they change without the contents
+// changing. Files in mergedHashes were changed on both sides and have new
+// merged contents.
+func mergeFileLists(base, head, workspace *pb.FileMetadata, mergedHashes map[string][]byte) (*pb.FileMetadata, []*pb.MergeConflict) {
+	sameEntry := func(a, b *pb.File) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return sameContents(a, b) && a.GetMode() == b.GetMode()
+	}
+
+	paths := make(map[string]bool)
+	for _, files := range []*pb.FileMetadata{base, head, workspace} {
+		for path := range files.GetFiles() {
+			paths[path] = true
+		}
+	}
+
+	result := &pb.FileMetadata{Files: make(map[string]*pb.File)}
+	conflicts := make([]*pb.MergeConflict, 0)
+	for path := range paths {
+		baseFile := base.GetFiles()[path]
+		headFile := head.GetFiles()[path]
+		workspaceFile := workspace.GetFiles()[path]
+
+		file := workspaceFile
+		switch {
+		case sameEntry(baseFile, workspaceFile):
+			file = headFile
+		case sameEntry(baseFile, headFile), sameEntry(headFile, workspaceFile):
+		case baseFile == nil && mergedHashes[path] == nil:
+			conflicts = append(conflicts, &pb.MergeConflict{Path: path, Type: pb.MergeConflict_AddAdd})
+		case headFile == nil || workspaceFile == nil:
+			conflicts = append(conflicts, &pb.MergeConflict{Path: path, Type: pb.MergeConflict_ModifyDelete})
+		default:
+			var merged bool
+			file, merged = mergeEntry(baseFile, headFile, workspaceFile, mergedHashes[path])
+			if !merged {
+				conflicts = append(conflicts, &pb.MergeConflict{Path: path, Type: pb.MergeConflict_Content})
+			}
+		}
+		if file != nil {
+			result.Files[path] = file
+		}
+	}
+	return result, conflicts
+}
+
+// sameContents compares what file entries hold, not including their modes.
+func sameContents(a, b *pb.File) bool {
+	return a.GetDir() == b.GetDir() && bytes.Equal(a.GetHash(), b.GetHash()) && a.GetSymlinkTarget() == b.GetSymlinkTarget()
+}
+
+// mergeEntry merges the contents and the mode of a file changed on both sides
+// separately, so a mode changed on one side keeps the contents changed on the
+// other. The contents are taken from mergedHash if they were merged. If both
+// sides changed the contents or the mode differently the workspace's is kept
+// and false is returned.
+func mergeEntry(base, head, workspace *pb.File, mergedHash []byte) (*pb.File, bool) {
+	file := proto.Clone(workspace).(*pb.File)
+	ok := true
+	switch {
+	case mergedHash != nil:
+		file.Hash = mergedHash
+	case sameContents(base, workspace):
+		file.Dir, file.Hash, file.SymlinkTarget = head.GetDir(), head.GetHash(), head.GetSymlinkTarget()
+	case !sameContents(base, head) && !sameContents(head, workspace):
+		ok = false
+	}
+
+	switch {
+	case base.GetMode() == workspace.GetMode():
+		file.Mode = head.GetMode()
+	case base.GetMode() != head.GetMode() && head.GetMode() != workspace.GetMode():
+		ok = false
+	}
+	return file, ok
+}
@@ -0,0 +1,60 @@
+package jamhubgrpc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+)
+
+func TestMergeFileLists(t *testing.T) {
+	file := func(hash string, mode uint32) *pb.FileMetadata {
+		return &pb.FileMetadata{Files: map[string]*pb.File{"file": {Hash: []byte(hash), Mode: mode}}}
+	}
+	tests := []struct {
+		name      string
+		head      *pb.FileMetadata
+		workspace *pb.FileMetadata
+		merged    *pb.File
+		conflict  bool
+	}{
+		{
+			name:      "mode changed in the workspace, contents in the head",
+			head:      file("head", 0644),
+			workspace: file("base", 0755),
+			merged:    &pb.File{Hash: []byte("head"), Mode: 0755},
+		},
+		{
+			name:      "contents changed in the workspace, mode in the head",
+			head:      file("base", 0755),
+			workspace: file("workspace", 0644),
+			merged:    &pb.File{Hash: []byte("workspace"), Mode: 0755},
+		},
+		{
+			name:      "mode changed on both sides",
+			head:      file("head", 0600),
+			workspace: file("base", 0755),
+			merged:    &pb.File{Hash: []byte("head"), Mode: 0755},
+			conflict:  true,
+		},
+		{
+			name:      "contents changed on both sides",
+			head:      file("head", 0644),
+			workspace: file("workspace", 0755),
+			merged:    &pb.File{Hash: []byte("workspace"), Mode: 0755},
+			conflict:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, conflicts := mergeFileLists(file("base", 0644), test.head, test.workspace, nil)
+			if test.conflict != (len(conflicts) > 0) {
+				t.Fatalf("unexpected conflicts %v", conflicts)
+			}
+			got := merged.GetFiles()["file"]
+			if !bytes.Equal(got.GetHash(), test.merged.GetHash()) || got.GetMode() != test.merged.GetMode() {
+				t.Fatalf("expected %s %o, got %s %o", test.merged.GetHash(), test.merged.GetMode(), got.GetHash(), got.GetMode())
+			}
+		})
+	}
+}
@@ -2,18 +2,28 @@ package jamhubgrpc
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 
 	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (s JamHub) GetProjectName(ctx context.Context, in *pb.GetProjectNameRequest) (*pb.GetProjectNameResponse, error) {
-	id, err := serverauth.ParseIdFromCtx(ctx)
+	id, err := serverauth.ParseOptionalIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerId, err := s.authorize(ctx, id, in.GetProjectId(), db.RoleReader)
 	if err != nil {
 		return nil, err
 	}
 
-	projectName, err := s.db.GetProjectName(in.GetProjectId(), id)
+	projectName, err := s.db.GetProjectName(in.GetProjectId(), ownerId)
 	if err != nil {
 		return nil, err
 	}
@@ -24,7 +34,7 @@ func (s JamHub) GetProjectName(ctx context.Context, in *pb.GetProjectNameRequest
 }
 
 func (s JamHub) AddProject(ctx context.Context, in *pb.AddProjectRequest) (*pb.AddProjectResponse, error) {
-	id, err := serverauth.ParseIdFromCtx(ctx)
+	id, err := parseAccountIdFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +50,7 @@ func (s JamHub) AddProject(ctx context.Context, in *pb.AddProjectRequest) (*pb.A
 }
 
 func (s JamHub) ListUserProjects(ctx context.Context, in *pb.ListUserProjectsRequest) (*pb.ListUserProjectsResponse, error) {
-	id, err := serverauth.ParseIdFromCtx(ctx)
+	id, err := parseAccountIdFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -52,19 +62,48 @@ func (s JamHub) ListUserProjects(ctx context.Context, in *pb.ListUserProjectsReq
 
 	projectsPb := make([]*pb.ListUserProjectsResponse_Project, len(projects))
 	for i := range projectsPb {
-		projectsPb[i] = &pb.ListUserProjectsResponse_Project{Name: projects[i].Name, Id: projects[i].Id}
+		// Fall back to the raw id for owners that never set a username
+		ownerUsername, err := s.db.Username(projects[i].Owner)
+		if err != nil {
+			ownerUsername = projects[i].Owner
+		}
+		projectsPb[i] = &pb.ListUserProjectsResponse_Project{
+			Name:          projects[i].Name,
+			Id:            projects[i].Id,
+			Public:        projects[i].Public,
+			OwnerUsername: ownerUsername,
+		}
 	}
 
 	return &pb.ListUserProjectsResponse{Projects: projectsPb}, nil
 }
 
 func (s JamHub) GetProjectId(ctx context.Context, in *pb.GetProjectIdRequest) (*pb.GetProjectIdResponse, error) {
+	if in.GetOwnerUsername() != "" {
+		userId, err := serverauth.ParseOptionalIdFromCtx(ctx)
+		if err != nil {
+			return nil, err
+		}
+		projectId, err := s.db.GetProjectIdByOwnerUsername(in.GetProjectName(), in.GetOwnerUsername())
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Errorf(codes.NotFound, "project %s/%s not found", in.GetOwnerUsername(), in.GetProjectName())
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.authorize(ctx, userId, projectId, db.RoleReader)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.GetProjectIdResponse{ProjectId: projectId}, nil
+	}
+
 	userId, err := serverauth.ParseIdFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	projectId, err := s.db.GetProjectId(in.GetProjectName(), userId)
+	projectId, err := s.db.GetMemberProjectId(in.GetProjectName(), userId)
 	if err != nil {
 		return nil, err
 	}
@@ -78,35 +117,46 @@ func (s JamHub) DeleteProject(ctx context.Context, in *pb.DeleteProjectRequest)
 		return nil, err
 	}
 
-	projectName := in.GetProjectName()
-	if in.GetProjectId() != 0 {
-		projectName, err = s.db.GetProjectName(in.GetProjectId(), id)
+	projectId := in.GetProjectId()
+	if projectId == 0 {
+		projectId, err = s.db.GetMemberProjectId(in.GetProjectName(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Errorf(codes.NotFound, "project %s not found", in.GetProjectName())
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
+	ownerId, err := s.authorize(ctx, id, projectId, db.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	projectName, err := s.db.GetProjectName(projectId, ownerId)
+	if err != nil {
+		return nil, err
+	}
 
-	projectId, err := s.db.DeleteProject(projectName, id)
+	projectId, err = s.db.DeleteProject(projectName, ownerId)
 	if err != nil {
 		return nil, err
 	}
-	err = s.changestore.DeleteProject(projectId, id)
+	err = s.changestore.DeleteProject(projectId, ownerId)
 	if err != nil {
 		return nil, err
 	}
-	err = s.oplocstoreworkspace.DeleteProject(id, projectId)
+	err = s.oplocstoreworkspace.DeleteProject(ownerId, projectId)
 	if err != nil {
 		return nil, err
 	}
-	err = s.oplocstorecommit.DeleteProject(id, projectId)
+	err = s.oplocstorecommit.DeleteProject(ownerId, projectId)
 	if err != nil {
 		return nil, err
 	}
-	err = s.opdatastoreworkspace.DeleteProject(id, projectId)
+	err = s.opdatastoreworkspace.DeleteProject(ownerId, projectId)
 	if err != nil {
 		return nil, err
 	}
-	err = s.opdatastorecommit.DeleteProject(id, projectId)
+	err = s.opdatastorecommit.DeleteProject(ownerId, projectId)
 	if err != nil {
 		return nil, err
 	}
@@ -115,3 +165,20 @@ func (s JamHub) DeleteProject(ctx context.Context, in *pb.DeleteProjectRequest)
 		ProjectName: projectName,
 	}, nil
 }
+
+func (s JamHub) SetProjectVisibility(ctx context.Context, in *pb.SetProjectVisibilityRequest) (*pb.SetProjectVisibilityResponse, error) {
+	userId, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.authorize(ctx, userId, in.GetProjectId(), db.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.SetProjectPublic(in.GetProjectId(), in.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetProjectVisibilityResponse{}, nil
+}
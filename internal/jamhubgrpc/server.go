@@ -12,12 +12,15 @@ import (
 	"github.com/zdgeier/jamhub/gen/pb"
 	"github.com/zdgeier/jamhub/internal/jamenv"
 	"github.com/zdgeier/jamhub/internal/jamhub/changestore"
+	"github.com/zdgeier/jamhub/internal/jamhub/chunkstore"
 	"github.com/zdgeier/jamhub/internal/jamhub/db"
+	"github.com/zdgeier/jamhub/internal/jamhub/gcjournal"
 	"github.com/zdgeier/jamhub/internal/jamhub/opdatastorecommit"
 	"github.com/zdgeier/jamhub/internal/jamhub/opdatastoreworkspace"
 	"github.com/zdgeier/jamhub/internal/jamhub/oplocstorecommit"
 	"github.com/zdgeier/jamhub/internal/jamhub/oplocstoreworkspace"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverconfig"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -38,49 +41,97 @@ type JamHub struct {
 	oplocstoreworkspace  *oplocstoreworkspace.LocalOpLocStore
 	oplocstorecommit     *oplocstorecommit.LocalOpLocStore
 	changestore          changestore.LocalChangeStore
+	mergeLocks           *projectLocks
+	issuer               *serverauth.Issuer
 	pb.UnimplementedJamHubServer
 }
 
-func New() (closer func(), err error) {
-	jamhub := JamHub{
-		db:                   db.New(),
-		opdatastoreworkspace: opdatastoreworkspace.NewOpDataStoreWorkspace(),
-		opdatastorecommit:    opdatastorecommit.NewOpDataStoreCommit(),
-		oplocstoreworkspace:  oplocstoreworkspace.NewOpLocStoreWorkspace(),
-		oplocstorecommit:     oplocstorecommit.NewOpLocStoreCommit(),
-		changestore:          changestore.NewLocalChangeStore(),
+func newJamHub(config serverconfig.Config) JamHub {
+	chunks := chunkstore.NewChunkStore(config.DataDir)
+	return JamHub{
+		db:                   db.New(config.DataDir),
+		opdatastoreworkspace: opdatastoreworkspace.NewOpDataStoreWorkspace(config.DataDir, chunks),
+		opdatastorecommit:    opdatastorecommit.NewOpDataStoreCommit(config.DataDir, chunks),
+		oplocstoreworkspace:  oplocstoreworkspace.NewOpLocStoreWorkspace(config.DataDir),
+		oplocstorecommit:     oplocstorecommit.NewOpLocStoreCommit(config.DataDir),
+		changestore:          changestore.NewLocalChangeStore(config.DataDir),
+		mergeLocks:           newProjectLocks(),
 	}
+}
 
-	var cert tls.Certificate
-	if jamenv.Env() == jamenv.Prod {
-		cert, err = tls.LoadX509KeyPair("/etc/jamsync/fullchain.pem", "/etc/jamsync/privkey.pem")
-	} else {
-		cert, err = tls.LoadX509KeyPair(filepath.Clean("x509/publickey.cer"), filepath.Clean("x509/private.key"))
+func New(config serverconfig.Config) (closer func(), err error) {
+	unlock, err := lockDataDir(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+
+	// Garbage collection may have crashed before swapping in every file
+	err = gcjournal.Recover(gcJournalDir(config.DataDir))
+	if err != nil {
+		return nil, err
 	}
+	jamhub := newJamHub(config)
+	err = jamhub.recoverCommits(config.DataDir)
 	if err != nil {
 		return nil, err
 	}
+	serverauth.SetAccessTokenVerifier(jamhub.verifyAccessToken)
+	if config.Auth.Provider == jamenv.BuiltinAuth.String() {
+		jamhub.issuer, err = serverauth.LoadIssuer(filepath.Join(config.DataDir, "jwks.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	serverauth.Configure(serverauth.Options{
+		Disabled:    config.AuthDisabled(),
+		Issuer:      jamhub.issuer,
+		Auth0Domain: config.Auth.Auth0Domain,
+	})
 
 	opts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(serverauth.EnsureValidToken),
-		grpc.Creds(credentials.NewServerTLSFromCert(&cert)),
+		grpc.StreamInterceptor(serverauth.EnsureValidTokenStream),
+	}
+	if config.TLS.Enabled {
+		cert, err := tls.LoadX509KeyPair(filepath.Clean(config.TLS.CertFile), filepath.Clean(config.TLS.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
 	}
 
 	server := grpc.NewServer(opts...)
 	reflection.Register(server)
 	pb.RegisterJamHubServer(server, jamhub)
 
-	tcplis, err := net.Listen("tcp", "0.0.0.0:14357")
-	if err != nil {
-		return nil, err
-	}
-	go func() {
-		if err := server.Serve(tcplis); err != nil {
-			log.Printf("error serving server: %v", err)
+	listeners := make([]net.Listener, 0, len(config.Listen))
+	for _, addr := range config.Listen {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
 		}
-	}()
+		listeners = append(listeners, lis)
+	}
+	for _, lis := range listeners {
+		go func(lis net.Listener) {
+			if err := server.Serve(lis); err != nil {
+				log.Printf("error serving server: %v", err)
+			}
+		}(lis)
+	}
 
-	return func() { server.Stop() }, nil
+	return func() {
+		server.Stop()
+		unlock()
+	}, nil
 }
 
 func Connect(accessToken *oauth2.Token) (client pb.JamHubClient, closer func(), err error) {
@@ -99,7 +150,8 @@ func Connect(accessToken *oauth2.Token) (client pb.JamHubClient, closer func(),
 			return conn, err
 		}),
 	}
-	if jamenv.Env() != jamenv.Local {
+	// Without a token requests are made anonymously
+	if accessToken != nil && accessToken.AccessToken != "" {
 		perRPC := oauth.TokenSource{TokenSource: oauth2.StaticTokenSource(accessToken)}
 		opts = append(opts, grpc.WithPerRPCCredentials(perRPC))
 	}
@@ -0,0 +1,125 @@
+package serverauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// builtinIssuer is the issuer of JWTs signed by the built-in identity provider.
+const builtinIssuer = "jamhub"
+
+// Issuer signs and validates the JWTs of the built-in identity provider.
+type Issuer struct {
+	signingKey jose.JSONWebKey
+	keys       jose.JSONWebKeySet
+	validator  *validator.Validator
+}
+
+// LoadIssuer loads the signing keys of the built-in identity provider from a
+// JWKS file, generating one on first use. The first key signs new tokens and
+// any others still validate tokens signed before the keys were rotated.
+func LoadIssuer(path string) (*Issuer, error) {
+	var privateKeys jose.JSONWebKeySet
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := generateSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		privateKeys.Keys = []jose.JSONWebKey{key}
+		data, err = json.Marshal(privateKeys)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, data, 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = json.Unmarshal(data, &privateKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(privateKeys.Keys) == 0 {
+		return nil, errors.New("no signing keys in " + path)
+	}
+
+	issuer := &Issuer{signingKey: privateKeys.Keys[0]}
+	for _, key := range privateKeys.Keys {
+		issuer.keys.Keys = append(issuer.keys.Keys, key.Public())
+	}
+	issuer.validator, err = validator.New(
+		func(ctx context.Context) (interface{}, error) {
+			return &issuer.keys, nil
+		},
+		validator.RS256,
+		builtinIssuer,
+		[]string{audience},
+		validator.WithCustomClaims(
+			func() validator.CustomClaims {
+				return &CustomClaims{}
+			},
+		),
+		validator.WithAllowedClockSkew(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return issuer, nil
+}
+
+func generateSigningKey() (jose.JSONWebKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	key := jose.JSONWebKey{Key: privateKey, Algorithm: string(jose.RS256), Use: "sig"}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return key, nil
+}
+
+// Sign issues a JWT for userId that expires after ttl.
+func (i *Issuer) Sign(userId string, ttl time.Duration) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: i.signingKey},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   builtinIssuer,
+		Subject:  userId,
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}).CompactSerialize()
+}
+
+func (i *Issuer) validate(token string) (*validator.ValidatedClaims, error) {
+	rawValidatedClaims, err := i.validator.ValidateToken(context.Background(), token)
+	if err != nil {
+		return nil, err
+	}
+	return rawValidatedClaims.(*validator.ValidatedClaims), nil
+}
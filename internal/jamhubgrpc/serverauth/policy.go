@@ -0,0 +1,68 @@
+package serverauth
+
+// methodPolicy is what a request needs to call an RPC. Handlers still check
+// the caller's role in the project, the policy only makes sure every RPC is
+// signed in and has the scope for what it does before the handler runs.
+type methodPolicy struct {
+	scope string
+	// anonymous RPCs can also be called without signing in so public
+	// projects can be read
+	anonymous bool
+}
+
+var (
+	anonymousRead = methodPolicy{scope: ScopeRead, anonymous: true}
+	read          = methodPolicy{scope: ScopeRead}
+	write         = methodPolicy{scope: ScopeWrite}
+	admin         = methodPolicy{scope: ScopeAdmin}
+)
+
+// methodPolicies has the policy of every JamHub RPC by full method name. RPCs
+// missing from it are rejected.
+var methodPolicies = map[string]methodPolicy{
+	"/pb.JamHub/AddProject":              write,
+	"/pb.JamHub/DeleteProject":           admin,
+	"/pb.JamHub/ListUserProjects":        read,
+	"/pb.JamHub/GetProjectId":            anonymousRead,
+	"/pb.JamHub/GetProjectCurrentCommit": anonymousRead,
+	"/pb.JamHub/GetProjectName":          anonymousRead,
+	"/pb.JamHub/AddProjectMember":        admin,
+	"/pb.JamHub/RemoveProjectMember":     admin,
+	"/pb.JamHub/ListProjectMembers":      read,
+	"/pb.JamHub/SetProjectVisibility":    admin,
+
+	"/pb.JamHub/CreateWorkspace":           write,
+	"/pb.JamHub/DeleteWorkspace":           write,
+	"/pb.JamHub/ListWorkspaces":            anonymousRead,
+	"/pb.JamHub/GetWorkspaceCurrentChange": anonymousRead,
+	"/pb.JamHub/GetWorkspaceId":            anonymousRead,
+	"/pb.JamHub/GetWorkspaceName":          anonymousRead,
+	"/pb.JamHub/UpdateWorkspaceBase":       write,
+	"/pb.JamHub/ResolveConflicts":          write,
+
+	"/pb.JamHub/ReadCommitChunkHashes":        anonymousRead,
+	"/pb.JamHub/ReadCommittedFile":            anonymousRead,
+	"/pb.JamHub/ListCommitOperationLocations": read,
+	"/pb.JamHub/MergeWorkspace":               write,
+	"/pb.JamHub/GetCommit":                    anonymousRead,
+	"/pb.JamHub/ListCommits":                  anonymousRead,
+
+	"/pb.JamHub/ReadWorkspaceChunkHashes":        anonymousRead,
+	"/pb.JamHub/ReadWorkspaceFile":               anonymousRead,
+	"/pb.JamHub/ListWorkspaceOperationLocations": read,
+	"/pb.JamHub/WriteWorkspaceOperationsStream":  write,
+
+	"/pb.JamHub/UserInfo":          read,
+	"/pb.JamHub/CreateUser":        admin,
+	"/pb.JamHub/Ping":              read,
+	"/pb.JamHub/CreateAccessToken": admin,
+	"/pb.JamHub/ListAccessTokens":  admin,
+	"/pb.JamHub/RevokeAccessToken": admin,
+	"/pb.JamHub/GetAuthProvider":   anonymousRead,
+	"/pb.JamHub/Register":          anonymousRead,
+	"/pb.JamHub/Login":             anonymousRead,
+
+	// Reflection only describes the RPCs, which tools like grpcurl need
+	// before they can sign in
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": anonymousRead,
+}
@@ -4,13 +4,11 @@ import (
 	"context"
 	"log"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
-	"github.com/zdgeier/jamhub/internal/jamenv"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -19,14 +17,60 @@ import (
 
 var provider *jwks.CachingProvider
 
+// options are how requests are authenticated, set by Configure.
+var options Options
+
+// audience is who JWTs have to be issued for to be accepted.
+const audience = "api.jamsync.dev"
+
+// TestUserId is who every request is from when authentication is disabled.
+const TestUserId = "test@jamhub.dev"
+
 var (
 	errMissingMetadata = status.Errorf(codes.InvalidArgument, "missing metadata")
 	errInvalidToken    = status.Errorf(codes.Unauthenticated, "invalid token")
 )
 
+// EnsureValidToken is the unary interceptor that checks requests against the
+// policy of the RPC they call.
 func EnsureValidToken(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	if jamenv.Env() == jamenv.Local {
-		return handler(ctx, req)
+	ctx, err := authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// EnsureValidTokenStream is EnsureValidToken for streaming RPCs.
+func EnsureValidTokenStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream passes the validated credentials on to stream handlers.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate validates the token of a request to method and checks that it
+// has the scope the method needs. The returned context holds the credentials
+// for the handler.
+func authenticate(ctx context.Context, method string) (context.Context, error) {
+	if AuthDisabled() {
+		return ctx, nil
+	}
+
+	policy, ok := methodPolicies[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "no access policy for %s", method)
 	}
 
 	md, ok := metadata.FromIncomingContext(ctx)
@@ -34,23 +78,144 @@ func EnsureValidToken(ctx context.Context, req interface{}, info *grpc.UnaryServ
 		return nil, errMissingMetadata
 	}
 
+	// Anonymous requests are let through to RPCs that allow them, the handler
+	// decides whether the project can be read without signing in
 	authorizationHeader := md.Get("authorization")
 	if len(authorizationHeader) < 1 || authorizationHeader[0] == "" {
-		return nil, errInvalidToken
+		if policy.anonymous {
+			return ctx, nil
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "sign in to call %s", method)
 	}
 
 	token := strings.TrimPrefix(authorizationHeader[0], "Bearer ")
-	_, err := ensureValidToken(token)
+	creds, err := validateToken(token)
 	if err != nil {
 		return nil, err
 	}
+	if !creds.Allows(policy.scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "access token needs the %s scope", policy.scope)
+	}
 
-	return handler(ctx, req)
+	return context.WithValue(ctx, credentialsKey{}, creds), nil
+}
+
+// AccessTokenPrefix starts every access token issued by the server, which
+// tells them apart from JWTs.
+const AccessTokenPrefix = "jam_"
+
+// Scopes that access tokens can be limited to.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// scopeRanks orders the scopes so that each one includes the ones below it.
+var scopeRanks = map[string]int{
+	ScopeRead:  1,
+	ScopeWrite: 2,
+	ScopeAdmin: 3,
+}
+
+// ValidScope reports whether scope is one of the scopes above.
+func ValidScope(scope string) bool {
+	_, found := scopeRanks[scope]
+	return found
+}
+
+// Credentials are who made a request and what they are allowed to do.
+type Credentials struct {
+	UserId string
+	// Scopes limits what an access token can be used for. Credentials from
+	// logging in are not limited and have nil Scopes.
+	Scopes []string
+}
+
+func (c Credentials) HasScope(scope string) bool {
+	if c.Scopes == nil {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the credentials have scope or a scope that includes
+// it.
+func (c Credentials) Allows(scope string) bool {
+	for s, rank := range scopeRanks {
+		if rank >= scopeRanks[scope] && c.HasScope(s) {
+			return true
+		}
+	}
+	return false
+}
+
+type credentialsKey struct{}
+
+var accessTokenVerifier func(token string) (Credentials, error)
+
+// SetAccessTokenVerifier sets how access tokens issued by the server are
+// looked up. Until it is set only JWTs are accepted.
+func SetAccessTokenVerifier(verifier func(token string) (Credentials, error)) {
+	accessTokenVerifier = verifier
+}
+
+func validateToken(token string) (Credentials, error) {
+	if strings.HasPrefix(token, AccessTokenPrefix) {
+		if accessTokenVerifier == nil {
+			return Credentials{}, errInvalidToken
+		}
+		return accessTokenVerifier(token)
+	}
+
+	validatedClaims, err := ensureValidToken(token)
+	if err != nil {
+		return Credentials{}, errInvalidToken
+	}
+
+	// Tokens from signing in are only limited if they were issued for some
+	// of our scopes
+	var scopes []string
+	if claims, ok := validatedClaims.CustomClaims.(*CustomClaims); ok {
+		for _, scope := range []string{ScopeRead, ScopeWrite, ScopeAdmin} {
+			if claims.HasScope(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return Credentials{UserId: validatedClaims.RegisteredClaims.Subject, Scopes: scopes}, nil
+}
+
+type Options struct {
+	// Disabled lets every request through as TestUserId, for local testing.
+	Disabled bool
+	// Issuer validates JWTs from the built-in identity provider instead of
+	// Auth0 when set.
+	Issuer      *Issuer
+	Auth0Domain string
+}
+
+func Configure(opts Options) {
+	options = opts
+	provider = nil
+}
+
+func AuthDisabled() bool {
+	return options.Disabled
 }
 
 // EnsureValidToken is a middleware that will check the validity of our JWT.
 func ensureValidToken(token string) (*validator.ValidatedClaims, error) {
-	issuerURL, err := url.Parse("https://" + os.Getenv("AUTH0_DOMAIN") + "/")
+	if options.Issuer != nil {
+		return options.Issuer.validate(token)
+	}
+
+	issuerURL, err := url.Parse("https://" + options.Auth0Domain + "/")
 	if err != nil {
 		log.Panicf("Failed to parse the issuer url: %v", err)
 	}
@@ -62,7 +227,7 @@ func ensureValidToken(token string) (*validator.ValidatedClaims, error) {
 		provider.KeyFunc,
 		validator.RS256,
 		issuerURL.String(),
-		[]string{"api.jamsync.dev"},
+		[]string{audience},
 		validator.WithCustomClaims(
 			func() validator.CustomClaims {
 				return &CustomClaims{}
@@ -104,25 +269,52 @@ func (c CustomClaims) HasScope(expectedScope string) bool {
 	return false
 }
 
-func ParseIdFromCtx(ctx context.Context) (string, error) {
-	if jamenv.Env() == jamenv.Local {
-		return "test@jamhub.dev", nil
+// CredentialsFromCtx returns the credentials a request was made with, which
+// are reused from the interceptor if it already validated them.
+func CredentialsFromCtx(ctx context.Context) (Credentials, error) {
+	if AuthDisabled() {
+		return Credentials{UserId: TestUserId}, nil
+	}
+	if creds, ok := ctx.Value(credentialsKey{}).(Credentials); ok {
+		return creds, nil
 	}
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return "", errMissingMetadata
+		return Credentials{}, errMissingMetadata
 	}
 
 	authorizationHeader := md.Get("authorization")
 	if len(authorizationHeader) < 1 || authorizationHeader[0] == "" {
-		return "", errInvalidToken
+		return Credentials{}, errInvalidToken
 	}
 
 	token := strings.TrimPrefix(authorizationHeader[0], "Bearer ")
-	validatedClaims, err := ensureValidToken(token)
+	return validateToken(token)
+}
+
+func ParseIdFromCtx(ctx context.Context) (string, error) {
+	creds, err := CredentialsFromCtx(ctx)
 	if err != nil {
 		return "", err
 	}
+	return creds.UserId, nil
+}
+
+// ParseOptionalIdFromCtx is ParseIdFromCtx for requests that can also be made
+// anonymously, in which case the id is empty. Invalid tokens are still
+// rejected.
+func ParseOptionalIdFromCtx(ctx context.Context) (string, error) {
+	if AuthDisabled() {
+		return TestUserId, nil
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", errMissingMetadata
+	}
 
-	return validatedClaims.RegisteredClaims.Subject, nil
+	authorizationHeader := md.Get("authorization")
+	if len(authorizationHeader) < 1 || authorizationHeader[0] == "" {
+		return "", nil
+	}
+	return ParseIdFromCtx(ctx)
 }
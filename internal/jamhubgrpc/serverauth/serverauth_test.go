@@ -0,0 +1,169 @@
+package serverauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s testStream) Context() context.Context {
+	return s.ctx
+}
+
+// jamHubMethods returns the full method name of every JamHub RPC and whether
+// it is streaming.
+func jamHubMethods() map[string]bool {
+	methods := make(map[string]bool)
+	for _, method := range pb.JamHub_ServiceDesc.Methods {
+		methods["/"+pb.JamHub_ServiceDesc.ServiceName+"/"+method.MethodName] = false
+	}
+	for _, stream := range pb.JamHub_ServiceDesc.Streams {
+		methods["/"+pb.JamHub_ServiceDesc.ServiceName+"/"+stream.StreamName] = true
+	}
+	return methods
+}
+
+// call runs a request to method with token through the interceptor and
+// returns whether the handler ran.
+func call(method string, streaming bool, token string) (bool, error) {
+	md := metadata.MD{}
+	if token != "" {
+		md.Set("authorization", "Bearer "+token)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	called := false
+	if streaming {
+		err := EnsureValidTokenStream(nil, testStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, func(srv interface{}, stream grpc.ServerStream) error {
+			called = true
+			return nil
+		})
+		return called, err
+	}
+	_, err := EnsureValidToken(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	return called, err
+}
+
+func setupTokens(t *testing.T) {
+	tokens := map[string]Credentials{
+		"jam_none":  {UserId: "user", Scopes: []string{}},
+		"jam_read":  {UserId: "user", Scopes: []string{ScopeRead}},
+		"jam_write": {UserId: "user", Scopes: []string{ScopeWrite}},
+		"jam_admin": {UserId: "user", Scopes: []string{ScopeAdmin}},
+	}
+	SetAccessTokenVerifier(func(token string) (Credentials, error) {
+		creds, ok := tokens[token]
+		if !ok {
+			return Credentials{}, errInvalidToken
+		}
+		return creds, nil
+	})
+	t.Cleanup(func() { SetAccessTokenVerifier(nil) })
+}
+
+func code(err error) codes.Code {
+	return status.Code(err)
+}
+
+func TestEveryMethodHasPolicy(t *testing.T) {
+	for method := range jamHubMethods() {
+		if _, ok := methodPolicies[method]; !ok {
+			t.Errorf("%s has no access policy", method)
+		}
+	}
+}
+
+func TestRejectsMissingCredentials(t *testing.T) {
+	setupTokens(t)
+	for method, streaming := range jamHubMethods() {
+		called, err := call(method, streaming, "")
+		if methodPolicies[method].anonymous {
+			if !called || err != nil {
+				t.Errorf("%s: anonymous request was rejected: %v", method, err)
+			}
+			continue
+		}
+		if called || code(err) != codes.Unauthenticated {
+			t.Errorf("%s: expected Unauthenticated without credentials, got %v (handler called %v)", method, err, called)
+		}
+	}
+}
+
+func TestRejectsInvalidCredentials(t *testing.T) {
+	setupTokens(t)
+	for method, streaming := range jamHubMethods() {
+		called, err := call(method, streaming, "jam_unknown")
+		if called || code(err) != codes.Unauthenticated {
+			t.Errorf("%s: expected Unauthenticated with an invalid token, got %v (handler called %v)", method, err, called)
+		}
+	}
+}
+
+func TestRejectsUnderScopedCredentials(t *testing.T) {
+	setupTokens(t)
+	tokens := []struct {
+		token string
+		rank  int
+	}{
+		{"jam_none", 0},
+		{"jam_read", scopeRanks[ScopeRead]},
+		{"jam_write", scopeRanks[ScopeWrite]},
+		{"jam_admin", scopeRanks[ScopeAdmin]},
+	}
+	for method, streaming := range jamHubMethods() {
+		required := scopeRanks[methodPolicies[method].scope]
+		for _, test := range tokens {
+			called, err := call(method, streaming, test.token)
+			if test.rank < required {
+				if called || code(err) != codes.PermissionDenied {
+					t.Errorf("%s with %s: expected PermissionDenied, got %v (handler called %v)", method, test.token, err, called)
+				}
+			} else if !called || err != nil {
+				t.Errorf("%s with %s: expected the handler to run, got %v", method, test.token, err)
+			}
+		}
+	}
+}
+
+func TestRejectsUnknownMethods(t *testing.T) {
+	setupTokens(t)
+	called, err := call("/pb.JamHub/NotAnRPC", false, "jam_admin")
+	if called || code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied for an RPC without a policy, got %v (handler called %v)", err, called)
+	}
+}
+
+func TestStreamHandlerGetsCredentials(t *testing.T) {
+	setupTokens(t)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer jam_write"))
+	err := EnsureValidTokenStream(nil, testStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/pb.JamHub/WriteWorkspaceOperationsStream"}, func(srv interface{}, stream grpc.ServerStream) error {
+		// The token cannot be validated again, so the credentials have to come
+		// from the interceptor
+		SetAccessTokenVerifier(nil)
+		id, err := ParseIdFromCtx(stream.Context())
+		if err != nil {
+			return err
+		}
+		if id != "user" {
+			return errors.New("unexpected user " + id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
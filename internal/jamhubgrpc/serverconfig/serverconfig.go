@@ -0,0 +1,206 @@
+package serverconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zdgeier/jamhub/internal/jamenv"
+)
+
+// Config is how a JamHub server runs. Each instance needs its own listen
+// addresses and data directory to run side by side with others.
+type Config struct {
+	// Env is "prod" or "local", which picks the defaults below.
+	Env string `json:"env"`
+	// Listen are the addresses the server accepts connections on.
+	Listen []string `json:"listen"`
+	// DataDir holds every store of the server.
+	DataDir string `json:"data_dir"`
+	TLS     TLS    `json:"tls"`
+	Auth    Auth   `json:"auth"`
+	// Store is the backend of the project stores. Only "local", which keeps
+	// everything in DataDir, exists so far.
+	Store string `json:"store"`
+}
+
+type TLS struct {
+	// Enabled can be turned off when a proxy in front of the server handles
+	// TLS.
+	Enabled  bool   `json:"enabled"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type Auth struct {
+	// Provider is "auth0", or "builtin" for users that register with the
+	// server itself.
+	Provider    string `json:"provider"`
+	Auth0Domain string `json:"auth0_domain"`
+}
+
+// Default is the config of a server without a config file, environment
+// variables or flags.
+func Default() Config {
+	return Config{
+		Env:     jamenv.Prod.String(),
+		Listen:  []string{"0.0.0.0:14357"},
+		DataDir: "jamhubdata",
+		TLS:     TLS{Enabled: true},
+		Auth:    Auth{Provider: jamenv.Auth0.String()},
+		Store:   "local",
+	}
+}
+
+// Flags are the command line flags that override the config.
+type Flags struct {
+	flagSet     *flag.FlagSet
+	path        *string
+	env         *string
+	listen      *string
+	dataDir     *string
+	tls         *bool
+	certFile    *string
+	keyFile     *string
+	auth        *string
+	auth0Domain *string
+	store       *string
+}
+
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	return &Flags{
+		flagSet:     flagSet,
+		path:        flagSet.String("config", os.Getenv("JAMHUB_CONFIG"), "JSON config file, also JAMHUB_CONFIG"),
+		env:         flagSet.String("env", "", "prod or local, also JAM_ENV"),
+		listen:      flagSet.String("listen", "", "comma separated addresses to listen on, also JAMHUB_LISTEN"),
+		dataDir:     flagSet.String("data-dir", "", "directory of the server's data, also JAMHUB_DATA_DIR"),
+		tls:         flagSet.Bool("tls", true, "serve over TLS, also JAMHUB_TLS"),
+		certFile:    flagSet.String("tls-cert", "", "TLS certificate file, also JAMHUB_TLS_CERT"),
+		keyFile:     flagSet.String("tls-key", "", "TLS key file, also JAMHUB_TLS_KEY"),
+		auth:        flagSet.String("auth", "", "auth0 or builtin identity provider, also JAM_AUTH"),
+		auth0Domain: flagSet.String("auth0-domain", "", "Auth0 tenant domain, also AUTH0_DOMAIN"),
+		store:       flagSet.String("store", "", "store backend, also JAMHUB_STORE"),
+	}
+}
+
+// Load builds the config from the defaults, the config file, environment
+// variables and the flags that were set, each overriding the ones before.
+func (f *Flags) Load() (Config, error) {
+	config := Default()
+	if *f.path != "" {
+		data, err := os.ReadFile(*f.path)
+		if err != nil {
+			return config, err
+		}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return config, fmt.Errorf("could not parse %s: %w", *f.path, err)
+		}
+	}
+
+	err := config.applyEnv()
+	if err != nil {
+		return config, err
+	}
+
+	f.flagSet.Visit(func(set *flag.Flag) {
+		switch set.Name {
+		case "env":
+			config.Env = *f.env
+		case "listen":
+			config.Listen = strings.Split(*f.listen, ",")
+		case "data-dir":
+			config.DataDir = *f.dataDir
+		case "tls":
+			config.TLS.Enabled = *f.tls
+		case "tls-cert":
+			config.TLS.CertFile = *f.certFile
+		case "tls-key":
+			config.TLS.KeyFile = *f.keyFile
+		case "auth":
+			config.Auth.Provider = *f.auth
+		case "auth0-domain":
+			config.Auth.Auth0Domain = *f.auth0Domain
+		case "store":
+			config.Store = *f.store
+		}
+	})
+
+	config.fillDefaults()
+	return config, config.validate()
+}
+
+func (c *Config) applyEnv() error {
+	setString := func(name string, value *string) {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+	// Unknown values fall back the same as they do for the clients
+	if os.Getenv("JAM_ENV") != "" {
+		c.Env = jamenv.Env().String()
+	}
+	if os.Getenv("JAM_AUTH") != "" {
+		c.Auth.Provider = jamenv.Auth().String()
+	}
+	setString("JAMHUB_DATA_DIR", &c.DataDir)
+	setString("JAMHUB_TLS_CERT", &c.TLS.CertFile)
+	setString("JAMHUB_TLS_KEY", &c.TLS.KeyFile)
+	setString("AUTH0_DOMAIN", &c.Auth.Auth0Domain)
+	setString("JAMHUB_STORE", &c.Store)
+	if listen := os.Getenv("JAMHUB_LISTEN"); listen != "" {
+		c.Listen = strings.Split(listen, ",")
+	}
+	if tls := os.Getenv("JAMHUB_TLS"); tls != "" {
+		enabled, err := strconv.ParseBool(tls)
+		if err != nil {
+			return fmt.Errorf("JAMHUB_TLS: %w", err)
+		}
+		c.TLS.Enabled = enabled
+	}
+	return nil
+}
+
+// fillDefaults sets the TLS files for the environment if none were given.
+func (c *Config) fillDefaults() {
+	if c.TLS.CertFile == "" && c.TLS.KeyFile == "" {
+		if c.Env == jamenv.Prod.String() {
+			c.TLS.CertFile = "/etc/jamsync/fullchain.pem"
+			c.TLS.KeyFile = "/etc/jamsync/privkey.pem"
+		} else {
+			c.TLS.CertFile = "x509/publickey.cer"
+			c.TLS.KeyFile = "x509/private.key"
+		}
+	}
+}
+
+func (c Config) validate() error {
+	if c.Env != jamenv.Prod.String() && c.Env != jamenv.Local.String() {
+		return fmt.Errorf("unknown env %q", c.Env)
+	}
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("no listen addresses")
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("no data directory")
+	}
+	if c.TLS.Enabled && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if c.Auth.Provider != jamenv.Auth0.String() && c.Auth.Provider != jamenv.BuiltinAuth.String() {
+		return fmt.Errorf("unknown auth provider %q", c.Auth.Provider)
+	}
+	if c.Store != "local" {
+		return fmt.Errorf("unknown store backend %q", c.Store)
+	}
+	return nil
+}
+
+// AuthDisabled reports whether requests skip authentication, which only
+// happens in local mode without the built-in identity provider.
+func (c Config) AuthDisabled() bool {
+	return c.Env == jamenv.Local.String() && c.Auth.Provider != jamenv.BuiltinAuth.String()
+}
@@ -0,0 +1,261 @@
+package jamhubgrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// requireScope checks that a request was not made with an access token
+// limited to less than scope.
+func requireScope(ctx context.Context, scope string) error {
+	creds, err := serverauth.CredentialsFromCtx(ctx)
+	if err != nil {
+		return err
+	}
+	if !creds.Allows(scope) {
+		return status.Errorf(codes.PermissionDenied, "access token needs the %s scope", scope)
+	}
+	return nil
+}
+
+// roleScope is the scope an access token needs to act with role in a project.
+func roleScope(role db.Role) string {
+	switch {
+	case role >= db.RoleMaintainer:
+		return serverauth.ScopeAdmin
+	case role >= db.RoleWriter:
+		return serverauth.ScopeWrite
+	}
+	return serverauth.ScopeRead
+}
+
+func hashAccessToken(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// verifyAccessToken looks up the credentials of an access token issued by
+// CreateAccessToken.
+func (s JamHub) verifyAccessToken(secret string) (serverauth.Credentials, error) {
+	token, err := s.db.GetAccessTokenByHash(hashAccessToken(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return serverauth.Credentials{}, status.Errorf(codes.Unauthenticated, "invalid access token")
+	}
+	if err != nil {
+		return serverauth.Credentials{}, err
+	}
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		return serverauth.Credentials{}, status.Errorf(codes.Unauthenticated, "access token %s expired", token.Name)
+	}
+	return serverauth.Credentials{UserId: token.UserId, Scopes: token.Scopes}, nil
+}
+
+// serviceAccountPrefix starts the user id of every service account.
+const serviceAccountPrefix = "service-account:"
+
+// serviceAccountId is the user id of a service account. Names are checked
+// against usernamePattern first since user ids end up in store paths.
+func serviceAccountId(projectId uint64, name string) string {
+	return fmt.Sprintf("%s%d:%s", serviceAccountPrefix, projectId, name)
+}
+
+// parseAccountIdFromCtx is serverauth.ParseIdFromCtx for RPCs that act on the
+// caller's own account instead of a project. Service accounts only have
+// access to the project they were added to, so they can't call them.
+func parseAccountIdFromCtx(ctx context.Context) (string, error) {
+	id, err := serverauth.ParseIdFromCtx(ctx)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(id, serviceAccountPrefix) {
+		return "", status.Errorf(codes.PermissionDenied, "service accounts can only access their project")
+	}
+	return id, nil
+}
+
+func accessTokenToPb(token db.AccessToken) *pb.AccessToken {
+	tokenPb := &pb.AccessToken{
+		Id:        token.Id,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		ProjectId: token.ProjectId,
+		CreatedAt: timestamppb.New(token.CreatedAt),
+	}
+	if token.ProjectId != 0 {
+		tokenPb.ServiceAccount = token.UserId
+	}
+	if !token.ExpiresAt.IsZero() {
+		tokenPb.ExpiresAt = timestamppb.New(token.ExpiresAt)
+	}
+	return tokenPb
+}
+
+func (s JamHub) CreateAccessToken(ctx context.Context, in *pb.CreateAccessTokenRequest) (*pb.CreateAccessTokenResponse, error) {
+	userId, err := parseAccountIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "access tokens need a name")
+	}
+	if len(in.GetScopes()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "access tokens need at least one scope")
+	}
+	for _, scope := range in.GetScopes() {
+		if !serverauth.ValidScope(scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown scope %s", scope)
+		}
+	}
+	if in.GetExpiresAt() != nil && in.GetExpiresAt().AsTime().Before(time.Now()) {
+		return nil, status.Errorf(codes.InvalidArgument, "expiry is in the past")
+	}
+
+	token := db.AccessToken{
+		UserId:    userId,
+		Name:      in.GetName(),
+		Scopes:    in.GetScopes(),
+		CreatedAt: time.Now(),
+	}
+	if in.GetExpiresAt() != nil {
+		token.ExpiresAt = in.GetExpiresAt().AsTime()
+	}
+	if in.GetServiceAccount() != "" {
+		token.UserId, err = s.addServiceAccount(ctx, userId, in.GetProjectId(), in.GetServiceAccount(), db.Role(in.GetRole()))
+		if err != nil {
+			return nil, err
+		}
+		token.ProjectId = in.GetProjectId()
+	} else if in.GetProjectId() != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "project tokens are issued for a service account")
+	}
+
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	secret := serverauth.AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	token.Id, err = s.db.AddAccessToken(hashAccessToken(secret), token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateAccessTokenResponse{
+		Token:  accessTokenToPb(token),
+		Secret: secret,
+	}, nil
+}
+
+// addServiceAccount adds a service account to a project with role, or
+// changes its role if it already exists, and returns its user id. The same
+// rules apply as for adding members.
+func (s JamHub) addServiceAccount(ctx context.Context, userId string, projectId uint64, name string, role db.Role) (string, error) {
+	if !usernamePattern.MatchString(name) {
+		return "", status.Errorf(codes.InvalidArgument, "service account names are up to 39 letters, digits, '.', '_' or '-'")
+	}
+	_, err := s.authorize(ctx, userId, projectId, db.RoleMaintainer)
+	if err != nil {
+		return "", err
+	}
+	if role == db.RoleNone {
+		role = db.RoleWriter
+	}
+	if role > db.RoleOwner {
+		return "", status.Errorf(codes.InvalidArgument, "invalid role %d", role)
+	}
+	userRole, err := s.db.GetProjectRole(projectId, userId)
+	if err != nil {
+		return "", err
+	}
+	if role > userRole {
+		return "", status.Errorf(codes.PermissionDenied, "cannot give a role above your own")
+	}
+
+	// Service accounts are registered as users so they can be managed like
+	// any other member
+	accountId := serviceAccountId(projectId, name)
+	err = s.db.CreateUser(accountId, accountId)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		return "", status.Errorf(codes.AlreadyExists, "%s is already taken", accountId)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = s.manageableMember(userId, projectId, accountId)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.SetMember(projectId, accountId, role)
+	if err != nil {
+		return "", err
+	}
+	return accountId, nil
+}
+
+func (s JamHub) ListAccessTokens(ctx context.Context, in *pb.ListAccessTokensRequest) (*pb.ListAccessTokensResponse, error) {
+	userId, err := parseAccountIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in.GetProjectId() != 0 {
+		_, err = s.authorize(ctx, userId, in.GetProjectId(), db.RoleMaintainer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tokens, err := s.db.ListAccessTokens(userId, in.GetProjectId())
+	if err != nil {
+		return nil, err
+	}
+	tokensPb := make([]*pb.AccessToken, len(tokens))
+	for i, token := range tokens {
+		tokensPb[i] = accessTokenToPb(token)
+	}
+	return &pb.ListAccessTokensResponse{Tokens: tokensPb}, nil
+}
+
+func (s JamHub) RevokeAccessToken(ctx context.Context, in *pb.RevokeAccessTokenRequest) (*pb.RevokeAccessTokenResponse, error) {
+	userId, err := parseAccountIdFromCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.db.GetAccessToken(in.GetId())
+	notFound := status.Errorf(codes.NotFound, "access token %d not found", in.GetId())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.ProjectId != 0 {
+		_, err = s.authorize(ctx, userId, token.ProjectId, db.RoleMaintainer)
+		if err != nil {
+			return nil, err
+		}
+	} else if token.UserId != userId {
+		return nil, notFound
+	}
+
+	err = s.db.DeleteAccessToken(in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RevokeAccessTokenResponse{}, nil
+}
@@ -0,0 +1,62 @@
+package jamhubgrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zdgeier/jamhub/gen/pb"
+	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServiceAccountsCannotActAsUsers(t *testing.T) {
+	s := testServer(t)
+	project, err := s.AddProject(context.Background(), &pb.AddProjectRequest{ProjectName: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.CreateAccessToken(context.Background(), &pb.CreateAccessTokenRequest{
+		Name:           "ci",
+		Scopes:         []string{serverauth.ScopeAdmin},
+		ProjectId:      project.GetProjectId(),
+		ServiceAccount: "ci",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverauth.Configure(serverauth.Options{})
+	serverauth.SetAccessTokenVerifier(s.verifyAccessToken)
+	t.Cleanup(func() { serverauth.SetAccessTokenVerifier(nil) })
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token.GetSecret()))
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"AddProject", func() error {
+			_, err := s.AddProject(ctx, &pb.AddProjectRequest{ProjectName: "other"})
+			return err
+		}},
+		{"CreateAccessToken", func() error {
+			_, err := s.CreateAccessToken(ctx, &pb.CreateAccessTokenRequest{Name: "personal", Scopes: []string{serverauth.ScopeAdmin}})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if status.Code(err) != codes.PermissionDenied {
+				t.Fatalf("expected PermissionDenied, got %v", err)
+			}
+		})
+	}
+
+	// The token still works for its project
+	_, err = s.GetProjectName(ctx, &pb.GetProjectNameRequest{ProjectId: project.GetProjectId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
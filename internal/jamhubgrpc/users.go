@@ -2,19 +2,33 @@ package jamhubgrpc
 
 import (
 	"context"
+	"errors"
+	"regexp"
 
 	"github.com/zdgeier/jamhub/gen/pb"
-	"github.com/zdgeier/jamhub/internal/jamenv"
+	"github.com/zdgeier/jamhub/internal/jamhub/db"
 	"github.com/zdgeier/jamhub/internal/jamhubgrpc/serverauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Users signed in through Auth0 are named by their email address
+var emailUsernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._%+-]{1,64}@[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)+$`)
+
 func (s JamHub) CreateUser(ctx context.Context, in *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
-	id, err := serverauth.ParseIdFromCtx(ctx)
+	id, err := parseAccountIdFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if !usernamePattern.MatchString(in.GetUsername()) && !emailUsernamePattern.MatchString(in.GetUsername()) {
+		return nil, status.Errorf(codes.InvalidArgument, "usernames are email addresses or up to 39 letters, digits, '.', '_' or '-'")
+	}
+
 	err = s.db.CreateUser(in.GetUsername(), id)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		return nil, status.Errorf(codes.AlreadyExists, "%s is already taken", in.GetUsername())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -26,7 +40,7 @@ func (s JamHub) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse,
 	if err != nil {
 		return nil, err
 	}
-	if jamenv.Env() == jamenv.Local {
+	if serverauth.AuthDisabled() {
 		return &pb.PingResponse{Username: id}, nil
 	}
 
@@ -15,10 +15,26 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// connect connects as the signed in user, or anonymously if nobody is signed
+// in so that public projects can still be browsed.
+func connect(ctx *gin.Context) (pb.JamHubClient, func(), error) {
+	accessToken, _ := sessions.Default(ctx).Get("access_token").(string)
+	return jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+}
+
+// getProjectId looks up the project of a request. Pages pass the username of
+// the project's owner in the owner query parameter so that projects of other
+// users can be found.
+func getProjectId(ctx *gin.Context, client pb.JamHubClient) (*pb.GetProjectIdResponse, error) {
+	return client.GetProjectId(ctx, &pb.GetProjectIdRequest{
+		ProjectName:   ctx.Param("projectName"),
+		OwnerUsername: ctx.Query("owner"),
+	})
+}
+
 func UserProjectsHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
@@ -36,16 +52,13 @@ func UserProjectsHandler() gin.HandlerFunc {
 
 func GetProjectCurrentCommitHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
-		id, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		id, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
@@ -63,17 +76,14 @@ func GetProjectCurrentCommitHandler() gin.HandlerFunc {
 
 func GetWorkspaceInfoHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		id, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		id, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
@@ -105,17 +115,14 @@ func GetWorkspaceInfoHandler() gin.HandlerFunc {
 
 func ProjectBrowseCommitHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		id, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		id, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
@@ -126,6 +133,14 @@ func ProjectBrowseCommitHandler() gin.HandlerFunc {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
+		if commitId == 0 {
+			commitResp, err := tempClient.GetProjectCurrentCommit(ctx, &pb.GetProjectCurrentCommitRequest{ProjectId: id.GetProjectId()})
+			if err != nil {
+				ctx.Error(err)
+				return
+			}
+			commitId = int(commitResp.GetCommitId())
+		}
 
 		metadataResult := new(bytes.Buffer)
 		err = file.DownloadCommittedFile(tempClient, id.GetProjectId(), uint64(commitId), ".jamhubfilelist", bytes.NewReader([]byte{}), metadataResult)
@@ -164,17 +179,14 @@ func ProjectBrowseCommitHandler() gin.HandlerFunc {
 
 func ProjectBrowseWorkspaceHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		id, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		id, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
@@ -228,17 +240,14 @@ func ProjectBrowseWorkspaceHandler() gin.HandlerFunc {
 
 func GetFileWorkspaceHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		config, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		config, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.Error(err)
 			return
@@ -266,17 +275,14 @@ func GetFileWorkspaceHandler() gin.HandlerFunc {
 
 func GetFileCommitHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		config, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		config, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.Error(err)
 			return
@@ -287,6 +293,14 @@ func GetFileCommitHandler() gin.HandlerFunc {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
+		if commitId == 0 {
+			commitResp, err := tempClient.GetProjectCurrentCommit(ctx, &pb.GetProjectCurrentCommitRequest{ProjectId: config.GetProjectId()})
+			if err != nil {
+				ctx.Error(err)
+				return
+			}
+			commitId = int(commitResp.GetCommitId())
+		}
 
 		err = file.DownloadCommittedFile(tempClient, config.ProjectId, uint64(commitId), ctx.Param("path")[1:], bytes.NewReader([]byte{}), ctx.Writer)
 		if err != nil {
@@ -298,17 +312,14 @@ func GetFileCommitHandler() gin.HandlerFunc {
 
 func GetWorkspacesHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		accessToken := sessions.Default(ctx).Get("access_token").(string)
-		tempClient, closer, err := jamhubgrpc.Connect(&oauth2.Token{AccessToken: accessToken})
+		tempClient, closer, err := connect(ctx)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer closer()
 
-		config, err := tempClient.GetProjectId(ctx, &pb.GetProjectIdRequest{
-			ProjectName: ctx.Param("projectName"),
-		})
+		config, err := getProjectId(ctx, tempClient)
 		if err != nil {
 			ctx.String(http.StatusInternalServerError, err.Error())
 			return
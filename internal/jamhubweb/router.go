@@ -137,12 +137,14 @@ func New(auth *authenticator.Authenticator) http.Handler {
 	router.GET("/api/projects/:projectName/workspacefiles/:workspaceId/:changeId/*path", api.ProjectBrowseWorkspaceHandler())
 	router.GET("/api/projects/:projectName/workspacefile/:workspaceId/:changeId/*path", api.GetFileWorkspaceHandler())
 
+	// Project pages can be viewed without signing in, the api only returns
+	// public projects to anonymous visitors
 	router.GET("/:username/projects", middleware.IsAuthenticated, middleware.Reauthenticate, userprojects.Handler)
-	router.GET("/:username/:project/workspacefile/:workspaceName/*path", middleware.IsAuthenticated, middleware.Reauthenticate, workspacefile.Handler)
-	router.GET("/:username/:project/committedfile/*path", middleware.IsAuthenticated, middleware.Reauthenticate, committedfile.Handler)
-	router.GET("/:username/:project/committedfiles/*path", middleware.IsAuthenticated, middleware.Reauthenticate, committedfiles.Handler)
-	router.GET("/:username/:project/projectinfo", middleware.IsAuthenticated, middleware.Reauthenticate, projectinfo.Handler)
-	router.GET("/:username/:project/workspacefiles/:workspaceName/*path", middleware.IsAuthenticated, middleware.Reauthenticate, workspacefiles.Handler)
+	router.GET("/:username/:project/workspacefile/:workspaceName/*path", middleware.Reauthenticate, workspacefile.Handler)
+	router.GET("/:username/:project/committedfile/*path", middleware.Reauthenticate, committedfile.Handler)
+	router.GET("/:username/:project/committedfiles/*path", middleware.Reauthenticate, committedfiles.Handler)
+	router.GET("/:username/:project/projectinfo", middleware.Reauthenticate, projectinfo.Handler)
+	router.GET("/:username/:project/workspacefiles/:workspaceName/*path", middleware.Reauthenticate, workspacefiles.Handler)
 	router.GET("/download", middleware.IsAuthenticated, middleware.Reauthenticate, download.Handler)
 	return MaxAge(handlers.CompressHandler(router))
 }
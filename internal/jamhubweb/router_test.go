@@ -0,0 +1,43 @@
+package jamhubweb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestProjectPagesAllowAnonymous(t *testing.T) {
+	t.Setenv("JAM_ENV", "prod")
+	// Templates are loaded relative to the web server's directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../../cmd/jamhubweb"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	router := New(nil)
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/alice/project/projectinfo", http.StatusOK},
+		{"/alice/project/committedfiles/", http.StatusOK},
+		{"/alice/project/committedfile/file.txt", http.StatusOK},
+		{"/alice/project/workspacefiles/dev/", http.StatusOK},
+		{"/alice/project/workspacefile/dev/file.txt", http.StatusOK},
+		{"/alice/projects", http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package linediff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type OpType int
+
+const (
+	OpEqual OpType = iota
+	OpInsert
+	OpDelete
+)
+
+type Edit struct {
+	Type OpType
+	Line string
+}
+
+// Lines splits data into lines, keeping the trailing newline on each line so
+// that the input can be reconstructed exactly.
+func Lines(data []byte) []string {
+	lines := make([]string, 0, bytes.Count(data, []byte("\n"))+1)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// IsBinary uses the same heuristic as git, a NUL byte in the first 8000 bytes.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Diff returns the shortest edit script that turns a into b. Past
+// maxEditDistance the lines between the common prefix and suffix are replaced
+// as a whole instead.
+func Diff(a, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Edit, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		edits = append(edits, Edit{OpEqual, line})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, Edit{OpEqual, line})
+	}
+	return edits
+}
+
+// maxEditDistance caps the number of steps myers takes. The paths kept to
+// recover the edit script grow with the square of the steps, so files that
+// are further apart than this are replaced as a whole instead.
+const maxEditDistance = 2000
+
+// myers is the O((N+M)D) algorithm from "An O(ND) Difference Algorithm and Its
+// Variations". The furthest reaching paths of every step are kept so the edit
+// script can be recovered by walking them backwards. Step d only reaches
+// diagonals -d to d, so only those are kept.
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	if max > maxEditDistance {
+		max = maxEditDistance
+	}
+
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := make([][]int, 0)
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[offset-d:offset+d+1])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return replace(a, b)
+}
+
+// replace is the edit script that deletes all of a and inserts all of b.
+func replace(a, b []string) []Edit {
+	edits := make([]Edit, 0, len(a)+len(b))
+	for _, line := range a {
+		edits = append(edits, Edit{OpDelete, line})
+	}
+	for _, line := range b {
+		edits = append(edits, Edit{OpInsert, line})
+	}
+	return edits
+}
+
+func backtrack(trace [][]int, a, b []string) []Edit {
+	reversed := make([]Edit, 0, len(a)+len(b))
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		// Diagonals outside of -d to d were not reached before step d
+		furthest := func(k int) int {
+			if k < -d || k > d {
+				return 0
+			}
+			return trace[d][k+d]
+		}
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && furthest(k-1) < furthest(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := furthest(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Edit{OpEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, Edit{OpInsert, b[y-1]})
+			} else {
+				reversed = append(reversed, Edit{OpDelete, a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i := range reversed {
+		edits[i] = reversed[len(reversed)-1-i]
+	}
+	return edits
+}
+
+// Unified writes the differences between a and b in unified diff format with
+// the given number of context lines. Nothing is written if a and b are equal.
+func Unified(w io.Writer, aName, bName string, a, b []string, context int) error {
+	edits := Diff(a, b)
+
+	type line struct {
+		Edit
+		aIdx, bIdx int
+	}
+	lines := make([]line, len(edits))
+	changes := make([]int, 0)
+	aIdx, bIdx := 0, 0
+	for i, edit := range edits {
+		lines[i] = line{edit, aIdx, bIdx}
+		switch edit.Type {
+		case OpEqual:
+			aIdx++
+			bIdx++
+		case OpDelete:
+			aIdx++
+			changes = append(changes, i)
+		case OpInsert:
+			bIdx++
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(changes); {
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*context {
+			j++
+		}
+		end := changes[j] + context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var aLen, bLen int
+		for _, l := range lines[start:end] {
+			if l.Type != OpInsert {
+				aLen++
+			}
+			if l.Type != OpDelete {
+				bLen++
+			}
+		}
+		_, err = fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(lines[start].aIdx, aLen), hunkRange(lines[start].bIdx, bLen))
+		if err != nil {
+			return err
+		}
+
+		for _, l := range lines[start:end] {
+			prefix := " "
+			switch l.Type {
+			case OpInsert:
+				prefix = "+"
+			case OpDelete:
+				prefix = "-"
+			}
+			text := l.Line
+			if !strings.HasSuffix(text, "\n") {
+				text += "\n\\ No newline at end of file\n"
+			}
+			_, err = io.WriteString(w, prefix+text)
+			if err != nil {
+				return err
+			}
+		}
+		i = j + 1
+	}
+	return nil
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+// hunks groups an edit script into the ranges of a that were replaced.
+func hunks(edits []Edit) []hunk {
+	result := make([]hunk, 0)
+	aIdx := 0
+	var curr *hunk
+	for _, edit := range edits {
+		if edit.Type == OpEqual {
+			if curr != nil {
+				result = append(result, *curr)
+				curr = nil
+			}
+			aIdx++
+			continue
+		}
+		if curr == nil {
+			curr = &hunk{start: aIdx, end: aIdx}
+		}
+		if edit.Type == OpDelete {
+			aIdx++
+			curr.end = aIdx
+		} else {
+			curr.lines = append(curr.lines, edit.Line)
+		}
+	}
+	if curr != nil {
+		result = append(result, *curr)
+	}
+	return result
+}
+
+// applyHunks replaces base[lo:hi] using hunks that all fall inside that range.
+func applyHunks(base []string, lo, hi int, hs []hunk) []string {
+	result := make([]string, 0)
+	pos := lo
+	for _, h := range hs {
+		result = append(result, base[pos:h.start]...)
+		result = append(result, h.lines...)
+		pos = h.end
+	}
+	return append(result, base[pos:hi]...)
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge3 merges the changes made from base to ours and from base to theirs.
+// Changes to separate lines of base are both applied, as is a change both
+// sides made the same way. Different changes that touch or overlap the same
+// lines of base conflict: both versions are written between conflict markers
+// labeled with oursLabel and theirsLabel, and conflict is true.
+func Merge3(base, ours, theirs []string, oursLabel, theirsLabel string) (merged []string, conflict bool) {
+	oursHunks := hunks(Diff(base, ours))
+	theirsHunks := hunks(Diff(base, theirs))
+
+	merged = make([]string, 0, len(base))
+	pos := 0
+	i, j := 0, 0
+	for i < len(oursHunks) || j < len(theirsHunks) {
+		var lo, hi int
+		if j >= len(theirsHunks) || (i < len(oursHunks) && oursHunks[i].start <= theirsHunks[j].start) {
+			lo, hi = oursHunks[i].start, oursHunks[i].end
+		} else {
+			lo, hi = theirsHunks[j].start, theirsHunks[j].end
+		}
+
+		// Grow the region until no hunk from either side touches its edges
+		oursStart, theirsStart := i, j
+		for {
+			grew := false
+			for i < len(oursHunks) && oursHunks[i].start <= hi {
+				if oursHunks[i].end > hi {
+					hi = oursHunks[i].end
+				}
+				i++
+				grew = true
+			}
+			for j < len(theirsHunks) && theirsHunks[j].start <= hi {
+				if theirsHunks[j].end > hi {
+					hi = theirsHunks[j].end
+				}
+				j++
+				grew = true
+			}
+			if !grew {
+				break
+			}
+		}
+
+		merged = append(merged, base[pos:lo]...)
+		oursRegion := applyHunks(base, lo, hi, oursHunks[oursStart:i])
+		theirsRegion := applyHunks(base, lo, hi, theirsHunks[theirsStart:j])
+		switch {
+		case oursStart == i:
+			merged = append(merged, theirsRegion...)
+		case theirsStart == j:
+			merged = append(merged, oursRegion...)
+		case equalLines(oursRegion, theirsRegion):
+			merged = append(merged, oursRegion...)
+		default:
+			conflict = true
+			merged = append(merged, "<<<<<<< "+oursLabel+"\n")
+			merged = append(merged, terminated(oursRegion)...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, terminated(theirsRegion)...)
+			merged = append(merged, ">>>>>>> "+theirsLabel+"\n")
+		}
+		pos = hi
+	}
+	merged = append(merged, base[pos:]...)
+	return merged, conflict
+}
+
+// terminated makes sure the last line ends in a newline so that a following
+// conflict marker starts on its own line.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	result := make([]string, len(lines))
+	copy(result, lines)
+	result[len(result)-1] += "\n"
+	return result
+}
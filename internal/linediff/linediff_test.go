@@ -0,0 +1,173 @@
+package linediff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func apply(a []string, edits []Edit) ([]string, []string) {
+	from := make([]string, 0)
+	to := make([]string, 0)
+	for _, edit := range edits {
+		switch edit.Type {
+		case OpEqual:
+			from = append(from, edit.Line)
+			to = append(to, edit.Line)
+		case OpDelete:
+			from = append(from, edit.Line)
+		case OpInsert:
+			to = append(to, edit.Line)
+		}
+	}
+	return from, to
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		changes int
+	}{
+		{"equal", "a\nb\nc\n", "a\nb\nc\n", 0},
+		{"empty to full", "", "a\nb\n", 2},
+		{"full to empty", "a\nb\n", "", 2},
+		{"insert middle", "a\nc\n", "a\nb\nc\n", 1},
+		{"delete middle", "a\nb\nc\n", "a\nc\n", 1},
+		{"replace", "a\nb\nc\n", "a\nx\nc\n", 2},
+		{"reorder", "a\nb\nc\nd\n", "c\nd\na\nb\n", 4},
+		{"no trailing newline", "a\nb", "a\nb\n", 2},
+	}
+
+	for _, test := range tests {
+		a, b := Lines([]byte(test.a)), Lines([]byte(test.b))
+		edits := Diff(a, b)
+		from, to := apply(a, edits)
+		if strings.Join(from, "") != test.a || strings.Join(to, "") != test.b {
+			t.Errorf("%s: edits do not reproduce inputs", test.name)
+		}
+
+		changes := 0
+		for _, edit := range edits {
+			if edit.Type != OpEqual {
+				changes++
+			}
+		}
+		if changes != test.changes {
+			t.Errorf("%s: expected %d changes, got %d", test.name, test.changes, changes)
+		}
+	}
+}
+
+func TestDiffTooFarApart(t *testing.T) {
+	a := make([]string, 0)
+	b := make([]string, 0)
+	for i := 0; i < maxEditDistance; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	a = append(a, "same\n")
+	b = append(b, "same\n")
+
+	edits := Diff(a, b)
+	from, to := apply(a, edits)
+	if !equalLines(from, a) || !equalLines(to, b) {
+		t.Fatal("edits do not reproduce inputs")
+	}
+	if len(edits) != 2*maxEditDistance+1 || edits[len(edits)-1].Type != OpEqual {
+		t.Errorf("expected the differing lines to be replaced and the common suffix kept, got %d edits", len(edits))
+	}
+}
+
+func TestUnified(t *testing.T) {
+	a := Lines([]byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"))
+	b := Lines([]byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\neleven"))
+
+	buf := new(bytes.Buffer)
+	err := Unified(buf, "a/file", "b/file", a, b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `--- a/file
++++ b/file
+@@ -2,3 +2,3 @@
+ 2
+-3
++three
+ 4
+@@ -10 +10,2 @@
+ 10
++eleven
+\ No newline at end of file
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected diff:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	err = Unified(buf, "a/file", "b/file", a, a, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output for equal inputs, got:\n%s", buf.String())
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		expected           string
+		expectedConflict   bool
+	}{
+		{
+			name:     "only ours changed",
+			base:     "a\nb\nc\n",
+			ours:     "a\nB\nc\n",
+			theirs:   "a\nb\nc\n",
+			expected: "a\nB\nc\n",
+		},
+		{
+			name:     "separate changes",
+			base:     "1\n2\n3\n4\n5\n6\n",
+			ours:     "one\n2\n3\n4\n5\n6\n",
+			theirs:   "1\n2\n3\n4\n5\nsix\n",
+			expected: "one\n2\n3\n4\n5\nsix\n",
+		},
+		{
+			name:     "same change on both sides",
+			base:     "a\nb\nc\n",
+			ours:     "a\nx\nc\n",
+			theirs:   "a\nx\nc\n",
+			expected: "a\nx\nc\n",
+		},
+		{
+			name:     "insertions at different places",
+			base:     "a\nb\nc\nd\n",
+			ours:     "start\na\nb\nc\nd\n",
+			theirs:   "a\nb\nc\nd\nend\n",
+			expected: "start\na\nb\nc\nd\nend\n",
+		},
+		{
+			name:             "conflicting change",
+			base:             "a\nb\nc\n",
+			ours:             "a\nours\nc\n",
+			theirs:           "a\ntheirs\nc\n",
+			expected:         "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\nc\n",
+			expectedConflict: true,
+		},
+	}
+
+	for _, test := range tests {
+		merged, conflict := Merge3(Lines([]byte(test.base)), Lines([]byte(test.ours)), Lines([]byte(test.theirs)), "ours", "theirs")
+		if conflict != test.expectedConflict {
+			t.Errorf("%s: expected conflict %v, got %v", test.name, test.expectedConflict, conflict)
+		}
+		if strings.Join(merged, "") != test.expected {
+			t.Errorf("%s: unexpected merge result:\n%s", test.name, strings.Join(merged, ""))
+		}
+	}
+}